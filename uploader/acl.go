@@ -0,0 +1,176 @@
+package uploader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Per-prefix access control lists from the YAML file named by
+// UPLOADER_ACL_FILE:
+//
+//	acls:
+//	  - prefix: team-a
+//	    write: [team-a-ci]
+//	    delete: [team-a-ci, admin]
+//	  - prefix: team-a/shared
+//	    write: ["*"]
+//
+// The rule with the longest prefix containing a key decides for it. Each
+// list names the principals allowed that operation; "*" is any
+// authenticated principal and "anonymous" a request without credentials.
+// An omitted list leaves the operation to the scopes. Writing or deleting
+// a tree must also pass every rule below it, since it replaces or removes
+// what those rules protect.
+const (
+	aclAnyPrincipal = "*"
+	aclAnonymous    = "anonymous"
+)
+
+type aclRule struct {
+	Prefix string   `yaml:"prefix"`
+	Read   []string `yaml:"read"`
+	Write  []string `yaml:"write"`
+	Delete []string `yaml:"delete"`
+}
+
+// acls is the rule set every request is checked against, API and cache
+// endpoints alike; registerRoutes installs it.
+var acls []aclRule
+
+func setACLs(rules []aclRule) { acls = rules }
+
+func loadACLs() ([]aclRule, error) {
+	p := os.Getenv("UPLOADER_ACL_FILE")
+	if p == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("UPLOADER_ACL_FILE: %w", err)
+	}
+
+	rules, err := parseACLs(data)
+	if err != nil {
+		return nil, fmt.Errorf("UPLOADER_ACL_FILE %s: %w", p, err)
+	}
+
+	return rules, nil
+}
+
+func parseACLs(data []byte) ([]aclRule, error) {
+	var doc struct {
+		ACLs []aclRule `yaml:"acls"`
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(doc.ACLs))
+
+	for i := range doc.ACLs {
+		r := &doc.ACLs[i]
+
+		prefix := strings.Trim(path.Clean("/"+r.Prefix), "/")
+		if strings.Contains(r.Prefix, "..") || isReservedPath(prefix) {
+			return nil, fmt.Errorf("acl %d: invalid prefix %q", i+1, r.Prefix)
+		}
+
+		if seen[prefix] {
+			return nil, fmt.Errorf("acl %d: duplicate prefix %q", i+1, r.Prefix)
+		}
+
+		seen[prefix] = true
+		r.Prefix = prefix
+	}
+
+	return doc.ACLs, nil
+}
+
+func (r aclRule) list(scope authScope) []string {
+	switch scope {
+	case scopeRead:
+		return r.Read
+	case scopeWrite:
+		return r.Write
+	default:
+		return r.Delete
+	}
+}
+
+// permits reports whether p (nil when anonymous) may perform scope under
+// the rule.
+func (r aclRule) permits(p *principal, scope authScope) bool {
+	names := r.list(scope)
+	if names == nil {
+		return true
+	}
+
+	for _, name := range names {
+		switch {
+		case p == nil && name == aclAnonymous,
+			p != nil && (name == aclAnyPrincipal || name == p.name):
+			return true
+		}
+	}
+
+	return false
+}
+
+func aclCaller(p *principal) string {
+	if p == nil {
+		return aclAnonymous
+	}
+
+	return p.name
+}
+
+// checkACL applies the rule owning key to scope and explains a denial.
+func checkACL(p *principal, scope authScope, key string) error {
+	var (
+		owner aclRule
+		found bool
+	)
+
+	for _, r := range acls {
+		if keyWithin(key, r.Prefix) && (!found || len(r.Prefix) > len(owner.Prefix)) {
+			owner, found = r, true
+		}
+	}
+
+	if found && !owner.permits(p, scope) {
+		return aclDenied(p, scope, key, owner)
+	}
+
+	return nil
+}
+
+// checkACLTree applies the rules below key, which a tree written, deleted
+// or archived at key would override or expose.
+func checkACLTree(p *principal, scope authScope, key string) error {
+	for _, r := range acls {
+		if r.Prefix != key && keyWithin(r.Prefix, key) && !r.permits(p, scope) {
+			return aclDenied(p, scope, key, r)
+		}
+	}
+
+	return nil
+}
+
+func aclDenied(p *principal, scope authScope, key string, r aclRule) error {
+	return echo.NewHTTPError(http.StatusForbidden,
+		fmt.Sprintf("DENIED: %s may not %s /%s (ACL for /%s)", aclCaller(p), scope, key, r.Prefix))
+}
@@ -0,0 +1,167 @@
+package uploader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testACLs = `
+acls:
+  - prefix: teams/a
+    read: [team-a, admin]
+    write: [team-a]
+    delete: [team-a, admin]
+  - prefix: teams/b
+    write: [team-b]
+    delete: [team-b]
+  - prefix: teams/b/public
+    write: ["*"]
+`
+
+func aclServer(t *testing.T) *echo.Echo {
+	t.Helper()
+
+	rules, err := parseACLs([]byte(testACLs))
+	require.NoError(t, err)
+
+	p := t.TempDir() + "/auth.yaml"
+	writeCredentialFile(t, p, "tokens:\n"+
+		"  - name: team-a\n    sha256: "+sha256Hex([]byte("a"))+"\n"+
+		"  - name: team-b\n    sha256: "+sha256Hex([]byte("b"))+"\n"+
+		"  - name: admin\n    sha256: "+sha256Hex([]byte("admin"))+"\n")
+
+	f, err := loadCredentialFile(p, 0)
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{credentialFile: f, acls: rules, list: listConfig{enabled: true}})
+	t.Cleanup(func() { setACLs(nil) })
+
+	for _, seed := range []struct{ token, key string }{
+		{"a", "teams/a/x.txt"},
+		{"b", "teams/b/y.txt"},
+	} {
+		rec := rawPut(e, "/"+seed.key, []byte(seed.key), bearer(seed.token))
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	return e
+}
+
+func deleteAs(t *testing.T, e *echo.Echo, token, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := buildDeleteRequest(t, "/upload", map[string]string{"path": path})
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestACLWritesAndDeletes(t *testing.T) {
+	e := aclServer(t)
+
+	rec := rawPut(e, "/teams/a/x.txt", []byte("b"), bearer("b"))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "team-b may not write /teams/a/x.txt (ACL for /teams/a)")
+
+	req := buildUploadRequest(t, "teams/a/z.txt", []byte("b"), "")
+	req.Header.Set("Authorization", "Bearer b")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "POST /upload is checked as well")
+
+	rec = rawPut(e, "/teams/b/public/p.txt", []byte("a"), bearer("a"))
+	assert.Equal(t, http.StatusCreated, rec.Code, "the longest prefix decides")
+
+	rec = deleteAs(t, e, "b", "teams/a/x.txt")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = deleteAs(t, e, "admin", "teams")
+	assert.Equal(t, http.StatusForbidden, rec.Code, "deleting the parent would take teams/b with it")
+	assert.Contains(t, rec.Body.String(), "(ACL for /teams/b)")
+
+	rec = deleteAs(t, e, "admin", "teams/a/x.txt")
+	assert.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+}
+
+func TestACLReads(t *testing.T) {
+	e := aclServer(t)
+
+	rec := getWithHeaders(e, http.MethodGet, "/teams/a/x.txt", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "anonymous may not read /teams/a/x.txt")
+
+	rec = getWithHeaders(e, http.MethodGet, "/teams/a/x.txt", bearer("b"))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, "/teams/a/x.txt", bearer("a"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "teams/a/x.txt", rec.Body.String())
+
+	rec = getWithHeaders(e, http.MethodGet, "/teams/b/y.txt", nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "reads under teams/b are not restricted")
+}
+
+func TestACLReadsCoverArchivesAndListings(t *testing.T) {
+	e := aclServer(t)
+
+	rec := getWithHeaders(e, http.MethodGet, "/archive/teams", bearer("b"))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the archive would carry teams/a")
+	assert.Contains(t, rec.Body.String(), "(ACL for /teams/a)")
+
+	rec = getWithHeaders(e, http.MethodGet, "/archive/teams", bearer("a"))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	for token, want := range map[string][]string{
+		"b": {"b", "b/y.txt"},
+		"a": {"a", "a/x.txt", "b", "b/y.txt"},
+	} {
+		rec = getWithHeaders(e, http.MethodGet, listRoute+"?path=teams&recursive=true", bearer(token))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var res listResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+		var names []string
+		for _, entry := range res.Entries {
+			names = append(names, entry.Name)
+		}
+
+		assert.Equal(t, want, names, token)
+	}
+}
+
+func TestACLSweepSkipsProtectedEntries(t *testing.T) {
+	e := aclServer(t)
+
+	req := buildDeleteRequest(t, "/delete", map[string]string{"path": "teams", "days": "-1", "recursive": "true"})
+	req.Header.Set("Authorization", "Bearer admin")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"deleted":["teams/a/x.txt","teams/a"]`)
+
+	rec = getWithHeaders(e, http.MethodGet, "/teams/b/y.txt", nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "admin may not delete under teams/b")
+}
+
+func TestParseACLsRejectsBadPrefixes(t *testing.T) {
+	for _, doc := range []string{
+		"acls:\n  - prefix: ../x\n",
+		"acls:\n  - prefix: " + metaDir + "\n",
+		"acls:\n  - prefix: a\n  - prefix: /a/\n",
+		"acls:\n  - prefix: a\n    list: [x]\n",
+	} {
+		_, err := parseACLs([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
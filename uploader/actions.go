@@ -0,0 +1,603 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+)
+
+// GitHub Actions cache service API as spoken by actions/cache through
+// @actions/cache (the "artifactcache" v1 protocol). Runners find us through
+// ACTIONS_CACHE_URL=http://krci-cache:8080/. The flow is:
+//
+//	POST  /_apis/artifactcache/caches       reserve {key, version} -> {cacheId}
+//	PATCH /_apis/artifactcache/caches/{id}  chunk with Content-Range, any order
+//	POST  /_apis/artifactcache/caches/{id}  commit {size}
+//	GET   /_apis/artifactcache/cache?keys=a,b&version=v  lookup
+//
+// Chunks are written in place into a reservation file in the staging dir
+// and published with the regular staged-file path on commit. Entries live
+// under actions/{version}/ as an archive plus a small JSON record; the
+// record is written last, so lookups never see a half-published entry.
+const (
+	actionsRoutePrefix     = "/_apis/artifactcache"
+	actionsKeyPrefix       = "actions"
+	actionsStagingPrefix   = "gha-"
+	actionsReservationTTL  = time.Hour
+	maxActionsKeyLength    = 512
+	maxActionsRequestBytes = 64 << 10
+)
+
+type actionsConfig struct {
+	enabled bool
+	// Optional bearer token for reserve/upload/commit/lookup. Runners send
+	// their per-job ACTIONS_RUNTIME_TOKEN, which cannot be verified offline.
+	// Without a token the server's own credentials apply when it has any
+	// (set ACTIONS_RUNTIME_TOKEN to a token from UPLOADER_AUTH_FILE), and
+	// any bearer is accepted otherwise.
+	token   string
+	maxSize int64 // 0 means unlimited
+	// reservationTTL is how long a reservation may go without a chunk;
+	// zero means actionsReservationTTL.
+	reservationTTL time.Duration
+}
+
+func loadActionsConfig(maxUploadSize string) (actionsConfig, error) {
+	var cfg actionsConfig
+
+	if v := os.Getenv("UPLOADER_ACTIONS_CACHE"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid UPLOADER_ACTIONS_CACHE %q: %w", v, err)
+		}
+
+		cfg.enabled = enabled
+	}
+
+	cfg.token = os.Getenv("UPLOADER_ACTIONS_CACHE_TOKEN")
+
+	maxSize, err := bytes.Parse(maxUploadSize)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid UPLOADER_MAX_UPLOAD_SIZE %q: %w", maxUploadSize, err)
+	}
+
+	cfg.maxSize = maxSize
+
+	return cfg, nil
+}
+
+// actionsCache holds the in-flight reservations. They are not persisted:
+// after a restart the startup sweep reclaims their files and clients that
+// were mid-upload get a 404 on their next chunk and skip saving. While the
+// server runs, a timer per reservation reclaims it once it goes idle.
+type actionsCache struct {
+	cfg          actionsConfig
+	mu           sync.Mutex
+	nextID       int64
+	reservations map[int64]*actionsReservation
+}
+
+type actionsReservation struct {
+	mu        sync.Mutex
+	key       string
+	version   string
+	tmp       string
+	ranges    map[int64]int64 // chunk start -> end (inclusive)
+	lastWrite time.Time
+	writers   int  // chunks being written
+	closed    bool // committed; no more chunks are taken
+}
+
+// actionsEntry is the JSON record stored next to each archive.
+type actionsEntry struct {
+	Key          string    `json:"key"`
+	Version      string    `json:"version"`
+	Size         int64     `json:"size"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+func registerActionsCacheRoutes(e *echo.Echo, cfg actionsConfig) {
+	if !cfg.enabled {
+		return
+	}
+
+	if cfg.reservationTTL == 0 {
+		cfg.reservationTTL = actionsReservationTTL
+	}
+
+	a := &actionsCache{
+		cfg: cfg,
+		// Seeded from the clock so IDs handed out before a restart are never
+		// reused for a different reservation afterwards.
+		nextID:       time.Now().UnixMilli(),
+		reservations: make(map[int64]*actionsReservation),
+	}
+
+	g := e.Group(actionsRoutePrefix, actionsAuth(cfg.token))
+	g.GET("/cache", a.lookup)
+	g.POST("/caches", a.reserve)
+	g.PATCH("/caches/:id", a.uploadChunk)
+	g.POST("/caches/:id", a.commit)
+	g.GET("/artifacts/:version/:name", actionsDownload)
+}
+
+func isActionsRoute(routePath string) bool {
+	return strings.HasPrefix(routePath, actionsRoutePrefix+"/")
+}
+
+// actionsAuth checks the bearer token on the API calls. Archive downloads
+// stay open: @actions/cache fetches archiveLocation without credentials,
+// the same way it would fetch a pre-signed blob URL.
+func actionsAuth(token string) echo.MiddlewareFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" || c.Path() == actionsRoutePrefix+"/artifacts/:version/:name" {
+				return next(c)
+			}
+
+			got := []byte(c.Request().Header.Get(echo.HeaderAuthorization))
+			if subtle.ConstantTimeCompare(got, expected) != 1 {
+				return echo.ErrUnauthorized
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func actionsEntryName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func actionsArchiveKey(version, name string) string {
+	return actionsKeyPrefix + "/" + version + "/" + name
+}
+
+func actionsRecordKey(version, key string) string {
+	return actionsArchiveKey(version, actionsEntryName(key)) + ".json"
+}
+
+func isActionsKey(key string) bool {
+	return key != "" && len(key) <= maxActionsKeyLength && !strings.Contains(key, ",")
+}
+
+func decodeActionsRequest(c echo.Context, v any) error {
+	if err := json.NewDecoder(io.LimitReader(c.Request().Body, maxActionsRequestBytes)).Decode(v); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+	}
+
+	return nil
+}
+
+func (a *actionsCache) reserve(c echo.Context) error {
+	var req struct {
+		Key       string `json:"key"`
+		Version   string `json:"version"`
+		CacheSize int64  `json:"cacheSize"`
+	}
+
+	if err := decodeActionsRequest(c, &req); err != nil {
+		return err
+	}
+
+	if !isActionsKey(req.Key) || !isSHA256Hex(req.Version) {
+		return echo.NewHTTPError(http.StatusBadRequest, "key must be 1-512 characters without commas and version a hex SHA-256")
+	}
+
+	if a.cfg.maxSize > 0 && req.CacheSize > a.cfg.maxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("cache entry exceeds %d bytes", a.cfg.maxSize))
+	}
+
+	// Committed entries are immutable, as on GitHub.
+	if _, err := store.Stat(c.Request().Context(), actionsRecordKey(req.Version, req.Key)); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "cache entry already exists")
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return storageHTTPError(err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range a.reservations {
+		if r.key == req.Key && r.version == req.Version {
+			return echo.NewHTTPError(http.StatusConflict, "cache entry is being created by another job")
+		}
+	}
+
+	tmp, err := reserveStagingName(actionsStagingPrefix)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// 0644 like the other staged files; the reservation starts empty and
+	// chunks fill it in place.
+	if err := os.WriteFile(tmp, nil, 0o644); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("create reservation: %s", err))
+	}
+
+	a.nextID++
+	r := &actionsReservation{
+		key:       req.Key,
+		version:   req.Version,
+		tmp:       tmp,
+		ranges:    make(map[int64]int64),
+		lastWrite: time.Now(),
+	}
+
+	a.reservations[a.nextID] = r
+	a.expireAfter(a.nextID, r, a.cfg.reservationTTL)
+
+	return c.JSON(http.StatusCreated, map[string]int64{"cacheId": a.nextID})
+}
+
+// expireAfter drops the reservation once its client went away without
+// committing, so its staged file does not pile up until the next restart.
+// A reservation still receiving chunks is checked again when it could next
+// have gone idle; one committed in the meantime is left alone.
+func (a *actionsCache) expireAfter(id int64, r *actionsReservation, d time.Duration) {
+	time.AfterFunc(d, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if a.reservations[id] != r {
+			return
+		}
+
+		r.mu.Lock()
+		idle := time.Since(r.lastWrite)
+		r.mu.Unlock()
+
+		if idle < a.cfg.reservationTTL {
+			a.expireAfter(id, r, a.cfg.reservationTTL-idle)
+			return
+		}
+
+		delete(a.reservations, id)
+		removeStaged(r.tmp)
+	})
+}
+
+func (a *actionsCache) reservation(c echo.Context) (int64, *actionsReservation, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cache id")
+	}
+
+	a.mu.Lock()
+	r, ok := a.reservations[id]
+	a.mu.Unlock()
+
+	if !ok {
+		return 0, nil, echo.NewHTTPError(http.StatusNotFound, "unknown cache reservation")
+	}
+
+	return id, r, nil
+}
+
+// parseContentRange accepts the "bytes start-end/*" form @actions/cache sends.
+func parseContentRange(v string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+
+	spec, _, _ = strings.Cut(spec, "/")
+
+	startStr, endStr, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+
+	start, err1 := strconv.ParseInt(startStr, 10, 64)
+	end, err2 := strconv.ParseInt(endStr, 10, 64)
+
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, false
+	}
+
+	return start, end, true
+}
+
+// uploadChunk writes one chunk at its offset. @actions/cache uploads
+// several chunks concurrently; each request writes through its own file
+// descriptor, so only the range bookkeeping needs the reservation lock.
+// A chunk arriving after the commit is refused, and so is a commit while
+// a chunk is still being written.
+func (a *actionsCache) uploadChunk(c echo.Context) error {
+	_, r, err := a.reservation(c)
+	if err != nil {
+		return err
+	}
+
+	start, end, ok := parseContentRange(c.Request().Header.Get("Content-Range"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing or invalid Content-Range")
+	}
+
+	// The offset comes from the client; bound it so one chunk cannot grow
+	// the reservation file past what an entry may be.
+	if a.cfg.maxSize > 0 && end >= a.cfg.maxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("chunk ends beyond the %d byte limit", a.cfg.maxSize))
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return echo.NewHTTPError(http.StatusConflict, "cache reservation is already committed")
+	}
+
+	r.writers++
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.writers--
+		r.mu.Unlock()
+	}()
+
+	f, err := os.OpenFile(r.tmp, os.O_WRONLY, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("open reservation: %s", err))
+	}
+
+	want := end - start + 1
+	n, copyErr := io.Copy(io.NewOffsetWriter(f, start), io.LimitReader(c.Request().Body, want))
+	closeErr := f.Close()
+
+	if copyErr != nil || closeErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("write chunk: %v", errors.Join(copyErr, closeErr)))
+	}
+
+	if n != want {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("chunk body has %d bytes, Content-Range announces %d", n, want))
+	}
+
+	r.mu.Lock()
+	if prev, ok := r.ranges[start]; !ok || end > prev {
+		r.ranges[start] = end
+	}
+
+	r.lastWrite = time.Now()
+	r.mu.Unlock()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// covered reports whether the received chunks span exactly [0, size)
+// without gaps, so a commit can neither leave a hole nor drop chunks.
+func (r *actionsReservation) covered(size int64) bool {
+	starts := make([]int64, 0, len(r.ranges))
+	for s := range r.ranges {
+		starts = append(starts, s)
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	next := int64(0)
+
+	for _, s := range starts {
+		if s > next {
+			return false
+		}
+
+		if e := r.ranges[s] + 1; e > next {
+			next = e
+		}
+	}
+
+	return next == size
+}
+
+func (a *actionsCache) commit(c echo.Context) error {
+	id, r, err := a.reservation(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Size int64 `json:"size"`
+	}
+
+	if err := decodeActionsRequest(c, &req); err != nil {
+		return err
+	}
+
+	if req.Size < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "size must not be negative")
+	}
+
+	r.mu.Lock()
+	closed, writing, complete := r.closed, r.writers > 0, r.covered(req.Size)
+	if !closed && !writing && complete {
+		r.closed = true
+	}
+	r.mu.Unlock()
+
+	switch {
+	case closed:
+		return echo.NewHTTPError(http.StatusNotFound, "unknown cache reservation")
+	case writing:
+		return echo.NewHTTPError(http.StatusConflict, "chunks are still being uploaded")
+	case !complete:
+		return echo.NewHTTPError(http.StatusBadRequest, "uploaded chunks do not match the committed size")
+	}
+
+	// Claim the reservation before publishing so a concurrent commit of the
+	// same id cannot publish the file twice.
+	a.mu.Lock()
+	if a.reservations[id] != r {
+		a.mu.Unlock()
+		return echo.NewHTTPError(http.StatusNotFound, "unknown cache reservation")
+	}
+
+	delete(a.reservations, id)
+	a.mu.Unlock()
+
+	defer removeStaged(r.tmp)
+
+	// A chunk that failed halfway may have left bytes past the last range.
+	if err := os.Truncate(r.tmp, req.Size); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("finalize reservation: %s", err))
+	}
+
+	record, err := json.Marshal(actionsEntry{Key: r.key, Version: r.version, Size: req.Size, CreationTime: time.Now().UTC()})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	archive := actionsArchiveKey(r.version, actionsEntryName(r.key))
+	if err := publishFileRecord(c.Request().Context(), archive, r.tmp, "", writeCondition{}, actionsRecordKey(r.version, r.key), record); err != nil {
+		return publishHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// lookup resolves keys in order: an exact match on a key wins, otherwise
+// the newest entry whose key starts with it, as GitHub does for the primary
+// key followed by restore-keys. A miss is 204, which the client expects.
+func (a *actionsCache) lookup(c echo.Context) error {
+	version := c.QueryParam("version")
+	keys := strings.Split(c.QueryParam("keys"), ",")
+
+	if !isSHA256Hex(version) || c.QueryParam("keys") == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "keys and version are required")
+	}
+
+	ctx := c.Request().Context()
+
+	var (
+		entries []actionsEntry // loaded on the first prefix lookup
+		loaded  bool
+	)
+
+	for _, key := range keys {
+		var he *echo.HTTPError
+
+		if entry, err := readActionsEntry(c, actionsRecordKey(version, key)); err == nil {
+			return writeActionsHit(c, entry)
+		} else if errors.As(err, &he) {
+			return he
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return storageHTTPError(err)
+		}
+
+		if !loaded {
+			dir := actionsKeyPrefix + "/" + version
+			if err := authorizeKey(ctx, scopeRead, dir); err != nil {
+				return err
+			}
+
+			infos, err := store.List(ctx, dir)
+			if errors.Is(err, fs.ErrNotExist) {
+				return c.NoContent(http.StatusNoContent)
+			}
+
+			if err != nil {
+				return storageHTTPError(err)
+			}
+
+			entries, loaded = loadActionsEntries(c, version, infos), true
+		}
+
+		var best *actionsEntry
+
+		for j := range entries {
+			if strings.HasPrefix(entries[j].Key, key) &&
+				(best == nil || entries[j].CreationTime.After(best.CreationTime)) {
+				best = &entries[j]
+			}
+		}
+
+		if best != nil {
+			return writeActionsHit(c, *best)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func loadActionsEntries(c echo.Context, version string, infos []fs.FileInfo) []actionsEntry {
+	entries := make([]actionsEntry, 0, len(infos)/2)
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+
+		entry, err := readActionsEntry(c, actionsArchiveKey(version, info.Name()))
+		if err == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// readActionsEntry reads the record at key. Prefix matches skip the ones
+// the caller may not read, so they never surface as a hit.
+func readActionsEntry(c echo.Context, key string) (actionsEntry, error) {
+	var entry actionsEntry
+
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return entry, err
+	}
+
+	obj, err := store.Open(c.Request().Context(), key)
+	if err != nil {
+		return entry, err
+	}
+
+	defer func() {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing %s: %v", key, closeErr)
+		}
+	}()
+
+	if err := json.NewDecoder(io.LimitReader(obj, maxActionsRequestBytes)).Decode(&entry); err != nil {
+		return entry, fmt.Errorf("decode %s: %w", key, err)
+	}
+
+	return entry, nil
+}
+
+func writeActionsHit(c echo.Context, entry actionsEntry) error {
+	location := fmt.Sprintf("%s://%s%s/artifacts/%s/%s",
+		c.Scheme(), c.Request().Host, actionsRoutePrefix, entry.Version, actionsEntryName(entry.Key))
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"cacheKey":        entry.Key,
+		"cacheVersion":    entry.Version,
+		"scope":           "",
+		"creationTime":    entry.CreationTime,
+		"archiveLocation": location,
+	})
+}
+
+func actionsDownload(c echo.Context) error {
+	version, name := c.Param("version"), c.Param("name")
+	if !isSHA256Hex(version) || !isSHA256Hex(name) {
+		return echo.ErrNotFound
+	}
+
+	return serveStoredFile(c, actionsArchiveKey(version, name))
+}
@@ -0,0 +1,380 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var actionsTestVersion = strings.Repeat("ab", 32)
+
+func actionsRequest(t *testing.T, e *echo.Echo, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, actionsRoutePrefix+target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// saveActionsEntry runs reserve, chunked upload (last chunk first) and commit.
+func saveActionsEntry(t *testing.T, e *echo.Echo, key, content string) {
+	t.Helper()
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":%q,"version":%q,"cacheSize":%d}`, key, actionsTestVersion, len(content)), nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	target := fmt.Sprintf("/caches/%d", reserved.CacheID)
+	half := len(content) / 2
+
+	for _, chunk := range [][2]int{{half, len(content)}, {0, half}} {
+		rec = actionsRequest(t, e, http.MethodPatch, target, content[chunk[0]:chunk[1]], map[string]string{
+			"Content-Range": fmt.Sprintf("bytes %d-%d/*", chunk[0], chunk[1]-1),
+		})
+		require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	rec = actionsRequest(t, e, http.MethodPost, target, fmt.Sprintf(`{"size":%d}`, len(content)), nil)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+}
+
+func lookupActionsEntry(t *testing.T, e *echo.Echo, keys ...string) (int, map[string]any) {
+	t.Helper()
+
+	q := url.Values{"keys": {strings.Join(keys, ",")}, "version": {actionsTestVersion}}
+	rec := actionsRequest(t, e, http.MethodGet, "/cache?"+q.Encode(), "", nil)
+
+	var hit map[string]any
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hit))
+	}
+
+	return rec.Code, hit
+}
+
+func TestActionsCacheSaveAndRestore(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true}})
+
+	code, _ := lookupActionsEntry(t, e, "npm-linux-abc")
+	assert.Equal(t, http.StatusNoContent, code, "miss before save")
+
+	saveActionsEntry(t, e, "npm-linux-abc", "archive-one")
+	saveActionsEntry(t, e, "npm-linux-def", "archive-two")
+
+	code, hit := lookupActionsEntry(t, e, "npm-linux-abc", "npm-linux-")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "npm-linux-abc", hit["cacheKey"], "exact primary key wins")
+
+	code, hit = lookupActionsEntry(t, e, "npm-linux-zzz", "npm-linux-")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "npm-linux-def", hit["cacheKey"], "newest prefix match for restore keys")
+
+	location, err := url.Parse(hit["archiveLocation"].(string))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, location.Path, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "archive-two", rec.Body.String())
+
+	code, _ = lookupActionsEntry(t, e, "yarn-")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	leftovers, err := filepath.Glob(filepath.Join(tempdir, stagingDir, actionsStagingPrefix+"*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers, "committed reservations must not leave staged files")
+}
+
+func TestActionsCacheReserveConflicts(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true}})
+
+	body := fmt.Sprintf(`{"key":"k","version":%q}`, actionsTestVersion)
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches", body, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = actionsRequest(t, e, http.MethodPost, "/caches", body, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "in-flight reservation")
+
+	saveActionsEntry(t, e, "done", "xy")
+
+	rec = actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"done","version":%q}`, actionsTestVersion), nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "committed entries are immutable")
+
+	rec = actionsRequest(t, e, http.MethodPost, "/caches", `{"key":"a,b","version":"v1"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestActionsCacheCommitRequiresAllChunks(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true}})
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"gap","version":%q}`, actionsTestVersion), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	target := fmt.Sprintf("/caches/%d", reserved.CacheID)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "tail", map[string]string{"Content-Range": "bytes 4-7/*"})
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "short", map[string]string{"Content-Range": "bytes 0-9/*"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "body shorter than the announced range")
+
+	rec = actionsRequest(t, e, http.MethodPost, target, `{"size":8}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, actionsKeyPrefix, actionsTestVersion))
+	assert.True(t, os.IsNotExist(err), "nothing published for an incomplete upload")
+
+	rec = actionsRequest(t, e, http.MethodPatch, "/caches/1", "x", map[string]string{"Content-Range": "bytes 0-0/*"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestActionsCacheCommitMatchesTheChunks(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true}})
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"sized","version":%q}`, actionsTestVersion), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	target := fmt.Sprintf("/caches/%d", reserved.CacheID)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "data", map[string]string{"Content-Range": "bytes 0-3/*"})
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	for _, body := range []string{`{"size":-1}`, `{"size":0}`, `{"size":2}`} {
+		rec = actionsRequest(t, e, http.MethodPost, target, body, nil)
+		assert.Equalf(t, http.StatusBadRequest, rec.Code, "commit %s of 4 uploaded bytes", body)
+	}
+
+	_, err := os.Stat(filepath.Join(tempdir, actionsKeyPrefix, actionsTestVersion))
+	assert.True(t, os.IsNotExist(err), "no entry for a size the chunks do not match")
+
+	rec = actionsRequest(t, e, http.MethodPost, target, `{"size":4}`, nil)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+}
+
+func TestActionsCacheCommitRefusedWhileAChunkIsWritten(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true}})
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"racy","version":%q}`, actionsTestVersion), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	target := fmt.Sprintf("/caches/%d", reserved.CacheID)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "data", map[string]string{"Content-Range": "bytes 0-3/*"})
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// A retry of the same chunk is still being written when the commit
+	// arrives.
+	pr, pw := io.Pipe()
+	done := make(chan int)
+
+	go func() {
+		req := httptest.NewRequest(http.MethodPatch, actionsRoutePrefix+target, pr)
+		req.Header.Set("Content-Range", "bytes 0-3/*")
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		done <- rec.Code
+	}()
+
+	_, err := pw.Write([]byte("da"))
+	require.NoError(t, err)
+
+	rec = actionsRequest(t, e, http.MethodPost, target, `{"size":4}`, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+
+	_, err = pw.Write([]byte("ta"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	require.Equal(t, http.StatusNoContent, <-done)
+
+	rec = actionsRequest(t, e, http.MethodPost, target, `{"size":4}`, nil)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "late", map[string]string{"Content-Range": "bytes 0-3/*"})
+	assert.Equal(t, http.StatusNotFound, rec.Code, "no chunk after the commit")
+}
+
+// A chunk that found its reservation just before the commit claimed it
+// must not write into the file being published.
+func TestActionsCacheClosedReservationRefusesChunks(t *testing.T) {
+	tmp := filepath.Join(t.TempDir(), "reservation")
+	require.NoError(t, os.WriteFile(tmp, []byte("data"), 0o644))
+
+	r := &actionsReservation{tmp: tmp, ranges: map[int64]int64{0: 3}, closed: true}
+	a := &actionsCache{reservations: map[int64]*actionsReservation{1: r}}
+
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader("late"))
+	req.Header.Set("Content-Range", "bytes 0-3/*")
+
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("1")
+
+	var he *echo.HTTPError
+	require.ErrorAs(t, a.uploadChunk(c), &he)
+	assert.Equal(t, http.StatusConflict, he.Code)
+
+	got, err := os.ReadFile(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(got))
+}
+
+func TestActionsCacheToken(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "user:pass",
+		actions:     actionsConfig{enabled: true, token: "s3cret"},
+	})
+
+	code, _ := lookupActionsEntry(t, e, "k")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"k","version":%q}`, actionsTestVersion),
+		map[string]string{echo.HeaderAuthorization: "Bearer s3cret"})
+	assert.Equal(t, http.StatusCreated, rec.Code, "bearer token, not the basic upload credentials")
+}
+
+func TestActionsCacheWithoutTokenUsesServerCredentials(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "user:pass",
+		actions:     actionsConfig{enabled: true},
+	})
+
+	body := fmt.Sprintf(`{"key":"k","version":%q}`, actionsTestVersion)
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches", body, map[string]string{echo.HeaderAuthorization: "Bearer anything"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "no token must not leave the API open")
+
+	rec = actionsRequest(t, e, http.MethodPost, "/caches", body, map[string]string{echo.HeaderAuthorization: basicAuth("user", "pass")})
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+}
+
+func TestActionsCacheBoundsChunksByMaxSize(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true, maxSize: 16}})
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"big","version":%q,"cacheSize":17}`, actionsTestVersion), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"k","version":%q}`, actionsTestVersion), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	target := fmt.Sprintf("/caches/%d", reserved.CacheID)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "x", map[string]string{"Content-Range": "bytes 1099511627776-1099511627776/*"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "xy", map[string]string{"Content-Range": "bytes 15-16/*"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = actionsRequest(t, e, http.MethodPatch, target, "x", map[string]string{"Content-Range": "bytes 15-15/*"})
+	assert.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+}
+
+func TestActionsCacheReservationsExpireOnTimer(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{actions: actionsConfig{enabled: true, reservationTTL: 50 * time.Millisecond}})
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches",
+		fmt.Sprintf(`{"key":"idle","version":%q}`, actionsTestVersion), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	staged := func() []string {
+		matches, err := filepath.Glob(filepath.Join(tempdir, stagingDir, actionsStagingPrefix+"*"))
+		require.NoError(t, err)
+
+		return matches
+	}
+
+	require.Len(t, staged(), 1)
+
+	assert.Eventually(t, func() bool { return len(staged()) == 0 }, 5*time.Second, 10*time.Millisecond,
+		"an idle reservation is reclaimed without another reserve")
+
+	rec = actionsRequest(t, e, http.MethodPatch, fmt.Sprintf("/caches/%d", reserved.CacheID), "x", map[string]string{"Content-Range": "bytes 0-0/*"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestActionsCacheDisabledByDefault(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{})
+
+	rec := actionsRequest(t, e, http.MethodPost, "/caches", `{}`, nil)
+	assert.NotEqual(t, http.StatusCreated, rec.Code)
+
+	code, _ := lookupActionsEntry(t, e, "k")
+	assert.NotEqual(t, http.StatusOK, code)
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, ok := parseContentRange("bytes 33554432-67108863/*")
+	require.True(t, ok)
+	assert.Equal(t, int64(33554432), start)
+	assert.Equal(t, int64(67108863), end)
+
+	for _, bad := range []string{"", "bytes 5-1/*", "items 0-1/*", "bytes -1/*"} {
+		_, _, ok := parseContentRange(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+func TestLoadActionsConfig(t *testing.T) {
+	saveServerGlobals(t)
+
+	t.Setenv("UPLOADER_ACTIONS_CACHE", "true")
+	t.Setenv("UPLOADER_ACTIONS_CACHE_TOKEN", "tok")
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.True(t, cfg.actions.enabled)
+	assert.Equal(t, "tok", cfg.actions.token)
+	assert.Positive(t, cfg.actions.maxSize)
+
+	t.Setenv("UPLOADER_ACTIONS_CACHE", "maybe")
+
+	_, err = loadConfig()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "UPLOADER_ACTIONS_CACHE")
+}
@@ -0,0 +1,239 @@
+package uploader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveFormat is an extraction format as named by the `extract` field and
+// the X-Extract header.
+type archiveFormat string
+
+const (
+	formatTar    archiveFormat = "tar"
+	formatTarGz  archiveFormat = "tar.gz"
+	formatTarZst archiveFormat = "tar.zst"
+	formatTarXz  archiveFormat = "tar.xz"
+	formatTarBz2 archiveFormat = "tar.bz2"
+	formatZip    archiveFormat = "zip"
+	formatAuto   archiveFormat = "auto"
+)
+
+// sniffLen covers the longest magic we look for: "ustar" at offset 257.
+const sniffLen = 262
+
+func parseArchiveFormat(v string) (archiveFormat, error) {
+	switch f := archiveFormat(v); f {
+	case formatTar, formatTarGz, formatTarZst, formatTarXz, formatTarBz2, formatZip, formatAuto:
+		return f, nil
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported extract format %q", v))
+	}
+}
+
+// extractFormat reads the extraction an upload asked for: the `extract`
+// field, or the older targz=true. "" means store the upload as is.
+func extractFormat(fields map[string]string) (archiveFormat, error) {
+	if v := fields["extract"]; v != "" {
+		return parseArchiveFormat(v)
+	}
+
+	if fields["targz"] == "true" {
+		return formatTarGz, nil
+	}
+
+	return "", nil
+}
+
+// detectArchiveFormat maps the leading bytes of an archive to its format.
+func detectArchiveFormat(head []byte) (archiveFormat, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatTarGz, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatTarZst, nil
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return formatTarXz, nil
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return formatTarBz2, nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip, nil
+	case len(head) >= sniffLen && bytes.HasPrefix(head[257:], []byte("ustar")):
+		return formatTar, nil
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, "extract=auto: unrecognized archive format")
+	}
+}
+
+// sniffArchiveFormat detects the format from br without consuming anything.
+func sniffArchiveFormat(br *bufio.Reader) (archiveFormat, error) {
+	head, err := br.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("read archive: %w", err)
+	}
+
+	return detectArchiveFormat(head)
+}
+
+// newDecompressor puts the decompressor for a tar-based format in front of r.
+func newDecompressor(format archiveFormat, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case formatTar:
+		return io.NopCloser(r), nil
+	case formatTarGz:
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+
+		return gzr, nil
+	case formatTarZst:
+		// One goroutine is plenty for a stream we write to disk anyway.
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+
+		return zr.IOReadCloser(), nil
+	case formatTarXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create xz reader: %w", err)
+		}
+
+		return io.NopCloser(xr), nil
+	case formatTarBz2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("%s is not a tar format", format)
+	}
+}
+
+// extractFile extracts the archive at src into dst. Unlike the streaming
+// path it can serve zip, whose central directory sits at the end.
+func extractFile(dst, src string, format archiveFormat) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			log.Printf("error closing archive %s: %v", src, closeErr)
+		}
+	}()
+
+	br := bufio.NewReader(f)
+
+	if format == formatAuto {
+		if format, err = sniffArchiveFormat(br); err != nil {
+			return err
+		}
+	}
+
+	if format == formatZip {
+		return unzip(dst, f)
+	}
+
+	return untar(dst, br, format)
+}
+
+// unzip extracts a zip archive with the same protections as UntarGz: every
+// entry is mapped onto a tar header and goes through processEntry, so path
+// checks, size accounting and link rejection are shared.
+func unzip(dst string, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat archive: %w", err)
+	}
+
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return fmt.Errorf("failed to read zip archive: %w", err)
+	}
+
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for destination: %w", err)
+	}
+
+	var totalWritten int64
+
+	ensuredDirs := map[string]struct{}{absDst: {}}
+
+	for _, entry := range zr.File {
+		header := zipEntryHeader(entry)
+
+		if header.Size > MaxFileSize {
+			return fmt.Errorf("file %s exceeds maximum size limit (%d bytes)", header.Name, MaxFileSize)
+		}
+
+		target := filepath.Join(absDst, header.Name)
+		if !isPathSafe(target, absDst) {
+			return fmt.Errorf("unsafe path detected: %s", header.Name)
+		}
+
+		if err := extractZipEntry(entry, header, target, &totalWritten, ensuredDirs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func zipEntryHeader(entry *zip.File) *tar.Header {
+	mode := entry.Mode()
+	header := &tar.Header{
+		Name: entry.Name,
+		Mode: int64(mode.Perm()),
+		// Clamped so a forged size cannot wrap around the limit check.
+		Size: int64(min(entry.UncompressedSize64, MaxFileSize+1)),
+	}
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+	case mode.IsDir():
+		header.Typeflag = tar.TypeDir
+	case mode.IsRegular():
+		header.Typeflag = tar.TypeReg
+	default:
+		header.Typeflag = tar.TypeChar
+	}
+
+	return header
+}
+
+func extractZipEntry(entry *zip.File, header *tar.Header, target string, totalWritten *int64, ensuredDirs map[string]struct{}) error {
+	if header.Typeflag != tar.TypeReg {
+		return processEntry(header, target, nil, totalWritten, ensuredDirs)
+	}
+
+	rc, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open zip entry %s: %w", header.Name, err)
+	}
+
+	defer func() {
+		if closeErr := rc.Close(); closeErr != nil {
+			log.Printf("warning: failed to close zip entry %s: %v", header.Name, closeErr)
+		}
+	}()
+
+	return processEntry(header, target, rc, totalWritten, ensuredDirs)
+}
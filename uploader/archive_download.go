@@ -0,0 +1,453 @@
+package uploader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+// GET /archive/{path} streams the directory at path as one archive, the
+// download counterpart of an extracting upload. The archive is written
+// straight to the response; nothing is buffered on disk.
+const (
+	archiveRoutePrefix    = "/archive"
+	snapshotStagingPrefix = "snap-"
+)
+
+// Content types of the formats an archive can be downloaded as.
+var archiveContentTypes = map[archiveFormat]string{
+	formatTarGz:  "application/gzip",
+	formatTarZst: "application/zstd",
+	formatZip:    "application/zip",
+}
+
+func registerArchiveRoutes(e *echo.Echo) {
+	e.GET(archiveRoutePrefix+"/*", downloadArchive)
+}
+
+func downloadArchive(c echo.Context) error {
+	format := archiveFormat(c.QueryParam("format"))
+	if format == "" {
+		format = formatTarGz
+	}
+
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported archive format %q (want tar.gz, tar.zst or zip)", format))
+	}
+
+	key, err := safeKey(c.Param("*"))
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	// The archive carries the whole tree, so a read ACL anywhere below key
+	// refuses it.
+	if err := authorizeTree(ctx, scopeRead, key); err != nil {
+		return err
+	}
+
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return storageHTTPError(err)
+	}
+
+	if !info.IsDir() {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is not a directory", c.Param("*")))
+	}
+
+	recordAccess(key)
+
+	tree, release, err := snapshotTree(ctx, key)
+	if err != nil {
+		return storageHTTPError(err)
+	}
+	defer release()
+
+	name := path.Base("/" + key)
+	if key == "" {
+		name = "root"
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, contentType)
+	h.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+"."+string(format)))
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The status is on the wire already; a failure can only cut the stream
+	// short, which the client sees as a truncated archive.
+	if err := writeArchive(c.Response(), tree, format); err != nil {
+		log.Printf("archive %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// snapshotter is implemented by backends that can freeze a directory tree
+// cheaply. Snapshot returns a local directory holding the frozen tree,
+// which the caller removes when done.
+type snapshotter interface {
+	Snapshot(ctx context.Context, key string) (string, error)
+}
+
+// snapshotTree returns a view of the directory at key that no publish of
+// key or below it can change, holding the key lock only while the view is
+// taken. Backends that cannot snapshot get the tree listing pinned
+// instead: every file is read only while it is still the version listed,
+// so a publish racing the download fails it rather than mixing trees.
+func snapshotTree(ctx context.Context, key string) (fs.FS, func(), error) {
+	unlock := lockKey(key)
+	defer unlock()
+
+	if s, ok := store.(snapshotter); ok {
+		dir, err := s.Snapshot(ctx, key)
+		if err == nil {
+			return os.DirFS(dir), func() { removeAllLogged(dir) }, nil
+		}
+
+		log.Printf("archive: snapshot of %s failed, pinning the listing instead: %v", key, err)
+	}
+
+	tree, err := pinTree(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tree, func() {}, nil
+}
+
+// Snapshot hard-links every file below key into a staging dir. Publishes
+// always rename new inodes into place, so the linked files never change,
+// and no file data is copied.
+func (localStorage) Snapshot(_ context.Context, key string) (string, error) {
+	snap, err := os.MkdirTemp(absStagePath, snapshotStagingPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("create snapshot dir: %w", err)
+	}
+
+	src := localPath(key)
+
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+
+		if key == "" && d.IsDir() && (rel == stagingDir || rel == metaDir) {
+			return filepath.SkipDir
+		}
+
+		dst := filepath.Join(snap, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dst, 0o755)
+		case d.Type().IsRegular():
+			return os.Link(p, dst)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		removeAllLogged(snap)
+		return "", fmt.Errorf("snapshot %s: %w", key, err)
+	}
+
+	return snap, nil
+}
+
+// errTreeChanged cuts an archive short when a file was replaced or removed
+// after its tree was pinned.
+var errTreeChanged = errors.New("changed since the archive started")
+
+// pinnedTreeFS is a listing of the tree below root taken under its key
+// lock. Directories come from the listing; files are opened from the
+// backend and refused unless they are still the version listed.
+type pinnedTreeFS struct {
+	storeTreeFS
+	dirs  map[string][]fs.DirEntry
+	files map[string]fs.FileInfo
+}
+
+func pinTree(ctx context.Context, root string) (*pinnedTreeFS, error) {
+	live := storeTreeFS{ctx: ctx, root: root}
+	t := &pinnedTreeFS{storeTreeFS: live, dirs: make(map[string][]fs.DirEntry), files: make(map[string]fs.FileInfo)}
+
+	err := fs.WalkDir(live, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			entries, err := live.ReadDir(name)
+			t.dirs[name] = entries
+
+			return err
+		}
+
+		info, err := d.Info()
+		t.files[name] = info
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *pinnedTreeFS) Stat(name string) (fs.FileInfo, error) {
+	if info, ok := t.files[name]; ok {
+		return info, nil
+	}
+
+	if _, ok := t.dirs[name]; ok {
+		return store.Stat(t.ctx, t.key(name))
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (t *pinnedTreeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, ok := t.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return entries, nil
+}
+
+func (t *pinnedTreeFS) Open(name string) (fs.File, error) {
+	pinned, ok := t.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	obj, err := store.Open(t.ctx, t.key(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errTreeChanged}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := obj.Stat()
+	if err == nil && objectVersion(info) != objectVersion(pinned) {
+		err = &fs.PathError{Op: "open", Path: name, Err: errTreeChanged}
+	}
+
+	if err != nil {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing %s: %v", name, closeErr)
+		}
+
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// objectVersion identifies the content of a file: its ETag where the
+// backend has one (and then only serves that version), its size and mtime
+// otherwise.
+func objectVersion(info fs.FileInfo) string {
+	if e, ok := info.(interface{ ETag() string }); ok && e.ETag() != "" {
+		return e.ETag()
+	}
+
+	return fmt.Sprintf("%d@%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// storeTreeFS exposes the tree below root in the active Storage as an
+// fs.FS, for backends without snapshots.
+type storeTreeFS struct {
+	ctx  context.Context
+	root string
+}
+
+func (t storeTreeFS) key(name string) string {
+	if name == "." {
+		return t.root
+	}
+
+	return joinKey(t.root, name)
+}
+
+func (t storeTreeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return store.Open(t.ctx, t.key(name))
+}
+
+func (t storeTreeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := store.List(t.ctx, t.key(name))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// archiveWriter adds one walked entry to an archive being streamed.
+type archiveWriter interface {
+	add(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+func writeArchive(w io.Writer, tree fs.FS, format archiveFormat) error {
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	walkErr := fs.WalkDir(tree, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return aw.add(name+"/", info, nil)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := tree.Open(name)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if closeErr := f.Close(); closeErr != nil {
+				log.Printf("error closing %s: %v", name, closeErr)
+			}
+		}()
+
+		return aw.add(name, info, f)
+	})
+
+	if err := aw.Close(); walkErr == nil {
+		walkErr = err
+	}
+
+	return walkErr
+}
+
+func newArchiveWriter(w io.Writer, format archiveFormat) (archiveWriter, error) {
+	switch format {
+	case formatTarGz:
+		gzw := gzip.NewWriter(w)
+		return &tarArchiveWriter{tw: tar.NewWriter(gzw), compressor: gzw}, nil
+	case formatTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("create zstd writer: %w", err)
+		}
+
+		return &tarArchiveWriter{tw: tar.NewWriter(zw), compressor: zw}, nil
+	case formatZip:
+		return zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("%s cannot be written", format)
+	}
+}
+
+type tarArchiveWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (a *tarArchiveWriter) add(name string, info fs.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	// Copy at most the size in the header: a snapshot cannot grow, but a
+	// pinned tree reads a backend where a writer could slip in between.
+	_, err = io.CopyN(a.tw, r, header.Size)
+
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	return a.compressor.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a zipArchiveWriter) add(name string, info fs.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if !info.IsDir() {
+		header.Method = zip.Deflate
+	}
+
+	w, err := a.zw.CreateHeader(header)
+	if err != nil || r == nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+
+	return err
+}
+
+func (a zipArchiveWriter) Close() error { return a.zw.Close() }
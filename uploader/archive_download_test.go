@@ -0,0 +1,184 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip extracts a downloaded archive with the upload-side extractor.
+func roundTrip(t *testing.T, body []byte, format archiveFormat) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "download")
+	require.NoError(t, os.WriteFile(src, body, 0o644))
+
+	dst := filepath.Join(dir, "out")
+	require.NoError(t, os.Mkdir(dst, 0o755))
+	require.NoError(t, extractFile(dst, src, format))
+
+	return dst
+}
+
+func TestArchiveDownloadRoundTrips(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/site", archiveFixtures(t)[formatTarGz], map[string]string{extractHeader: "tar.gz"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	for _, format := range []archiveFormat{formatTarGz, formatTarZst, formatZip} {
+		rec = getWithHeaders(e, http.MethodGet, "/archive/site?format="+string(format), nil)
+		require.Equal(t, http.StatusOK, rec.Code, format)
+		assert.Equal(t, archiveContentTypes[format], rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Header().Get("Content-Disposition"), `"site.`+string(format)+`"`)
+
+		assertArchiveTree(t, roundTrip(t, rec.Body.Bytes(), format), string(format))
+	}
+
+	rec = getWithHeaders(e, http.MethodGet, "/archive/site", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assertArchiveTree(t, roundTrip(t, rec.Body.Bytes(), formatAuto), "default format")
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers, "snapshots are removed after the download")
+}
+
+func TestArchiveDownloadRejects(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := rawPut(e, "/dir/file.txt", []byte("x"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	for target, want := range map[string]int{
+		"/archive/dir?format=rar":    http.StatusBadRequest,
+		"/archive/dir/file.txt":      http.StatusBadRequest,
+		"/archive/missing":           http.StatusNotFound,
+		"/archive/" + stagingDir:     http.StatusForbidden,
+		"/archive/" + metaDir:        http.StatusForbidden,
+		"/archive/dir/../../outside": http.StatusForbidden,
+	} {
+		rec = getWithHeaders(e, http.MethodGet, target, nil)
+		assert.Equal(t, want, rec.Code, target)
+	}
+}
+
+func TestArchiveRootSkipsReservedDirs(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := rawPut(e, "/a.txt", []byte("alpha"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, "/archive/", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	out := roundTrip(t, rec.Body.Bytes(), formatTarGz)
+
+	entries, err := os.ReadDir(out)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a.txt", entries[0].Name())
+}
+
+// A tree published after the snapshot was taken must not leak into the
+// archive, even though the old tree is gone from disk by then.
+func TestArchiveSnapshotIgnoresLaterPublish(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := rawPut(e, "/site", archiveFixtures(t)[formatTarGz], map[string]string{extractHeader: "tar.gz"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	tree, release, err := snapshotTree(context.Background(), "site")
+	require.NoError(t, err)
+	defer release()
+
+	rec = rawPut(e, "/site", makeTarGz(t, "N", 2), map[string]string{extractHeader: "tar.gz"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeArchive(&buf, tree, formatTarGz))
+
+	out := roundTrip(t, buf.Bytes(), formatTarGz)
+	assertArchiveTree(t, out, "snapshot")
+
+	_, err = os.Stat(filepath.Join(out, "N-1.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Without snapshots the listing is pinned: a publish does not wait for the
+// download, but the download fails instead of mixing in the new file.
+func TestArchiveWithoutSnapshotPinsTheListing(t *testing.T) {
+	e, _ := memServer(t)
+
+	rec := rawPut(e, "/site/a.txt", []byte("alpha"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	rec = rawPut(e, "/site/dir/b.txt", []byte("beta"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, "/archive/site?format=zip", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assertArchiveTree(t, roundTrip(t, rec.Body.Bytes(), formatZip), "mem backend")
+
+	_, release, err := snapshotTree(context.Background(), "site")
+	require.NoError(t, err)
+	defer release()
+
+	locked := make(chan struct{})
+
+	go func() {
+		unlock := lockKey("site")
+		close(locked)
+		unlock()
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("key lock was held during the download")
+	}
+
+	tree, _, err := snapshotTree(context.Background(), "site")
+	require.NoError(t, err)
+
+	rec = rawPut(e, "/site/dir/b.txt", []byte("replaced"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	err = writeArchive(io.Discard, tree, formatZip)
+	assert.ErrorIs(t, err, errTreeChanged)
+}
+
+// A snapshot of a tree waits for publishes below it, which hold their own
+// keys and not the tree's.
+func TestArchiveSnapshotWaitsForPublishesBelow(t *testing.T) {
+	_, _ = concurrencyServer(t)
+
+	unlock := lockKey("site/dir/b.txt")
+
+	done := make(chan struct{})
+
+	go func() {
+		_, release, _ := snapshotTree(context.Background(), "site")
+		if release != nil {
+			release()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("snapshot taken while a file below was being published")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlock()
+	<-done
+}
@@ -0,0 +1,215 @@
+package uploader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+// The standard library cannot write bzip2, so tar.bz2 comes as a fixture:
+// a.txt ("alpha") and dir/b.txt ("beta"), the same tree as archiveTar.
+const archiveTarBz2 = "QlpoOTFBWSZTWcoCfKYAAIl7gMmAABBAAfeAAIh2ZF5ACEggAHQSkCAAMgDTIJJQBpoNAAA+6HBEYsADSJIQ+HJcUhCJ44oEIYBltZViOBHCgQfBggwffaZwGLoKGNW5oc6vks3XPSPb4qIyJkpkiZiaCIH4u5IpwoSGUBPlMA=="
+
+var archiveTree = map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"}
+
+func archiveTar(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		body := archiveTree[name]
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(body))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func compressWith(t *testing.T, raw []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	w, err := newWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(raw)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+type zipEntry struct {
+	name, body string
+	mode       os.FileMode
+}
+
+func makeZip(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		fh.SetMode(e.mode)
+
+		w, err := zw.CreateHeader(fh)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func archiveFixtures(t *testing.T) map[archiveFormat][]byte {
+	t.Helper()
+
+	raw := archiveTar(t)
+	bz2, err := base64.StdEncoding.DecodeString(archiveTarBz2)
+	require.NoError(t, err)
+
+	return map[archiveFormat][]byte{
+		formatTar: raw,
+		formatTarGz: compressWith(t, raw, func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		}),
+		formatTarZst: compressWith(t, raw, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}),
+		formatTarXz: compressWith(t, raw, func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		}),
+		formatTarBz2: bz2,
+		formatZip:    makeZip(t, zipEntry{"a.txt", "alpha", 0o644}, zipEntry{"dir/", "", os.ModeDir | 0o755}, zipEntry{"dir/b.txt", "beta", 0o644}),
+	}
+}
+
+func assertArchiveTree(t *testing.T, root, msg string) {
+	t.Helper()
+
+	for name, want := range archiveTree {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if assert.NoError(t, err, msg) {
+			assert.Equal(t, want, string(got), msg)
+		}
+	}
+}
+
+func TestUploadExtractsEveryFormat(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	for format, body := range archiveFixtures(t) {
+		for _, requested := range []archiveFormat{format, formatAuto} {
+			dest := filepath.Join("x", string(format), string(requested))
+			msg := string(format) + " as " + string(requested)
+
+			// Streaming path: the fields precede the file.
+			rec := serve(e, buildBatchRequest(t,
+				batchPart{name: "path", value: dest + "/early"},
+				batchPart{name: "extract", value: string(requested)},
+				batchPart{name: "file", filename: "archive", value: string(body)},
+			))
+			require.Equal(t, http.StatusCreated, rec.Code, msg+": "+rec.Body.String())
+			assertArchiveTree(t, filepath.Join(tempdir, dest, "early"), msg)
+
+			// Late path: the file is spooled first and extracted from disk.
+			rec = serve(e, buildUploadRequestWithFields(t, body, map[string]string{"path": dest + "/late", "extract": string(requested)}))
+			require.Equal(t, http.StatusCreated, rec.Code, msg+": "+rec.Body.String())
+			assertArchiveTree(t, filepath.Join(tempdir, dest, "late"), msg)
+
+			rec = rawPut(e, "/"+dest+"/raw", body, map[string]string{extractHeader: string(requested)})
+			require.Equal(t, http.StatusCreated, rec.Code, msg+": "+rec.Body.String())
+			assertArchiveTree(t, filepath.Join(tempdir, dest, "raw"), msg)
+		}
+	}
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestUploadRejectsUnknownExtractFormat(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := serve(e, buildBatchRequest(t,
+		batchPart{name: "path", value: "out"},
+		batchPart{name: "extract", value: "rar"},
+		batchPart{name: "file", filename: "a.rar", value: "Rar!"},
+	))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = rawPut(e, "/out", []byte("plain text, not an archive"), map[string]string{extractHeader: "auto"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "unrecognized archive format")
+
+	_, err := os.Stat(filepath.Join(tempdir, "out"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTargzFieldStillExtracts(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := serve(e, buildUploadRequest(t, "legacy", archiveFixtures(t)[formatTarGz], "true"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assertArchiveTree(t, filepath.Join(tempdir, "legacy"), "targz=true")
+}
+
+func TestUnzipKeepsUntarProtections(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []zipEntry
+		want    string
+	}{
+		{"traversal", []zipEntry{{"../evil.txt", "x", 0o644}}, "unsafe path detected"},
+		{"absolute", []zipEntry{{"/../../evil.txt", "x", 0o644}}, "unsafe path detected"},
+		{"symlink", []zipEntry{{"link", "/etc/passwd", os.ModeSymlink | 0o777}}, "symlinks and hard links are not allowed"},
+	} {
+		dir := t.TempDir()
+		src := filepath.Join(dir, "a.zip")
+		require.NoError(t, os.WriteFile(src, makeZip(t, tc.entries...), 0o644))
+
+		dst := filepath.Join(dir, "out")
+		require.NoError(t, os.Mkdir(dst, 0o755))
+
+		err := extractFile(dst, src, formatZip)
+		require.Error(t, err, tc.name)
+		assert.Contains(t, err.Error(), tc.want, tc.name)
+
+		_, err = os.Lstat(filepath.Join(dir, "evil.txt"))
+		assert.True(t, os.IsNotExist(err), tc.name)
+	}
+}
+
+func TestDetectArchiveFormat(t *testing.T) {
+	for format, body := range archiveFixtures(t) {
+		got, err := detectArchiveFormat(body[:min(len(body), sniffLen)])
+		require.NoError(t, err, format)
+		assert.Equal(t, format, got)
+	}
+
+	_, err := detectArchiveFormat([]byte("hello"))
+	assert.Error(t, err)
+}
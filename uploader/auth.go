@@ -0,0 +1,681 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Credentials beyond the single UPLOADER_UPLOAD_CREDENTIALS pair come from
+// the file named by UPLOADER_AUTH_FILE, either YAML:
+//
+//	users:
+//	  - name: team-a-ci
+//	    password: $2y$10$...     # bcrypt
+//	    scopes: [read, write]
+//	    prefixes: [team-a]
+//	tokens:
+//	  - name: team-b-deploy
+//	    sha256: 9f86d0...        # hex SHA-256 of the bearer token
+//	    scopes: [read, write, delete]
+//	    prefixes: [team-b]
+//
+// or htpasswd with bcrypt hashes, optionally followed by scopes and
+// prefixes: "team-a-ci:$2y$10$...:read,write:team-a". Omitted scopes grant
+// all of them and omitted prefixes the whole tree. The file is re-read when
+// its size or mtime changes.
+type authScope uint8
+
+const (
+	scopeRead authScope = 1 << iota
+	scopeWrite
+	scopeDelete
+
+	allScopes = scopeRead | scopeWrite | scopeDelete
+)
+
+const credentialReloadInterval = 5 * time.Second
+
+var scopeNames = []struct {
+	name  string
+	scope authScope
+}{
+	{"read", scopeRead},
+	{"write", scopeWrite},
+	{"delete", scopeDelete},
+}
+
+func parseScopes(names []string) (authScope, error) {
+	if len(names) == 0 {
+		return allScopes, nil
+	}
+
+	var scopes authScope
+
+	for _, name := range names {
+		found := false
+
+		for _, s := range scopeNames {
+			if s.name == name {
+				scopes |= s.scope
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+
+	return scopes, nil
+}
+
+func (s authScope) String() string {
+	var names []string
+
+	for _, n := range scopeNames {
+		if s&n.scope != 0 {
+			names = append(names, n.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// principal is an authenticated caller: what it may do, and where. No
+// prefixes means the whole tree.
+type principal struct {
+	name     string
+	scopes   authScope
+	prefixes []string
+}
+
+func (p *principal) allows(key string) bool {
+	if len(p.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range p.prefixes {
+		if keyWithin(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parsePrefixes(prefixes []string) ([]string, error) {
+	out := make([]string, 0, len(prefixes))
+
+	for _, p := range prefixes {
+		prefix := strings.Trim(path.Clean("/"+p), "/")
+		if strings.Contains(p, "..") || prefix == "" || isReservedPath(prefix) {
+			return nil, fmt.Errorf("invalid prefix %q", p)
+		}
+
+		out = append(out, prefix)
+	}
+
+	return out, nil
+}
+
+type principalCtxKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// principalFrom returns the caller the auth middleware attached to ctx, or
+// nil for anonymous requests and background work.
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalCtxKey{}).(*principal)
+	return p
+}
+
+// authorizeKey checks the caller on ctx against key: its scopes and
+// prefixes, then the ACLs. Anonymous requests got past registerAuth
+// already, so only the ACLs apply to them.
+func authorizeKey(ctx context.Context, scope authScope, key string) error {
+	p := principalFrom(ctx)
+
+	if p != nil && p.scopes&scope == 0 {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("DENIED: %s lacks the %s scope", p.name, scope))
+	}
+
+	if p != nil && !p.allows(key) {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("DENIED: %s may not access /%s", p.name, key))
+	}
+
+	return checkACL(p, scope, key)
+}
+
+// authorizeTree is authorizeKey for an operation that may cover a whole
+// tree at key (a write, a delete or an archive download), which must pass
+// the ACLs below key as well.
+func authorizeTree(ctx context.Context, scope authScope, key string) error {
+	if err := authorizeKey(ctx, scope, key); err != nil {
+		return err
+	}
+
+	return checkACLTree(principalFrom(ctx), scope, key)
+}
+
+// readAuthConfig makes GET and HEAD require credentials too, except below
+// the public prefixes. /health stays open regardless, for probes.
+type readAuthConfig struct {
+	required       bool
+	publicPrefixes []string
+}
+
+func loadReadAuthConfig(authEnabled bool) (readAuthConfig, error) {
+	var cfg readAuthConfig
+
+	if v := os.Getenv("UPLOADER_AUTH_READS"); v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid UPLOADER_AUTH_READS %q: %w", v, err)
+		}
+
+		cfg.required = required
+	}
+
+	if cfg.required && !authEnabled {
+		return cfg, errors.New("UPLOADER_AUTH_READS requires UPLOADER_UPLOAD_CREDENTIALS, UPLOADER_AUTH_FILE or UPLOADER_SA_AUDIENCE")
+	}
+
+	if v := os.Getenv("UPLOADER_PUBLIC_PREFIXES"); v != "" {
+		for _, raw := range strings.Split(v, ",") {
+			if raw = strings.TrimSpace(raw); raw == "" {
+				continue
+			}
+
+			prefix := strings.Trim(path.Clean("/"+raw), "/")
+			if strings.Contains(raw, "..") || prefix == "" || isReservedPath(prefix) {
+				return cfg, fmt.Errorf("invalid UPLOADER_PUBLIC_PREFIXES entry %q", raw)
+			}
+
+			cfg.publicPrefixes = append(cfg.publicPrefixes, prefix)
+		}
+	}
+
+	return cfg, nil
+}
+
+// isPublic reports whether a request path lies below a public prefix.
+// Paths are matched as requested, so /ac/... and /cache/... are public
+// through "ac" and "cache", like the keys they store.
+func (cfg readAuthConfig) isPublic(requestPath string) bool {
+	p := strings.Trim(path.Clean("/"+requestPath), "/")
+
+	for _, prefix := range cfg.publicPrefixes {
+		if keyWithin(p, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requiredScope maps a request to the scope it needs. A tus upload is
+// written, read back and cancelled by the uploader, so all of it is write.
+// Minting a presigned URL needs the scope of the method it signs, which
+// the handler checks.
+func requiredScope(c echo.Context) authScope {
+	if isTusRoute(c.Path()) {
+		return scopeWrite
+	}
+
+	if c.Path() == presignRoute {
+		return 0
+	}
+
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead:
+		return scopeRead
+	case http.MethodDelete:
+		return scopeDelete
+	default:
+		return scopeWrite
+	}
+}
+
+type credentialUser struct {
+	principal
+	hash []byte
+}
+
+type credentialToken struct {
+	principal
+	sum []byte
+}
+
+// credentialSet is one parsed credentials file. Verified passwords are
+// remembered by their SHA-256 so bcrypt only runs once per password, not
+// once per request; a reload starts from scratch.
+type credentialSet struct {
+	users    map[string]*credentialUser
+	tokens   []*credentialToken
+	verified sync.Map
+}
+
+type credentialFileYAML struct {
+	Users []struct {
+		Name     string   `yaml:"name"`
+		Password string   `yaml:"password"`
+		Scopes   []string `yaml:"scopes"`
+		Prefixes []string `yaml:"prefixes"`
+	} `yaml:"users"`
+	Tokens []struct {
+		Name     string   `yaml:"name"`
+		SHA256   string   `yaml:"sha256"`
+		Scopes   []string `yaml:"scopes"`
+		Prefixes []string `yaml:"prefixes"`
+	} `yaml:"tokens"`
+}
+
+func parseCredentialFile(name string, data []byte) (*credentialSet, error) {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		return parseCredentialYAML(data)
+	default:
+		return parseHtpasswd(data)
+	}
+}
+
+func newPrincipal(name string, scopes, prefixes []string) (principal, error) {
+	if name == "" {
+		return principal{}, errors.New("missing name")
+	}
+
+	s, err := parseScopes(scopes)
+	if err != nil {
+		return principal{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	p, err := parsePrefixes(prefixes)
+	if err != nil {
+		return principal{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return principal{name: name, scopes: s, prefixes: p}, nil
+}
+
+func (s *credentialSet) addUser(p principal, hash string) error {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("%s: password must be a bcrypt hash", p.name)
+	}
+
+	if _, dup := s.users[p.name]; dup {
+		return fmt.Errorf("duplicate user %s", p.name)
+	}
+
+	s.users[p.name] = &credentialUser{principal: p, hash: []byte(hash)}
+
+	return nil
+}
+
+func parseCredentialYAML(data []byte) (*credentialSet, error) {
+	var doc credentialFileYAML
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	set := &credentialSet{users: make(map[string]*credentialUser)}
+
+	for _, u := range doc.Users {
+		p, err := newPrincipal(u.Name, u.Scopes, u.Prefixes)
+		if err != nil {
+			return nil, fmt.Errorf("user %w", err)
+		}
+
+		if err := set.addUser(p, u.Password); err != nil {
+			return nil, fmt.Errorf("user %w", err)
+		}
+	}
+
+	for _, t := range doc.Tokens {
+		p, err := newPrincipal(t.Name, t.Scopes, t.Prefixes)
+		if err != nil {
+			return nil, fmt.Errorf("token %w", err)
+		}
+
+		sum, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("token %s: sha256 must be 64 hex characters", t.Name)
+		}
+
+		set.tokens = append(set.tokens, &credentialToken{principal: p, sum: sum})
+	}
+
+	return set, nil
+}
+
+func parseHtpasswd(data []byte) (*credentialSet, error) {
+	set := &credentialSet{users: make(map[string]*credentialUser)}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+
+	for sc.Scan() {
+		line++
+
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ":")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: want name:hash[:scopes[:prefixes]]", line)
+		}
+
+		var scopes, prefixes []string
+		if len(fields) > 2 && fields[2] != "" {
+			scopes = strings.Split(fields[2], ",")
+		}
+
+		if len(fields) > 3 && fields[3] != "" {
+			prefixes = strings.Split(fields[3], ",")
+		}
+
+		p, err := newPrincipal(fields[0], scopes, prefixes)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if err := set.addUser(p, fields[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+
+	return set, sc.Err()
+}
+
+func (s *credentialSet) checkPassword(name, password string) *principal {
+	u, ok := s.users[name]
+	if !ok {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(password))
+
+	if v, ok := s.verified.Load(name); ok && subtle.ConstantTimeCompare(v.([]byte), sum[:]) == 1 {
+		return &u.principal
+	}
+
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return nil
+	}
+
+	s.verified.Store(name, sum[:])
+
+	return &u.principal
+}
+
+func (s *credentialSet) checkToken(token string) *principal {
+	sum := sha256.Sum256([]byte(token))
+
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(t.sum, sum[:]) == 1 {
+			return &t.principal
+		}
+	}
+
+	return nil
+}
+
+// lookup returns the user, or else the token, called name.
+func (s *credentialSet) lookup(name string) *principal {
+	if u, ok := s.users[name]; ok {
+		return &u.principal
+	}
+
+	for _, t := range s.tokens {
+		if t.name == name {
+			return &t.principal
+		}
+	}
+
+	return nil
+}
+
+// credentialFile hot-reloads a credentials file: requests stat it at most
+// once per interval and re-parse it when it changed. A file that fails to
+// parse is logged and the previous credentials stay in force.
+type credentialFile struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	set     *credentialSet
+	size    int64
+	modTime time.Time
+	checked time.Time
+}
+
+func loadCredentialFile(p string, interval time.Duration) (*credentialFile, error) {
+	f := &credentialFile{path: p, interval: interval}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *credentialFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	set, err := parseCredentialFile(f.path, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.set, f.size, f.modTime = set, info.Size(), info.ModTime()
+
+	return nil
+}
+
+func (f *credentialFile) current() *credentialSet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) < f.interval {
+		return f.set
+	}
+
+	f.checked = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		log.Printf("credentials file %s: %v", f.path, err)
+		return f.set
+	}
+
+	if info.Size() == f.size && info.ModTime().Equal(f.modTime) {
+		return f.set
+	}
+
+	if err := f.reload(); err != nil {
+		log.Printf("credentials file not reloaded: %v", err)
+		return f.set
+	}
+
+	log.Printf("credentials file %s reloaded", f.path)
+
+	return f.set
+}
+
+// authenticator resolves the Authorization header to a principal. The
+// single UPLOADER_UPLOAD_CREDENTIALS pair is a principal with every scope.
+type authenticator struct {
+	static          *principal
+	checkStatic     func(user, pass string) bool
+	file            *credentialFile
+	serviceAccounts *serviceAccountAuth
+	presign         presignConfig
+}
+
+func newAuthenticator(cfg serverConfig) *authenticator {
+	a := &authenticator{file: cfg.credentialFile, serviceAccounts: cfg.serviceAccounts, presign: cfg.presign}
+
+	if cfg.credentials != "" {
+		user, _, _ := strings.Cut(cfg.credentials, ":")
+		validate := basicAuthValidator(cfg.credentials)
+
+		a.static = &principal{name: user, scopes: allScopes}
+		a.checkStatic = func(user, pass string) bool {
+			ok, _ := validate(user, pass, nil)
+			return ok
+		}
+	}
+
+	return a
+}
+
+func (a *authenticator) authenticate(r *http.Request) *principal {
+	header := r.Header.Get(echo.HeaderAuthorization)
+
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		if a.file != nil {
+			if p := a.file.current().checkToken(token); p != nil {
+				return p
+			}
+		}
+
+		if a.serviceAccounts == nil || !isJWT(token) {
+			return nil
+		}
+
+		p, err := a.serviceAccounts.verify(token, time.Now())
+		if err != nil {
+			log.Printf("service account token rejected: %v", err)
+		}
+
+		return p
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+
+	if a.static != nil && a.checkStatic(user, pass) {
+		return a.static
+	}
+
+	if a.file != nil {
+		return a.file.current().checkPassword(user, pass)
+	}
+
+	return nil
+}
+
+// lookup finds the principal called name among the credentials as they
+// are now, trying the sources in the order authenticate does, or nil when
+// nobody has that name any more.
+func (a *authenticator) lookup(name string) *principal {
+	if a.static != nil && a.static.name == name {
+		return a.static
+	}
+
+	if a.file != nil {
+		if p := a.file.current().lookup(name); p != nil {
+			return p
+		}
+	}
+
+	if a.serviceAccounts != nil {
+		if p, err := a.serviceAccounts.principalFor(name); err == nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// authMode is how a route treats credentials.
+type authMode int
+
+const (
+	// authExempt routes bring their own credentials or none at all.
+	authExempt authMode = iota
+	// authOptional routes are open, but a caller that sends credentials is
+	// known to the ACLs.
+	authOptional
+	authRequired
+)
+
+// middleware authenticates requests as mode decides, checks the scope the
+// route needs and attaches the principal to the request context for the
+// per-key checks further down.
+func (a *authenticator) middleware(mode func(echo.Context) authMode) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			m := mode(c)
+			if m == authExempt {
+				return next(c)
+			}
+
+			var p *principal
+
+			if isPresigned(c.Request()) {
+				signed, err := a.verifyPresigned(c.Request())
+				if err != nil {
+					return err
+				}
+
+				p = signed
+			} else {
+				p = a.authenticate(c.Request())
+			}
+
+			if p == nil && m == authOptional {
+				return next(c)
+			}
+
+			if p == nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "basic realm=Restricted")
+				return echo.ErrUnauthorized
+			}
+
+			if scope := requiredScope(c); scope != 0 && p.scopes&scope == 0 {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("DENIED: %s lacks the %s scope", p.name, scope))
+			}
+
+			c.SetRequest(c.Request().WithContext(withPrincipal(c.Request().Context(), p)))
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	return string(hash)
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+// writeCredentialFile writes content to the credentials file at p and
+// moves its mtime forward, so a rewrite within the same second still
+// reads as a change.
+func writeCredentialFile(t *testing.T, p, content string) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+
+	next := time.Now().Add(time.Duration(len(content)) * time.Second)
+	require.NoError(t, os.Chtimes(p, next, next))
+}
+
+func credentialServer(t *testing.T, name, content string) (*echo.Echo, string) {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), name)
+	writeCredentialFile(t, p, content)
+
+	f, err := loadCredentialFile(p, 0)
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{credentialFile: f})
+
+	return e, p
+}
+
+func TestCredentialFileScopesAndPrefixes(t *testing.T) {
+	e, _ := credentialServer(t, "auth.yaml", `
+users:
+  - name: team-a
+    password: `+bcryptHash(t, "a-secret")+`
+    scopes: [read, write]
+    prefixes: [team-a]
+tokens:
+  - name: team-b
+    sha256: `+sha256Hex([]byte("b-token"))+`
+    prefixes: [team-b]
+`)
+
+	teamA := map[string]string{"Authorization": basicAuth("team-a", "a-secret")}
+
+	rec := rawPut(e, "/team-a/x.txt", []byte("a"), teamA)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, "/team-b/x.txt", []byte("a"), teamA)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "team-a may not access /team-b/x.txt")
+
+	req := buildDeleteRequest(t, "/upload", map[string]string{"path": "team-a/x.txt"})
+	req.Header.Set("Authorization", teamA["Authorization"])
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "team-a has no delete scope")
+	assert.Contains(t, rec.Body.String(), "lacks the delete scope")
+
+	rec = rawPut(e, "/team-b/y.txt", []byte("b"), bearer("b-token"))
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	req = buildUploadRequest(t, "team-a/y.txt", []byte("b"), "")
+	req.Header.Set("Authorization", "Bearer b-token")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the form path is checked too")
+
+	req = buildDeleteRequest(t, "/upload", map[string]string{"path": "team-b/y.txt"})
+	req.Header.Set("Authorization", "Bearer b-token")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	for _, h := range []map[string]string{
+		nil,
+		{"Authorization": basicAuth("team-a", "wrong")},
+		bearer("unknown"),
+	} {
+		rec = rawPut(e, "/team-a/z.txt", []byte("z"), h)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestCredentialFileHtpasswd(t *testing.T) {
+	e, _ := credentialServer(t, "htpasswd", strings.Join([]string{
+		"# pipelines",
+		"ci:" + bcryptHash(t, "ci-secret"),
+		"reader:" + bcryptHash(t, "r-secret") + ":read",
+	}, "\n"))
+
+	rec := rawPut(e, "/any/where.txt", []byte("x"), map[string]string{"Authorization": basicAuth("ci", "ci-secret")})
+	assert.Equal(t, http.StatusCreated, rec.Code, "no scopes or prefixes grants everything")
+
+	rec = rawPut(e, "/any/where.txt", []byte("x"), map[string]string{"Authorization": basicAuth("reader", "r-secret")})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestCredentialFileHotReload(t *testing.T) {
+	e, p := credentialServer(t, "auth.yaml", "tokens:\n  - name: old\n    sha256: "+sha256Hex([]byte("old-token"))+"\n")
+
+	rec := rawPut(e, "/x.txt", []byte("x"), bearer("old-token"))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	writeCredentialFile(t, p, "tokens:\n  - name: new\n    sha256: "+sha256Hex([]byte("new-token"))+"\n")
+
+	rec = rawPut(e, "/x.txt", []byte("x"), bearer("old-token"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "the rotated token is gone")
+
+	rec = rawPut(e, "/x.txt", []byte("x"), bearer("new-token"))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	writeCredentialFile(t, p, "tokens:\n  - name: broken\n")
+
+	rec = rawPut(e, "/x.txt", []byte("x"), bearer("new-token"))
+	assert.Equal(t, http.StatusCreated, rec.Code, "a broken file keeps the last good credentials")
+}
+
+func TestLegacyCredentialsKeepEveryScope(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{credentials: "ci:secret"})
+
+	rec := rawPut(e, "/x.txt", []byte("x"), map[string]string{"Authorization": basicAuth("ci", "secret")})
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	req := buildDeleteRequest(t, "/upload", map[string]string{"path": "x.txt"})
+	req.Header.Set("Authorization", basicAuth("ci", "secret"))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
+
+func TestParseCredentialFileRejectsBadEntries(t *testing.T) {
+	hash := bcryptHash(t, "x")
+
+	for name, content := range map[string]string{
+		"plain.yaml":    "users:\n  - name: a\n    password: plaintext\n",
+		"scope.yaml":    "users:\n  - name: a\n    password: " + hash + "\n    scopes: [admin]\n",
+		"prefix.yaml":   "users:\n  - name: a\n    password: " + hash + "\n    prefixes: [../up]\n",
+		"reserved.yaml": "users:\n  - name: a\n    password: " + hash + "\n    prefixes: [" + stagingDir + "]\n",
+		"token.yaml":    "tokens:\n  - name: a\n    sha256: abc\n",
+		"field.yaml":    "users:\n  - name: a\n    hash: " + hash + "\n",
+		"dup.htpasswd":  "a:" + hash + "\na:" + hash + "\n",
+		"md5.htpasswd":  "a:$apr1$abc$def\n",
+	} {
+		_, err := parseCredentialFile(name, []byte(content))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestReadAuthRequiresCredentialsOutsidePublicPrefixes(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "ci:secret",
+		readAuth:    readAuthConfig{required: true, publicPrefixes: []string{"docs"}},
+	})
+
+	auth := map[string]string{"Authorization": basicAuth("ci", "secret")}
+
+	for _, name := range []string{"/secret.txt", "/docs/readme.txt"} {
+		rec := rawPut(e, name, []byte(name), auth)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := getWithHeaders(e, method, "/secret.txt", nil)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, method)
+		assert.NotEmpty(t, rec.Header().Get(echo.HeaderWWWAuthenticate))
+
+		rec = getWithHeaders(e, method, "/secret.txt", auth)
+		assert.Equal(t, http.StatusOK, rec.Code, method)
+
+		rec = getWithHeaders(e, method, "/docs/readme.txt", nil)
+		assert.Equal(t, http.StatusOK, rec.Code, method)
+	}
+
+	rec := getWithHeaders(e, http.MethodGet, "/docs/../secret.txt", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "prefixes match the cleaned path")
+
+	rec = getWithHeaders(e, http.MethodGet, healthPath, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "probes never need credentials")
+}
+
+func TestLoadReadAuthConfig(t *testing.T) {
+	cfg, err := loadReadAuthConfig(false)
+	require.NoError(t, err)
+	assert.False(t, cfg.required, "reads are open by default")
+
+	t.Setenv("UPLOADER_AUTH_READS", "true")
+	t.Setenv("UPLOADER_PUBLIC_PREFIXES", "docs, /releases/")
+
+	_, err = loadReadAuthConfig(false)
+	require.Error(t, err, "nobody could read without credentials to check")
+
+	cfg, err = loadReadAuthConfig(true)
+	require.NoError(t, err)
+	assert.Equal(t, readAuthConfig{required: true, publicPrefixes: []string{"docs", "releases"}}, cfg)
+
+	for _, v := range []string{"/", "../up", stagingDir} {
+		t.Setenv("UPLOADER_PUBLIC_PREFIXES", v)
+
+		_, err = loadReadAuthConfig(true)
+		assert.Error(t, err, v)
+	}
+}
+
+// Version lists, tags and cache records name what a protocol tree holds,
+// so they take read access like the objects they point at.
+func TestProtocolRecordReadsCheckPrincipalPrefixes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "auth.yaml")
+	writeCredentialFile(t, p, "tokens:\n"+
+		"  - name: ci\n    sha256: "+sha256Hex([]byte("ci"))+"\n"+
+		"  - name: team-a\n    sha256: "+sha256Hex([]byte("a"))+"\n    prefixes: [team-a]\n")
+
+	f, err := loadCredentialFile(p, 0)
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{credentialFile: f, actions: actionsConfig{enabled: true}})
+
+	for _, name := range []string{"v1.0.0.mod", "v1.0.0.info"} {
+		req := buildUploadRequest(t, "goproxy/example.com/m/@v/"+name, []byte("{}"), "")
+		req.Header.Set("Authorization", "Bearer ci")
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	rec := ociRequest(e, http.MethodPut, "/v2/team/app/manifests/latest",
+		[]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`), bearer("ci"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = actionsRequest(t, e, http.MethodPost, "/caches", fmt.Sprintf(`{"key":"k","version":%q}`, actionsTestVersion), bearer("ci"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var reserved struct{ CacheID int64 }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reserved))
+
+	target := fmt.Sprintf("/caches/%d", reserved.CacheID)
+	rec = actionsRequest(t, e, http.MethodPatch, target, "x", map[string]string{"Content-Range": "bytes 0-0/*", "Authorization": "Bearer ci"})
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = actionsRequest(t, e, http.MethodPost, target, `{"size":1}`, bearer("ci"))
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	lookup := actionsRoutePrefix + "/cache?keys=k&version=" + actionsTestVersion
+
+	for _, target := range []string{"/goproxy/example.com/m/@v/list", "/goproxy/example.com/m/@latest", lookup} {
+		rec = getWithHeaders(e, http.MethodGet, target, bearer("a"))
+		assert.Equal(t, http.StatusForbidden, rec.Code, target)
+
+		rec = getWithHeaders(e, http.MethodGet, target, bearer("ci"))
+		assert.Less(t, rec.Code, 300, target)
+	}
+
+	rec = getWithHeaders(e, http.MethodHead, "/v2/team/app/manifests/latest", bearer("a"))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Docker-Content-Digest"), "the tag must not resolve for a caller who may not read it")
+}
+
+func TestProtocolReadsCheckPrincipalPrefixes(t *testing.T) {
+	e, _ := credentialServer(t, "auth.yaml", "tokens:\n"+
+		"  - name: ci\n    sha256: "+sha256Hex([]byte("ci"))+"\n"+
+		"  - name: team-a\n    sha256: "+sha256Hex([]byte("a"))+"\n    prefixes: [team-a]\n")
+
+	blob := []byte("blob")
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+
+	rec := rawPut(e, "/cas/"+sha256Hex(blob), blob, bearer("ci"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/app/manifests/latest", manifest, bearer("ci"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	for _, target := range []string{"/cas/" + sha256Hex(blob), "/v2/team/app/manifests/latest"} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			rec = getWithHeaders(e, method, target, bearer("a"))
+			assert.Equal(t, http.StatusForbidden, rec.Code, method+" "+target)
+
+			rec = getWithHeaders(e, method, target, bearer("ci"))
+			assert.Equal(t, http.StatusOK, rec.Code, method+" "+target)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// publishBatch publishes the staged files of a multi-file upload as one
+// unit. Every key is locked (all at once, so two batches cannot deadlock)
+// and checked before the first rename; the objects about to be
+// replaced are copied into the staging dir so a publish failing halfway
+// can put them back.
+func publishBatch(ctx context.Context, files []*uploadedFile, cond writeCondition) error {
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		keys = append(keys, f.key)
+	}
+
+	unlock := lockKeys(keys...)
+	defer unlock()
+
+	backups := make(map[string]stagedUpload, len(files))
+
+	defer func() {
+		for _, b := range backups {
+			removeStaged(b.tmp)
+		}
+	}()
+
+	for _, f := range files {
+		if err := checkWrite(ctx, f.key, cond); err != nil {
+			return err
+		}
+
+		b, err := backupObject(ctx, f.key)
+		if err != nil {
+			return err
+		}
+
+		if b.tmp != "" {
+			backups[f.key] = b
+		}
+	}
+
+	for i, f := range files {
+		if err := store.PublishFile(ctx, f.key, f.staged.tmp); err != nil {
+			rollbackBatch(ctx, files[:i], backups)
+			return fmt.Errorf("publish %s: %w", f.resolvedPath, err)
+		}
+
+		recordDigest(ctx, f.key, f.staged.sha256)
+	}
+
+	return nil
+}
+
+// backupObject copies the object at key into the staging dir. A missing
+// object yields a zero stagedUpload: rolling back means deleting the key.
+func backupObject(ctx context.Context, key string) (stagedUpload, error) {
+	obj, err := store.Open(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return stagedUpload{}, nil
+	}
+
+	if err != nil {
+		return stagedUpload{}, fmt.Errorf("back up %s: %w", key, err)
+	}
+
+	defer func() {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing %s: %v", key, closeErr)
+		}
+	}()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return stagedUpload{}, fmt.Errorf("back up %s: %w", key, err)
+	}
+
+	if info.IsDir() {
+		return stagedUpload{}, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("%s is a directory", key))
+	}
+
+	var b stagedUpload
+
+	b.tmp, b.size, b.sha256, err = streamPartToStagedTemp(obj)
+	if err != nil {
+		removeStaged(b.tmp)
+		return stagedUpload{}, fmt.Errorf("back up %s: %w", key, err)
+	}
+
+	return b, nil
+}
+
+// rollbackBatch undoes the publishes that succeeded before a batch failed.
+// Failures are logged: the request is already failing, and the remaining
+// keys are still worth restoring.
+func rollbackBatch(ctx context.Context, published []*uploadedFile, backups map[string]stagedUpload) {
+	for _, f := range published {
+		b, ok := backups[f.key]
+		if !ok {
+			if err := deleteKey(ctx, f.key); err != nil {
+				log.Printf("batch rollback: delete %s: %v", f.key, err)
+			}
+
+			continue
+		}
+
+		if err := store.PublishFile(ctx, f.key, b.tmp); err != nil {
+			log.Printf("batch rollback: restore %s: %v", f.key, err)
+			continue
+		}
+
+		recordDigest(ctx, f.key, b.sha256)
+	}
+}
@@ -0,0 +1,232 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchPart is one step of a hand-built multipart body: a field when
+// filename is empty, a file part otherwise.
+type batchPart struct {
+	name, filename, value string
+}
+
+func buildBatchRequest(t *testing.T, parts ...batchPart) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	for _, p := range parts {
+		if p.filename == "" {
+			require.NoError(t, w.WriteField(p.name, p.value))
+			continue
+		}
+
+		fw, err := w.CreateFormFile(p.name, p.filename)
+		require.NoError(t, err)
+		_, err = fw.Write([]byte(p.value))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+
+	return req
+}
+
+func serve(e http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestUploadManyFilesUnderPrefix(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := serve(e, buildBatchRequest(t,
+		batchPart{name: "prefix", value: "reports/run-7"},
+		batchPart{name: "file", filename: "junit.xml", value: "<xml/>"},
+		batchPart{name: "file", filename: "coverage.out", value: "mode: set"},
+		batchPart{name: "path", value: "summaries/run-7.md"},
+		batchPart{name: "file", filename: "summary.md", value: "# ok"},
+	))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var res struct {
+		Count int `json:"count"`
+		Files []struct {
+			Path   string `json:"path"`
+			Size   int64  `json:"size"`
+			SHA256 string `json:"sha256"`
+		} `json:"files"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.Equal(t, 3, res.Count)
+	assert.Equal(t, "reports/run-7/junit.xml", res.Files[0].Path)
+	assert.EqualValues(t, 6, res.Files[0].Size)
+	assert.Equal(t, "reports/run-7/coverage.out", res.Files[1].Path)
+	assert.Equal(t, "summaries/run-7.md", res.Files[2].Path, "a path field binds to the next file")
+	assert.Equal(t, sha256Hex([]byte("# ok")), res.Files[2].SHA256)
+
+	for path, want := range map[string]string{
+		"reports/run-7/junit.xml":    "<xml/>",
+		"reports/run-7/coverage.out": "mode: set",
+		"summaries/run-7.md":         "# ok",
+	} {
+		got, err := os.ReadFile(filepath.Join(tempdir, filepath.FromSlash(path)))
+		require.NoError(t, err, path)
+		assert.Equal(t, want, string(got))
+	}
+}
+
+func TestUploadManyFilesIsAllOrNothing(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempdir, "taken.txt"), []byte("old"), 0o644))
+
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		parts  []batchPart
+		want   int
+	}{
+		{
+			name: "checksum mismatch on the last file",
+			parts: []batchPart{
+				{name: "file", filename: "a.txt", value: "a"},
+				{name: sha256Field, value: strings.Repeat("0", 64)},
+				{name: "file", filename: "b.txt", value: "b"},
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:   "one destination already exists",
+			header: map[string]string{"If-None-Match": "*"},
+			parts: []batchPart{
+				{name: "file", filename: "a.txt", value: "a"},
+				{name: "file", filename: "taken.txt", value: "new"},
+			},
+			want: http.StatusPreconditionFailed,
+		},
+		{
+			name: "duplicate destination",
+			parts: []batchPart{
+				{name: "file", filename: "a.txt", value: "a"},
+				{name: "file", filename: "a.txt", value: "again"},
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "traversal in one path",
+			parts: []batchPart{
+				{name: "file", filename: "a.txt", value: "a"},
+				{name: "path", value: "../escape.txt"},
+				{name: "file", filename: "b.txt", value: "b"},
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "trailing path is ambiguous",
+			parts: []batchPart{
+				{name: "file", filename: "a.txt", value: "a"},
+				{name: "file", filename: "b.txt", value: "b"},
+				{name: "path", value: "where.txt"},
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "targz with several files",
+			parts: []batchPart{
+				{name: "targz", value: "true"},
+				{name: "file", filename: "a.txt", value: "a"},
+				{name: "file", filename: "b.txt", value: "b"},
+			},
+			want: http.StatusBadRequest,
+		},
+	} {
+		req := buildBatchRequest(t, tc.parts...)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+
+		rec := serve(e, req)
+		assert.Equal(t, tc.want, rec.Code, tc.name)
+
+		for _, name := range []string{"a.txt", "b.txt"} {
+			_, err := os.Stat(filepath.Join(tempdir, name))
+			assert.True(t, os.IsNotExist(err), "%s: %s must not be published", tc.name, name)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "taken.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(got))
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+// failingPublishStorage fails PublishFile for one key, the only way to hit
+// the rollback path after every check has passed.
+type failingPublishStorage struct {
+	Storage
+	failKey string
+}
+
+func (f failingPublishStorage) PublishFile(ctx context.Context, key, staged string) error {
+	if key == f.failKey {
+		return errors.New("disk on fire")
+	}
+
+	return f.Storage.PublishFile(ctx, key, staged)
+}
+
+func TestUploadManyFilesRollsBackFailedPublish(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/keep.txt", []byte("old"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	original := store
+	setStorage(failingPublishStorage{Storage: original, failKey: "broken.txt"})
+	t.Cleanup(func() { setStorage(original) })
+
+	rec = serve(e, buildBatchRequest(t,
+		batchPart{name: "file", filename: "keep.txt", value: "new"},
+		batchPart{name: "file", filename: "fresh.txt", value: "fresh"},
+		batchPart{name: "file", filename: "broken.txt", value: "x"},
+	))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "keep.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(got), "replaced file is restored")
+
+	_, err = os.Stat(filepath.Join(tempdir, "fresh.txt"))
+	assert.True(t, os.IsNotExist(err), "new file is removed")
+
+	rec = getWithHeaders(e, http.MethodGet, "/keep.txt", nil)
+	assert.Equal(t, `"`+sha256Hex([]byte("old"))+`"`, rec.Header().Get("ETag"))
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
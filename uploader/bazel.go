@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Bazel HTTP remote caching protocol (https://bazel.build/remote/caching):
+// action-cache results under /ac/{sha256}, content-addressed blobs under
+// /cas/{sha256}. Entries are stored at the same keys in the cache root so
+// the age-based cleanup endpoints cover them unchanged.
+const (
+	bazelACPrefix  = "ac"
+	bazelCASPrefix = "cas"
+)
+
+func registerBazelRoutes(e *echo.Echo) {
+	for _, prefix := range []string{bazelACPrefix, bazelCASPrefix} {
+		route := "/" + prefix + "/:hash"
+
+		e.GET(route, bazelGet)
+		e.HEAD(route, bazelHead)
+		e.PUT(route, bazelPut)
+	}
+}
+
+// bazelKey validates the hash path segment and maps the request onto its
+// storage key. Both AC and CAS keys are lowercase hex SHA-256.
+func bazelKey(c echo.Context) (string, string, error) {
+	hash := c.Param("hash")
+	if !isSHA256Hex(hash) {
+		return "", "", echo.NewHTTPError(http.StatusBadRequest, "key must be a lowercase hex SHA-256")
+	}
+
+	prefix := bazelACPrefix
+	if c.Path() == "/"+bazelCASPrefix+"/:hash" {
+		prefix = bazelCASPrefix
+	}
+
+	return prefix, prefix + "/" + hash, nil
+}
+
+func bazelGet(c echo.Context) error {
+	_, key, err := bazelKey(c)
+	if err != nil {
+		return err
+	}
+
+	return serveStoredFile(c, key)
+}
+
+func bazelHead(c echo.Context) error {
+	_, key, err := bazelKey(c)
+	if err != nil {
+		return err
+	}
+
+	return statStoredFile(c, key)
+}
+
+// bazelPut stages the body through the regular upload path and only
+// publishes it once a CAS entry's content is proven to match its key, so a
+// truncated or corrupted upload can never poison the cache.
+func bazelPut(c echo.Context) error {
+	prefix, key, err := bazelKey(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, _, sum, err := streamPartToStagedTemp(c.Request().Body)
+	defer removeStaged(tmp)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("stage upload: %s", err))
+	}
+
+	if prefix == bazelCASPrefix && sum != c.Param("hash") {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("content hash %s does not match key", sum))
+	}
+
+	if err := publishFileDigest(c.Request().Context(), key, tmp, sum, writeCondition{}); err != nil {
+		return publishHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
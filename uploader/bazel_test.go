@@ -0,0 +1,127 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBazelCASRoundTrip(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	blob := []byte("compiled object")
+	hash := sha256Hex(blob)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/cas/"+hash, bytes.NewReader(blob)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "cas", hash))
+	require.NoError(t, err)
+	assert.Equal(t, blob, got)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cas/"+hash, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, blob, rec.Body.Bytes())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/cas/"+hash, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "15", rec.Header().Get("Content-Length"))
+}
+
+func TestBazelCASRejectsHashMismatch(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	hash := sha256Hex([]byte("expected"))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/cas/"+hash, strings.NewReader("tampered")))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, "cas", hash))
+	assert.True(t, os.IsNotExist(err), "mismatched blob must not be published")
+
+	staged, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, staged, "rejected upload must not leak a staging file")
+}
+
+// AC entries are keyed by the action digest, not by their own content.
+func TestBazelACAcceptsArbitraryContent(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	hash := sha256Hex([]byte("action"))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/ac/"+hash, strings.NewReader("action result proto")))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ac/"+hash, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "action result proto", rec.Body.String())
+}
+
+func TestBazelMissingAndInvalidKeys(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	missing := sha256Hex([]byte("nope"))
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/ac/" + missing, http.StatusNotFound},
+		{http.MethodHead, "/cas/" + missing, http.StatusNotFound},
+		{http.MethodGet, "/cas/not-a-hash", http.StatusBadRequest},
+		{http.MethodPut, "/ac/" + strings.ToUpper(missing), http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader("x")))
+		assert.Equalf(t, tc.want, rec.Code, "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestBazelConcurrentCASWriters(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	blob := bytes.Repeat([]byte("B"), 128*1024)
+	hash := sha256Hex(blob)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/cas/"+hash, bytes.NewReader(blob)))
+			assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		}()
+	}
+
+	wg.Wait()
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "cas", hash))
+	require.NoError(t, err)
+	assert.Equal(t, hash, sha256Hex(got))
+}
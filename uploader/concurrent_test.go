@@ -27,12 +27,21 @@ import (
 func concurrencyServer(t *testing.T) (*echo.Echo, string) {
 	t.Helper()
 
+	return configuredServer(t, serverConfig{})
+}
+
+// configuredServer is concurrencyServer with auth and route-group settings
+// taken from cfg, registered in the same order as Uploader().
+func configuredServer(t *testing.T, cfg serverConfig) (*echo.Echo, string) {
+	t.Helper()
+
 	tempdir := withStagingDir(t)
 	require.NoError(t, setupStagingDir())
 
 	e := echo.New()
 	e.HideBanner = true
-	registerRoutes(e, http.FileServer(hideStagingFS{root: http.Dir(tempdir)}))
+	registerAuth(e, cfg)
+	registerRoutes(e, cfg, hideStagingFS{root: http.Dir(tempdir)})
 
 	return e, tempdir
 }
@@ -354,12 +363,13 @@ func TestStagingDirRejectedFromMutatingHandlers(t *testing.T) {
 func TestDeleteOldFilesRecursiveDir(t *testing.T) {
 	e, tempdir := concurrencyServer(t)
 
-	// Make a non-empty directory whose mtime is well in the past.
+	// Make a directory whose contents are all well in the past.
 	stale := filepath.Join(tempdir, "stale-dir")
 	require.NoError(t, os.MkdirAll(stale, 0o755))
 	require.NoError(t, os.WriteFile(filepath.Join(stale, "inside.txt"), []byte("x"), 0o644))
 
 	old := time.Now().Add(-30 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(stale, "inside.txt"), old, old))
 	require.NoError(t, os.Chtimes(stale, old, old))
 
 	req := buildDeleteRequest(t, "/delete", map[string]string{
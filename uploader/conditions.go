@@ -0,0 +1,165 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// writeCondition carries the If-Match / If-None-Match preconditions of an
+// upload. Each list holds entity tags as sent, or "*" for "any current
+// object". The zero value imposes nothing.
+type writeCondition struct {
+	ifMatch     []string
+	ifNoneMatch []string
+}
+
+func writeConditionFromRequest(h http.Header) writeCondition {
+	return writeCondition{
+		ifMatch:     parseETagList(h.Values("If-Match")),
+		ifNoneMatch: parseETagList(h.Values("If-None-Match")),
+	}
+}
+
+func parseETagList(values []string) []string {
+	var tags []string
+
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
+
+// Immutable prefixes come from UPLOADER_IMMUTABLE_PREFIXES. Like store, the
+// list is package state so every publish path enforces it, protocol
+// endpoints included; registerRoutes installs it.
+var immutablePrefixes []string
+
+func setImmutablePrefixes(prefixes []string) { immutablePrefixes = prefixes }
+
+func loadImmutablePrefixes() ([]string, error) {
+	v := os.Getenv("UPLOADER_IMMUTABLE_PREFIXES")
+	if v == "" {
+		return nil, nil
+	}
+
+	var prefixes []string
+
+	for _, raw := range strings.Split(v, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+
+		prefix := strings.Trim(path.Clean("/"+raw), "/")
+		if strings.Contains(raw, "..") || isReservedPath(prefix) {
+			return nil, fmt.Errorf("invalid UPLOADER_IMMUTABLE_PREFIXES entry %q", raw)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// keyWithin reports whether key is prefix or below it; "" covers everything.
+func keyWithin(key, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// checkWrite decides whether an upload may replace key. It runs once
+// before the body is read, to fail fast, and again under lockKey right
+// before the publish, which is the check that counts: every publish of the
+// key, of a tree above it or of anything below it is serialized behind
+// that lock in this process, so nothing can land between the check and the
+// rename.
+func checkWrite(ctx context.Context, key string, cond writeCondition) error {
+	if err := authorizeTree(ctx, scopeWrite, key); err != nil {
+		return err
+	}
+
+	info, err := store.Stat(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("stat %s: %s", key, err))
+	}
+
+	exists := err == nil
+
+	if err := checkImmutable(ctx, key, exists); err != nil {
+		return err
+	}
+
+	var current string
+	if exists {
+		current = lookupDigest(ctx, key, info)
+	}
+
+	if len(cond.ifMatch) > 0 && !exists {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "If-Match: path does not exist")
+	}
+
+	if len(cond.ifMatch) > 0 && !etagListMatches(cond.ifMatch, current, false) {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "If-Match: current ETag does not match")
+	}
+
+	if exists && etagListMatches(cond.ifNoneMatch, current, true) {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "If-None-Match: path already exists")
+	}
+
+	return nil
+}
+
+// checkImmutable refuses to replace anything under an immutable prefix. A
+// tree publish above a prefix would replace what is below it too, so an
+// existing prefix inside key counts as an overwrite as well.
+func checkImmutable(ctx context.Context, key string, exists bool) error {
+	for _, prefix := range immutablePrefixes {
+		if exists && keyWithin(key, prefix) {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("DENIED: %s is immutable", key))
+		}
+
+		if prefix != key && keyWithin(prefix, key) {
+			if _, err := store.Stat(ctx, prefix); err == nil {
+				return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("DENIED: %s would replace immutable %s", key, prefix))
+			}
+		}
+	}
+
+	return nil
+}
+
+// etagListMatches evaluates an If-Match (strong comparison) or
+// If-None-Match (weak comparison) list against the current ETag. Objects
+// without a recorded digest only match "*".
+func etagListMatches(tags []string, current string, weak bool) bool {
+	for _, tag := range tags {
+		if tag == "*" {
+			return true
+		}
+
+		if current == "" {
+			continue
+		}
+
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == `"`+current+`"` {
+			return true
+		}
+	}
+
+	return false
+}
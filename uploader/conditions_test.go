@@ -0,0 +1,146 @@
+package uploader
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIfNoneMatchStarRefusesOverwrite(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/release.bin", []byte("v1"), map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, "/release.bin", []byte("v2"), map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	req := buildUploadRequest(t, "release.bin", []byte("v3"), "")
+	req.Header.Set("If-None-Match", "*")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "release.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(got))
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+// All writers pass the early check before any of them publishes; only the
+// check under the key lock keeps the second one from landing.
+func TestIfNoneMatchStarIsRaceFree(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	const writers = 16
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = make(map[int]int)
+	)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			rec := rawPut(e, "/once.bin", []byte(fmt.Sprintf("writer-%d", i)), map[string]string{"If-None-Match": "*"})
+
+			mu.Lock()
+			codes[rec.Code]++
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, map[int]int{http.StatusCreated: 1, http.StatusPreconditionFailed: writers - 1}, codes)
+
+	rec := getWithHeaders(e, http.MethodGet, "/once.bin", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "once.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, `"`+sha256Hex(got)+`"`, rec.Header().Get("ETag"), "the record describes the winner")
+}
+
+func TestIfMatchReplacesOnlyKnownVersion(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/state.json", []byte("v1"), map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code, "If-Match needs an existing object")
+
+	rec = rawPut(e, "/state.json", []byte("v1"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	v1 := `"` + sha256Hex([]byte("v1")) + `"`
+
+	rec = rawPut(e, "/state.json", []byte("v2"), map[string]string{"If-Match": v1})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, "/state.json", []byte("v3"), map[string]string{"If-Match": v1})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code, "stale ETag")
+
+	rec = rawPut(e, "/state.json", []byte("v3"), map[string]string{"If-Match": "W/" + `"` + sha256Hex([]byte("v2")) + `"`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code, "weak tags never match If-Match")
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "state.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(got))
+}
+
+func TestImmutablePrefixesRejectOverwrites(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{immutablePrefixes: []string{"releases"}})
+	t.Cleanup(func() { setImmutablePrefixes(nil) })
+
+	rec := rawPut(e, "/releases/1.0/app.bin", []byte("first"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, "/releases/1.0/app.bin", []byte("second"), nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "immutable")
+
+	rec = rawPut(e, "/releases/1.0", makeTarGz(t, "I", 1), map[string]string{extractHeader: "tar.gz"})
+	assert.Equal(t, http.StatusConflict, rec.Code, "replacing the parent tree is an overwrite too")
+
+	rec = rawPut(e, "/releases/1.1/app.bin", []byte("new"), nil)
+	assert.Equal(t, http.StatusCreated, rec.Code, "new paths are fine")
+
+	rec = rawPut(e, "/snapshots/app.bin", []byte("a"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	rec = rawPut(e, "/snapshots/app.bin", []byte("b"), nil)
+	assert.Equal(t, http.StatusCreated, rec.Code, "other prefixes stay mutable")
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "releases", "1.0", "app.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(got))
+}
+
+func TestLoadImmutablePrefixes(t *testing.T) {
+	saveServerGlobals(t)
+
+	t.Setenv("UPLOADER_IMMUTABLE_PREFIXES", "/releases/, tags ,,")
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"releases", "tags"}, cfg.immutablePrefixes)
+
+	t.Setenv("UPLOADER_IMMUTABLE_PREFIXES", "../outside")
+
+	_, err = loadConfig()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "UPLOADER_IMMUTABLE_PREFIXES")
+}
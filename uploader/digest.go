@@ -0,0 +1,92 @@
+package uploader
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Clients can assert the SHA-256 of what they send, either as a hex `sha256`
+// form field or as an RFC 3230 Digest / RFC 9530 Content-Digest header
+// (base64). On multipart uploads every assertion applies to the file part,
+// not the multipart framing around it.
+const sha256Field = "sha256"
+
+var digestHeaders = []string{"Digest", "Content-Digest"}
+
+// expectedSHA256 returns every SHA-256 the request asserts, as lowercase hex.
+// A digest header that carries no sha-256 member is rejected rather than
+// ignored: the client asked for a verification we cannot perform.
+func expectedSHA256(h http.Header, fields map[string]string) ([]string, error) {
+	var want []string
+
+	if v, ok := fields[sha256Field]; ok {
+		sum := strings.ToLower(strings.TrimSpace(v))
+		if !isSHA256Hex(sum) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "sha256 field must be a hex SHA-256")
+		}
+
+		want = append(want, sum)
+	}
+
+	for _, name := range digestHeaders {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+
+		sum, ok := parseDigestHeader(strings.Join(values, ","))
+		if !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s header must carry a base64 sha-256 value", name))
+		}
+
+		want = append(want, sum)
+	}
+
+	return want, nil
+}
+
+// parseDigestHeader extracts the sha-256 member of a Digest
+// ("sha-256=<b64>") or Content-Digest ("sha-256=:<b64>:") header value.
+func parseDigestHeader(value string) (string, bool) {
+	for _, member := range strings.Split(value, ",") {
+		alg, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+
+		// Structured-field byte sequences are wrapped in colons and may
+		// carry parameters; neither is part of the value.
+		encoded, _, _ = strings.Cut(encoded, ";")
+
+		raw, err := base64.StdEncoding.DecodeString(strings.Trim(encoded, ":"))
+		if err != nil || len(raw) != 32 {
+			return "", false
+		}
+
+		return hex.EncodeToString(raw), true
+	}
+
+	return "", false
+}
+
+// verifySHA256 compares the digest computed while staging an upload with
+// every digest the request asserted; nothing may be published on mismatch.
+func verifySHA256(h http.Header, fields map[string]string, got string) error {
+	want, err := expectedSHA256(h, fields)
+	if err != nil {
+		return err
+	}
+
+	for _, sum := range want {
+		if sum != got {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("checksum mismatch: expected sha256 %s, got %s", sum, got))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildUploadRequestWithFields sends the file part first and the extra
+// fields after it, the order that forces verification to wait for the body.
+func buildUploadRequestWithFields(t *testing.T, content []byte, fields map[string]string) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	part, err := w.CreateFormFile("file", "payload.bin")
+	require.NoError(t, err)
+	_, err = part.Write(content)
+	require.NoError(t, err)
+
+	for k, v := range fields {
+		require.NoError(t, w.WriteField(k, v))
+	}
+
+	require.NoError(t, w.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+
+	return req
+}
+
+func base64SHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUploadVerifiesSHA256Field(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	content := []byte("checked content")
+
+	req := buildUploadRequestWithFields(t, content, map[string]string{"path": "bad.bin", sha256Field: strings.Repeat("0", 64)})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "checksum mismatch")
+
+	_, err := os.Stat(filepath.Join(tempdir, "bad.bin"))
+	assert.True(t, os.IsNotExist(err), "mismatched upload must not be published")
+
+	req = buildUploadRequestWithFields(t, content, map[string]string{"path": "good.bin", sha256Field: strings.ToUpper(sha256Hex(content))})
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var res map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, sha256Hex(content), res["sha256"])
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestUploadVerifiesDigestHeaders(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	content := []byte("header checked")
+
+	for _, tc := range []struct {
+		name, header, value string
+		want                int
+	}{
+		{"digest", "Digest", "md5=abc, SHA-256=" + base64SHA256(content), http.StatusCreated},
+		{"content-digest", "Content-Digest", "sha-256=:" + base64SHA256(content) + ":", http.StatusCreated},
+		{"mismatch", "Content-Digest", "sha-256=:" + base64SHA256([]byte("other")) + ":", http.StatusBadRequest},
+		{"no sha-256", "Digest", "md5=HUXZLQLMuI/KZ5KDcJPcOA==", http.StatusBadRequest},
+		{"malformed", "Digest", "sha-256=not-base64", http.StatusBadRequest},
+	} {
+		req := buildUploadRequest(t, tc.name+".bin", content, "")
+		req.Header.Set(tc.header, tc.value)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, tc.want, rec.Code, tc.name)
+
+		_, err := os.Stat(filepath.Join(tempdir, tc.name+".bin"))
+		assert.Equal(t, tc.want == http.StatusCreated, err == nil, tc.name)
+	}
+}
+
+func TestUploadVerifiesArchiveDigest(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	archive := makeTarGz(t, "D", 2)
+
+	// Raw PUT extracts while streaming, multipart with path after the file
+	// extracts from the temp copy; both digests cover the archive bytes.
+	rec := rawPut(e, "/extracted", archive, map[string]string{
+		extractHeader:    "tar.gz",
+		"Content-Digest": "sha-256=:" + base64SHA256([]byte("nope")) + ":",
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, "extracted"))
+	assert.True(t, os.IsNotExist(err))
+
+	req := buildUploadRequest(t, "site", archive, "true")
+	req.Header.Set("Digest", "sha-256="+base64SHA256(archive))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), sha256Hex(archive))
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestRawPutReturnsDigest(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := rawPut(e, "/raw.bin", []byte("raw"), map[string]string{"Digest": "sha-256=" + base64SHA256([]byte("raw"))})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), sha256Hex([]byte("raw")))
+}
@@ -0,0 +1,420 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+)
+
+// Size-based eviction. When UPLOADER_QUOTA is set, a background loop sums
+// up the eviction units of the cache and, once they pass the high-water
+// mark, deletes the least recently accessed ones until usage is below the
+// low-water mark. Access times are tracked in memory on every download and
+// publish, since relatime makes atime useless; units nobody touched since
+// the start fall back to their newest mtime. The staging dir is never
+// listed, and units with a publish in flight are skipped.
+const (
+	defaultEvictionHighWatermark = 90
+	defaultEvictionLowWatermark  = 80
+	defaultEvictionInterval      = time.Minute
+)
+
+type evictionConfig struct {
+	quota    int64
+	high     int
+	low      int
+	interval time.Duration
+}
+
+func loadEvictionConfig() (evictionConfig, error) {
+	cfg := evictionConfig{
+		high:     defaultEvictionHighWatermark,
+		low:      defaultEvictionLowWatermark,
+		interval: defaultEvictionInterval,
+	}
+
+	if v := os.Getenv("UPLOADER_QUOTA"); v != "" {
+		quota, err := bytes.Parse(v)
+		if err != nil || quota <= 0 {
+			return cfg, fmt.Errorf("invalid UPLOADER_QUOTA %q", v)
+		}
+
+		cfg.quota = quota
+	}
+
+	for name, dst := range map[string]*int{
+		"UPLOADER_QUOTA_HIGH_WATERMARK": &cfg.high,
+		"UPLOADER_QUOTA_LOW_WATERMARK":  &cfg.low,
+	} {
+		if v := os.Getenv(name); v != "" {
+			percent, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+			if err != nil {
+				return cfg, fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+
+			*dst = percent
+		}
+	}
+
+	if cfg.low <= 0 || cfg.low >= cfg.high || cfg.high > 100 {
+		return cfg, fmt.Errorf("quota watermarks must satisfy 0 < low (%d%%) < high (%d%%) <= 100", cfg.low, cfg.high)
+	}
+
+	if v := os.Getenv("UPLOADER_EVICTION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid UPLOADER_EVICTION_INTERVAL %q", v)
+		}
+
+		cfg.interval = d
+	}
+
+	return cfg, nil
+}
+
+func (cfg evictionConfig) highBytes() int64 { return cfg.quota * int64(cfg.high) / 100 }
+func (cfg evictionConfig) lowBytes() int64  { return cfg.quota * int64(cfg.low) / 100 }
+
+// A unit is a top-level entry, the way trees are uploaded, except below
+// the protocol roots: each protocol keeps its whole cache under one root,
+// so there the unit is what a client addresses. That is a Bazel or Gradle
+// entry, a Turborepo artifact or Actions cache entry together with its
+// .json record, an OCI blob or one repository's manifests, and a Go
+// module's version dir.
+var evictionUnitDepths = map[string]int{
+	bazelCASPrefix:   2,
+	bazelACPrefix:    2,
+	gradleKeyPrefix:  2,
+	turboKeyPrefix:   3,
+	actionsKeyPrefix: 3,
+}
+
+// evictionMember cuts key to the stored entry that is deleted as a whole,
+// and reports false for a key above that depth, such as the "cas" dir.
+func evictionMember(key string) (string, bool) {
+	segs := strings.Split(key, "/")
+	depth := 1
+
+	switch segs[0] {
+	case ociKeyPrefix:
+		depth = 4 // oci/blobs/<alg>/<hex>
+		if len(segs) > 1 && segs[1] != "blobs" {
+			depth = depthThrough(segs, "_manifests")
+		}
+	case goproxyKeyPrefix:
+		depth = depthThrough(segs, goproxyVersionDir)
+	default:
+		if d, ok := evictionUnitDepths[segs[0]]; ok {
+			depth = d
+		}
+	}
+
+	if len(segs) < depth {
+		return key, false
+	}
+
+	return strings.Join(segs[:depth], "/"), true
+}
+
+// depthThrough is the number of segments up to and including marker, or
+// one more than there are when marker is not among them.
+func depthThrough(segs []string, marker string) int {
+	for i, s := range segs {
+		if s == marker {
+			return i + 1
+		}
+	}
+
+	return len(segs) + 1
+}
+
+// evictionUnit names the unit key belongs to: its member, with a .json
+// record folded into the object it describes.
+func evictionUnit(key string) string {
+	member, _ := evictionMember(key)
+
+	if root, _, _ := strings.Cut(member, "/"); root == turboKeyPrefix || root == actionsKeyPrefix {
+		return strings.TrimSuffix(member, ".json")
+	}
+
+	return member
+}
+
+var accessTimes = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// recordAccess marks the unit holding key as used now. Only keys that
+// exist are recorded, and each pass forgets units that are gone, so the
+// table is bounded by the units stored.
+func recordAccess(key string) {
+	unit := evictionUnit(key)
+	if unit == "" {
+		return
+	}
+
+	accessTimes.Lock()
+	accessTimes.m[unit] = time.Now()
+	accessTimes.Unlock()
+}
+
+// entryGuards keeps eviction away from units with a publish in flight:
+// lockKey holds the guard of the key's unit shared, and the evictor only
+// deletes a unit whose guard it gets exclusively without waiting.
+var entryGuards = struct {
+	sync.Mutex
+	m map[string]*entryGuard
+}{m: make(map[string]*entryGuard)}
+
+type entryGuard struct {
+	sync.RWMutex
+	refs int
+}
+
+func acquireEntryGuard(top string) *entryGuard {
+	entryGuards.Lock()
+	defer entryGuards.Unlock()
+
+	g, ok := entryGuards.m[top]
+	if !ok {
+		g = &entryGuard{}
+		entryGuards.m[top] = g
+	}
+
+	g.refs++
+
+	return g
+}
+
+func releaseEntryGuard(top string, g *entryGuard) {
+	entryGuards.Lock()
+	if g.refs--; g.refs == 0 {
+		delete(entryGuards.m, top)
+	}
+	entryGuards.Unlock()
+}
+
+// holdEntry pins the unit of key against eviction until the returned func
+// is called. The publish it covers counts as an access.
+func holdEntry(key string) func() {
+	unit := evictionUnit(key)
+	if unit == "" {
+		return func() {}
+	}
+
+	g := acquireEntryGuard(unit)
+	g.RLock()
+
+	return func() {
+		g.RUnlock()
+		releaseEntryGuard(unit, g)
+		recordAccess(unit)
+	}
+}
+
+// tryEvictEntry claims top for deletion, or reports false when a publish
+// holds it.
+func tryEvictEntry(top string) (func(), bool) {
+	g := acquireEntryGuard(top)
+	if !g.TryLock() {
+		releaseEntryGuard(top, g)
+		return nil, false
+	}
+
+	return func() {
+		g.Unlock()
+		releaseEntryGuard(top, g)
+	}, true
+}
+
+func runEvictor(ctx context.Context, cfg evictionConfig) {
+	log.Printf("eviction: quota %d bytes, evicting from %d%% down to %d%% every %s", cfg.quota, cfg.high, cfg.low, cfg.interval)
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := evictOnce(ctx, cfg); err != nil {
+			log.Printf("eviction: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type evictionCandidate struct {
+	name       string
+	members    []string
+	size       int64
+	lastAccess time.Time
+}
+
+// evictOnce runs one eviction pass and returns the units it deleted.
+func evictOnce(ctx context.Context, cfg evictionConfig) ([]string, error) {
+	infos, err := store.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("list root: %w", err)
+	}
+
+	units := make(map[string]*evictionCandidate)
+
+	for _, info := range infos {
+		if err := measureEntry(ctx, info, units); err != nil {
+			log.Printf("eviction: measure %s: %v", info.Name(), err)
+		}
+	}
+
+	candidates := make([]evictionCandidate, 0, len(units))
+	present := make(map[string]bool, len(units))
+
+	var total int64
+
+	for _, c := range units {
+		candidates = append(candidates, *c)
+		present[c.name] = true
+		total += c.size
+	}
+
+	pruneAccessTimes(present)
+
+	if total <= cfg.highBytes() {
+		return nil, nil
+	}
+
+	accessTimes.Lock()
+	for i := range candidates {
+		if t, ok := accessTimes.m[candidates[i].name]; ok && t.After(candidates[i].lastAccess) {
+			candidates[i].lastAccess = t
+		}
+	}
+	accessTimes.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastAccess.Before(candidates[j].lastAccess) })
+
+	var evicted []string
+
+	for _, c := range candidates {
+		if total <= cfg.lowBytes() {
+			break
+		}
+
+		release, ok := tryEvictEntry(c.name)
+		if !ok {
+			continue
+		}
+
+		var err error
+		for _, member := range c.members {
+			if err = deleteKey(ctx, member); err != nil {
+				break
+			}
+		}
+
+		release()
+
+		if err != nil {
+			log.Printf("eviction: delete %s: %v", c.name, err)
+			continue
+		}
+
+		total -= c.size
+		evicted = append(evicted, c.name)
+
+		accessTimes.Lock()
+		delete(accessTimes.m, c.name)
+		accessTimes.Unlock()
+
+		log.Printf("eviction: deleted %s (%d bytes, last access %s)", c.name, c.size, c.lastAccess.Format(time.RFC3339))
+	}
+
+	if total > cfg.lowBytes() {
+		return evicted, fmt.Errorf("usage %d bytes still above the low-water mark after evicting %d entries", total, len(evicted))
+	}
+
+	return evicted, nil
+}
+
+// measureEntry adds the files below a top-level entry to the units they
+// belong to: their sizes, and the newest mtime as the last access until a
+// real one is recorded.
+func measureEntry(ctx context.Context, info fs.FileInfo, units map[string]*evictionCandidate) error {
+	add := func(key string, fi fs.FileInfo) {
+		member, complete := evictionMember(key)
+		if !complete && fi.IsDir() {
+			return
+		}
+
+		unit := evictionUnit(key)
+
+		c, ok := units[unit]
+		if !ok {
+			c = &evictionCandidate{name: unit}
+			units[unit] = c
+		}
+
+		if !slices.Contains(c.members, member) {
+			c.members = append(c.members, member)
+		}
+
+		if fi.ModTime().After(c.lastAccess) {
+			c.lastAccess = fi.ModTime()
+		}
+
+		if !fi.IsDir() {
+			c.size += fi.Size()
+		}
+	}
+
+	if !info.IsDir() {
+		add(info.Name(), info)
+		return nil
+	}
+
+	return fs.WalkDir(storeTreeFS{ctx: ctx, root: info.Name()}, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		key := info.Name()
+		if name != "." {
+			key = joinKey(key, name)
+		}
+
+		add(key, fi)
+
+		return nil
+	})
+}
+
+// pruneAccessTimes forgets units deleted by other means since the last
+// pass.
+func pruneAccessTimes(present map[string]bool) {
+	accessTimes.Lock()
+	defer accessTimes.Unlock()
+
+	for name := range accessTimes.m {
+		if !present[name] {
+			delete(accessTimes.m, name)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetAccessTimes isolates a test from accesses recorded by earlier ones.
+func resetAccessTimes(t *testing.T) {
+	t.Helper()
+
+	clear := func() {
+		accessTimes.Lock()
+		accessTimes.m = make(map[string]time.Time)
+		accessTimes.Unlock()
+	}
+
+	clear()
+	t.Cleanup(clear)
+}
+
+// 300 bytes stored against a 400 byte quota evicts from 50% (200) down
+// to 25% (100).
+var testEviction = evictionConfig{quota: 400, high: 50, low: 25}
+
+func putEntries(t *testing.T, e http.Handler, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		rec := rawPut(e, "/"+name+"/blob", []byte(strings.Repeat("x", 100)), nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+}
+
+func TestEvictionDeletesLeastRecentlyAccessed(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+	resetAccessTimes(t)
+
+	putEntries(t, e, "a", "b", "c")
+
+	rec := getWithHeaders(e, http.MethodGet, "/a/blob", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	evicted, err := evictOnce(context.Background(), testEviction)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, evicted)
+
+	_, err = os.Stat(filepath.Join(tempdir, "a", "blob"))
+	assert.NoError(t, err, "the recently downloaded entry stays")
+
+	_, err = os.Stat(filepath.Join(tempdir, metaDir, "b"))
+	assert.True(t, os.IsNotExist(err), "digest records go with the entry")
+
+	evicted, err = evictOnce(context.Background(), testEviction)
+	require.NoError(t, err)
+	assert.Empty(t, evicted, "below the high-water mark nothing happens")
+}
+
+func TestEvictionFallsBackToModTime(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	putEntries(t, e, "old", "new", "mid")
+	resetAccessTimes(t)
+
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old": 3 * time.Hour, "mid": 2 * time.Hour, "new": time.Hour} {
+		for _, p := range []string{filepath.Join(tempdir, name), filepath.Join(tempdir, name, "blob")} {
+			require.NoError(t, os.Chtimes(p, now.Add(-age), now.Add(-age)))
+		}
+	}
+
+	evicted, err := evictOnce(context.Background(), testEviction)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old", "mid"}, evicted)
+}
+
+func TestEvictionSkipsEntriesBeingPublished(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+	resetAccessTimes(t)
+
+	putEntries(t, e, "a", "b", "c")
+
+	// A big in-flight upload in staging is not the evictor's to touch.
+	big := filepath.Join(tempdir, stagingDir, "up-inflight")
+	require.NoError(t, os.WriteFile(big, make([]byte, 1000), 0o644))
+
+	unlock := lockKey("a/next")
+
+	evicted, err := evictOnce(context.Background(), testEviction)
+	unlock()
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, evicted, "a is pinned even though it is the oldest")
+
+	_, err = os.Stat(big)
+	assert.NoError(t, err)
+
+	entryGuards.Lock()
+	defer entryGuards.Unlock()
+	assert.Empty(t, entryGuards.m)
+}
+
+func TestEvictionWorksPerObjectInProtocolCaches(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+	resetAccessTimes(t)
+
+	var hashes []string
+
+	for _, c := range []string{"a", "b", "c"} {
+		blob := []byte(strings.Repeat(c, 100))
+		hashes = append(hashes, sha256Hex(blob))
+
+		rec := rawPut(e, "/cas/"+sha256Hex(blob), blob, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	rec := getWithHeaders(e, http.MethodGet, "/cas/"+hashes[0], nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// A publish elsewhere in the CAS pins only its own object.
+	unlock := lockKey("cas/" + strings.Repeat("0", 64))
+
+	evicted, err := evictOnce(context.Background(), testEviction)
+	unlock()
+
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"cas/" + hashes[1], "cas/" + hashes[2]}, evicted)
+
+	_, err = os.Stat(filepath.Join(tempdir, "cas", hashes[0]))
+	assert.NoError(t, err, "the recently read object and the CAS itself stay")
+}
+
+func TestEvictionUnits(t *testing.T) {
+	for key, want := range map[string]string{
+		"builds/app/1.0/app.tar":     "builds",
+		"cas/abc":                    "cas/abc",
+		"cas":                        "cas",
+		"cache/key":                  "cache/key",
+		"turbo/team_web/abc123.json": "turbo/team_web/abc123",
+		"actions/v1/name":            "actions/v1/name",
+		"oci/blobs/sha256/abc":       "oci/blobs/sha256/abc",
+		"oci/repositories/team/app/_manifests/tags/v1": "oci/repositories/team/app/_manifests",
+		"goproxy/example.com/mod/@v/v1.0.0.zip":        "goproxy/example.com/mod/@v",
+		"notes.json":                                   "notes.json",
+	} {
+		assert.Equal(t, want, evictionUnit(key), key)
+	}
+
+	member, complete := evictionMember("turbo/team_web/abc123.json")
+	assert.Equal(t, "turbo/team_web/abc123.json", member)
+	assert.True(t, complete)
+
+	_, complete = evictionMember("oci/repositories/team")
+	assert.False(t, complete, "directories above a unit are not units")
+}
+
+func TestLoadEvictionConfig(t *testing.T) {
+	cfg, err := loadEvictionConfig()
+	require.NoError(t, err)
+	assert.Zero(t, cfg.quota, "eviction is off by default")
+
+	t.Setenv("UPLOADER_QUOTA", "10GB")
+	t.Setenv("UPLOADER_QUOTA_HIGH_WATERMARK", "95%")
+	t.Setenv("UPLOADER_QUOTA_LOW_WATERMARK", "70")
+	t.Setenv("UPLOADER_EVICTION_INTERVAL", "30s")
+
+	cfg, err = loadEvictionConfig()
+	require.NoError(t, err)
+	assert.Equal(t, evictionConfig{quota: 10_000_000_000, high: 95, low: 70, interval: 30 * time.Second}, cfg)
+
+	t.Setenv("UPLOADER_QUOTA_LOW_WATERMARK", "95")
+
+	_, err = loadEvictionConfig()
+	require.Error(t, err, "low must stay below high")
+
+	t.Setenv("UPLOADER_QUOTA_LOW_WATERMARK", "70")
+	t.Setenv("UPLOADER_QUOTA", "lots")
+
+	_, err = loadEvictionConfig()
+	assert.Error(t, err)
+}
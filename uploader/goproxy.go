@@ -0,0 +1,185 @@
+package uploader
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Go module proxy protocol (https://go.dev/ref/mod#goproxy-protocol) served
+// from the tree under goproxy/. The layout is the one the go command keeps
+// in $GOMODCACHE/cache/download, so pipelines fill it with a regular targz
+// upload to path=goproxy.
+//
+// Paths stay in their case-escaped form ("!azure" for "Azure") both on the
+// wire and in storage, so files map one-to-one and case-insensitive
+// filesystems cannot conflate modules.
+const (
+	goproxyRoutePrefix = "/goproxy"
+	goproxyKeyPrefix   = "goproxy"
+	goproxyVersionDir  = "@v"
+)
+
+var goproxyContentTypes = map[string]string{
+	".info": "application/json",
+	".mod":  "text/plain; charset=utf-8",
+	".zip":  "application/zip",
+}
+
+func registerGoproxyRoutes(e *echo.Echo) {
+	e.GET(goproxyRoutePrefix+"/*", goproxyHandler)
+	e.HEAD(goproxyRoutePrefix+"/*", goproxyHandler)
+}
+
+func goproxyHandler(c echo.Context) error {
+	rest := c.Param("*")
+
+	if mod, ok := strings.CutSuffix(rest, "/@latest"); ok {
+		return goproxyLatest(c, mod)
+	}
+
+	mod, file, ok := strings.Cut(rest, "/"+goproxyVersionDir+"/")
+	if !ok || !isEscapedModulePath(mod) {
+		return echo.ErrNotFound
+	}
+
+	if file == "list" {
+		return goproxyList(c, mod)
+	}
+
+	dot := strings.LastIndexByte(file, '.')
+	if dot <= 0 {
+		return echo.ErrNotFound
+	}
+
+	contentType, ok := goproxyContentTypes[file[dot:]]
+	if !ok || !isEscapedVersion(file[:dot]) {
+		return echo.ErrNotFound
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+
+	return serveStoredFile(c, goproxyKey(mod, file))
+}
+
+func goproxyKey(mod, file string) string {
+	return goproxyKeyPrefix + "/" + mod + "/" + goproxyVersionDir + "/" + file
+}
+
+// goproxyList answers @v/list from the files present in the version dir.
+// A version counts once its .mod is present (that is all `go mod tidy`
+// needs); pseudo-versions are omitted as the protocol requires.
+func goproxyList(c echo.Context, mod string) error {
+	versions, err := goproxyVersions(c, mod)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+
+	for _, v := range versions {
+		if !module.IsPseudoVersion(v) {
+			b.WriteString(v)
+			b.WriteByte('\n')
+		}
+	}
+
+	return c.Blob(http.StatusOK, "text/plain; charset=utf-8", []byte(b.String()))
+}
+
+// goproxyLatest serves the .info of the highest known version, preferring
+// releases over pre-releases over pseudo-versions like the go command does.
+func goproxyLatest(c echo.Context, mod string) error {
+	if !isEscapedModulePath(mod) {
+		return echo.ErrNotFound
+	}
+
+	versions, err := goproxyVersions(c, mod)
+	if err != nil {
+		return err
+	}
+
+	best := ""
+
+	for _, v := range versions {
+		if best == "" || latestRank(v) > latestRank(best) ||
+			(latestRank(v) == latestRank(best) && semver.Compare(v, best) > 0) {
+			best = v
+		}
+	}
+
+	if best == "" {
+		return echo.ErrNotFound
+	}
+
+	escaped, err := module.EscapeVersion(best)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, goproxyContentTypes[".info"])
+
+	return serveStoredFile(c, goproxyKey(mod, escaped+".info"))
+}
+
+func latestRank(v string) int {
+	switch {
+	case module.IsPseudoVersion(v):
+		return 0
+	case semver.Prerelease(v) != "":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// goproxyVersions returns the unescaped, semver-sorted versions that have a
+// .mod file in the module's version dir.
+func goproxyVersions(c echo.Context, mod string) ([]string, error) {
+	ctx := c.Request().Context()
+	dir := goproxyKeyPrefix + "/" + mod + "/" + goproxyVersionDir
+
+	// The list reveals what the .info, .mod and .zip reads below would.
+	if err := authorizeKey(ctx, scopeRead, dir); err != nil {
+		return nil, err
+	}
+
+	infos, err := store.List(ctx, dir)
+	if err != nil {
+		return nil, storageHTTPError(err)
+	}
+
+	var versions []string
+
+	for _, info := range infos {
+		name, ok := strings.CutSuffix(info.Name(), ".mod")
+		if !ok || info.IsDir() || !isEscapedVersion(name) {
+			continue
+		}
+
+		v, _ := module.UnescapeVersion(name)
+		versions = append(versions, v)
+	}
+
+	semver.Sort(versions)
+
+	return versions, nil
+}
+
+// isEscapedModulePath validates the case-escaped form of a module path.
+// The module path rules already refuse empty, dot-only and hidden elements
+// that could address something outside the module tree.
+func isEscapedModulePath(p string) bool {
+	_, err := module.UnescapePath(p)
+	return err == nil
+}
+
+// isEscapedVersion accepts the case-escaped form of a canonical semantic
+// version, the only kind the go command stores in the module cache.
+func isEscapedVersion(v string) bool {
+	u, err := module.UnescapeVersion(v)
+	return err == nil && module.CanonicalVersion(u) == u
+}
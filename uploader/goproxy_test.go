@@ -0,0 +1,118 @@
+package uploader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const goproxyTestModule = "goproxy/github.com/!azure/go-autorest/@v/"
+
+func goproxyServer(t *testing.T) *echo.Echo {
+	t.Helper()
+
+	e, _ := concurrencyServer(t)
+
+	files := map[string]string{
+		"v1.2.0.info":                    `{"Version":"v1.2.0"}`,
+		"v1.2.0.mod":                     "module github.com/Azure/go-autorest\n",
+		"v1.2.0.zip":                     "PK\x03\x04",
+		"v1.10.0.info":                   `{"Version":"v1.10.0"}`,
+		"v1.10.0.mod":                    "module github.com/Azure/go-autorest\n",
+		"v2.0.0-!r!c1+incompatible.info": `{"Version":"v2.0.0-RC1+incompatible"}`,
+		"v2.0.0-!r!c1+incompatible.mod":  "module github.com/Azure/go-autorest\n",
+		"v1.10.1-0.20240101120000-abcdef123456.mod": "module github.com/Azure/go-autorest\n",
+		"v1.3.0.info": `{"Version":"v1.3.0"}`, // no .mod: not listed
+	}
+
+	for name, content := range files {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, buildUploadRequest(t, goproxyTestModule+name, []byte(content), ""))
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	return e
+}
+
+func TestGoproxyList(t *testing.T) {
+	e := goproxyServer(t)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/goproxy/github.com/!azure/go-autorest/@v/list", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, "v1.2.0\nv1.10.0\nv2.0.0-RC1+incompatible\n", rec.Body.String(),
+		"semver order, unescaped, without pseudo-versions")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/goproxy/github.com/!azure/missing/@v/list", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGoproxyFilesContentTypes(t *testing.T) {
+	e := goproxyServer(t)
+
+	for file, want := range map[string]string{
+		"v1.2.0.info": "application/json",
+		"v1.2.0.mod":  "text/plain; charset=utf-8",
+		"v1.2.0.zip":  "application/zip",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+goproxyTestModule+file, nil))
+		require.Equal(t, http.StatusOK, rec.Code, file)
+		assert.Equal(t, want, rec.Header().Get(echo.HeaderContentType), file)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/"+goproxyTestModule+"v1.2.0.zip", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "4", rec.Header().Get(echo.HeaderContentLength))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+goproxyTestModule+"v9.9.9.zip", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGoproxyLatest(t *testing.T) {
+	e := goproxyServer(t)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/goproxy/github.com/!azure/go-autorest/@latest", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get(echo.HeaderContentType))
+	assert.JSONEq(t, `{"Version":"v1.10.0"}`, rec.Body.String(), "releases win over newer pre-releases")
+}
+
+func TestGoproxyRejectsBadPaths(t *testing.T) {
+	e := goproxyServer(t)
+
+	for _, p := range []string{
+		"/goproxy/github.com/Azure/go-autorest/@v/list",  // unescaped upper case
+		"/goproxy/github.com/!Azure/go-autorest/@v/list", // '!' before upper case
+		"/goproxy/github.com/!azure/go-autorest/@v/v1.2.0.txt",
+		"/goproxy/github.com/!azure/go-autorest/@v/latest.info",
+		"/goproxy/../.tmp/@v/list",
+		"/goproxy/github.com/!azure/go-autorest/@v/",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, p)
+	}
+}
+
+func TestGoproxyEscapedForms(t *testing.T) {
+	assert.True(t, isEscapedModulePath("github.com/!burnt!sushi/toml"))
+	assert.True(t, isEscapedVersion("v2.0.0-!r!c1+incompatible"))
+
+	for _, p := range []string{"", "github.com/BurntSushi/toml", "trailing!", "github.com/.hidden/x", "github.com/x/@v"} {
+		assert.False(t, isEscapedModulePath(p), p)
+	}
+
+	for _, v := range []string{"", "v1.2", "1.2.3", "v1.2.3+meta", "v1.0.0-RC1", "v1.0.0/../x"} {
+		assert.False(t, isEscapedVersion(v), v)
+	}
+}
@@ -0,0 +1,166 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
+)
+
+// Gradle HTTP build cache (https://docs.gradle.org/current/userguide/build_cache.html#sec:build_cache_configure_remote):
+// GET/HEAD/PUT on /cache/{key}. Entries are stored under cache/ in the cache
+// root so /delete cleans them up like any other file.
+const (
+	gradleRoute               = "/cache/:key"
+	gradleKeyPrefix           = "cache"
+	defaultGradleMaxEntrySize = "1GB"
+	maxGradleKeyLength        = 255
+)
+
+type gradleConfig struct {
+	// Optional "username:password" for the Gradle routes only. When set it
+	// is required for reads as well as writes and replaces the global
+	// upload credentials on these routes.
+	credentials  string
+	maxEntrySize string
+}
+
+func loadGradleConfig() (gradleConfig, error) {
+	cfg := gradleConfig{maxEntrySize: defaultGradleMaxEntrySize}
+
+	if v := os.Getenv("UPLOADER_GRADLE_CREDENTIALS"); v != "" {
+		if _, _, ok := strings.Cut(v, ":"); !ok {
+			return cfg, errors.New("UPLOADER_GRADLE_CREDENTIALS must use 'username:password' format")
+		}
+
+		cfg.credentials = v
+	}
+
+	if v := os.Getenv("UPLOADER_GRADLE_MAX_ENTRY_SIZE"); v != "" {
+		if _, err := bytes.Parse(v); err != nil {
+			return cfg, fmt.Errorf("invalid UPLOADER_GRADLE_MAX_ENTRY_SIZE %q: %w", v, err)
+		}
+
+		cfg.maxEntrySize = v
+	}
+
+	return cfg, nil
+}
+
+// registerGradleRoutes takes files for the paths nested below cache/: they
+// are regular uploads, not Gradle entries, and are served like any other.
+func registerGradleRoutes(e *echo.Echo, cfg gradleConfig, files http.FileSystem) {
+	var mw []echo.MiddlewareFunc
+
+	if cfg.maxEntrySize != "" {
+		mw = append(mw, middleware.BodyLimit(cfg.maxEntrySize))
+	}
+
+	if cfg.credentials != "" {
+		auth := middleware.DefaultBasicAuthConfig
+		auth.Realm = "gradle"
+		auth.Validator = basicAuthValidator(cfg.credentials)
+		mw = append(mw, middleware.BasicAuthWithConfig(auth))
+	}
+
+	// Plain routes rather than a group: a group with middleware claims
+	// every path below its prefix. Echo still hands a trailing param the
+	// rest of the path, so nested paths land here and are passed on to the
+	// regular handlers without the Gradle middleware.
+	route := func(h, nested echo.HandlerFunc) echo.HandlerFunc {
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+
+		return func(c echo.Context) error {
+			if isGradleRoute(c) {
+				return h(c)
+			}
+
+			rest := gradleKeyPrefix + "/" + c.Param("key")
+			c.SetParamNames("*")
+			c.SetParamValues(rest)
+
+			return nested(c)
+		}
+	}
+
+	e.GET(gradleRoute, route(gradleGet, serveFiles(files)))
+	e.HEAD(gradleRoute, route(gradleHead, serveFiles(files)))
+	e.PUT(gradleRoute, route(gradlePut, uploadRaw))
+}
+
+// isGradleRoute reports whether c addresses a Gradle entry rather than a
+// file nested below cache/.
+func isGradleRoute(c echo.Context) bool {
+	return c.Path() == gradleRoute && !strings.Contains(c.Param("key"), "/")
+}
+
+func gradleKey(c echo.Context) (string, error) {
+	key := c.Param("key")
+	if !isGradleCacheKey(key) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "invalid build cache key")
+	}
+
+	return gradleKeyPrefix + "/" + key, nil
+}
+
+// Gradle keys are hex hashes; anything beyond [A-Za-z0-9._-] or starting
+// with a dot is refused so a key can never address a hidden or parent path.
+func isGradleCacheKey(key string) bool {
+	if key == "" || len(key) > maxGradleKeyLength || key[0] == '.' {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !isAlphaNum(c) && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isAlphaNum(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func gradleGet(c echo.Context) error {
+	key, err := gradleKey(c)
+	if err != nil {
+		return err
+	}
+
+	return serveStoredFile(c, key)
+}
+
+func gradleHead(c echo.Context) error {
+	key, err := gradleKey(c)
+	if err != nil {
+		return err
+	}
+
+	return statStoredFile(c, key)
+}
+
+// Gradle always sends Content-Length, so oversized entries are usually
+// refused by BodyLimit before any bytes are read; Gradle treats that 413 as
+// a soft failure and keeps building.
+func gradlePut(c echo.Context) error {
+	key, err := gradleKey(c)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := putDigest(c.Request().Context(), key, c.Request().Body, writeCondition{}); err != nil {
+		return publishHTTPError(fmt.Errorf("store cache entry: %w", err))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,179 @@
+package uploader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const gradleTestKey = "3f2b8a1c9d0e4f5a6b7c8d9e0f1a2b3c"
+
+func TestGradleCacheRoundTrip(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{gradle: gradleConfig{maxEntrySize: "1MB"}})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/"+gradleTestKey, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "miss before store")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/cache/"+gradleTestKey, strings.NewReader("entry")))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	got, err := os.ReadFile(filepath.Join(tempdir, gradleKeyPrefix, gradleTestKey))
+	require.NoError(t, err)
+	assert.Equal(t, "entry", string(got))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/"+gradleTestKey, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "entry", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/cache/"+gradleTestKey, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestGradleCacheEnforcesOwnSizeLimit(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{gradle: gradleConfig{maxEntrySize: "1KB"}})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/cache/"+gradleTestKey, bytes.NewReader(make([]byte, 4096))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, gradleKeyPrefix, gradleTestKey))
+	assert.True(t, os.IsNotExist(err))
+
+	// The route limit must not leak onto the regular upload route.
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, buildUploadRequest(t, "big.bin", make([]byte, 4096), ""))
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+}
+
+func TestGradleCacheOwnCredentials(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "uploader:secret",
+		gradle:      gradleConfig{credentials: "gradle:builds"},
+	})
+
+	put := func(user, pass string) int {
+		req := httptest.NewRequest(http.MethodPut, "/cache/"+gradleTestKey, strings.NewReader("x"))
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, put("", ""))
+	assert.Equal(t, http.StatusUnauthorized, put("uploader", "secret"), "global creds must not unlock the gradle routes")
+	assert.Equal(t, http.StatusOK, put("gradle", "builds"))
+
+	// Reads are protected too once the routes have their own credentials.
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/"+gradleTestKey, nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// And the gradle creds do not unlock the rest of the server.
+	req := buildUploadRequest(t, "x.txt", []byte("x"), "")
+	req.SetBasicAuth("gradle", "builds")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestGradleCacheFallsBackToGlobalCredentials(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{credentials: "uploader:secret"})
+
+	req := httptest.NewRequest(http.MethodPut, "/cache/"+gradleTestKey, strings.NewReader("x"))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPut, "/cache/"+gradleTestKey, strings.NewReader("x"))
+	req.SetBasicAuth("uploader", "secret")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// Only single-segment keys belong to Gradle; files deeper below cache/
+// stay regular files under the server's own credentials.
+func TestGradleRoutesLeaveNestedFilesReachable(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "uploader:secret",
+		gradle:      gradleConfig{credentials: "gradle:builds", maxEntrySize: "1KB"},
+	})
+
+	req := buildUploadRequest(t, "cache/a/b.txt", []byte("nested"), "")
+	req.SetBasicAuth("uploader", "secret")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/a/b.txt", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "nested", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/cache/a/b.txt", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	put := func(user, pass string) int {
+		req := httptest.NewRequest(http.MethodPut, "/cache/a/c.txt", bytes.NewReader(make([]byte, 2048)))
+		req.SetBasicAuth(user, pass)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, put("gradle", "builds"), "gradle creds must not unlock nested paths")
+	assert.Equal(t, http.StatusCreated, put("uploader", "secret"), "the gradle entry size limit does not apply")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/a/c.txt", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestGradleCacheRejectsBadKeys(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	for _, key := range []string{".hidden", "a%2Fb", strings.Repeat("a", maxGradleKeyLength+1)} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/cache/"+key, strings.NewReader("x")))
+		assert.Equalf(t, http.StatusBadRequest, rec.Code, "key %q", key)
+	}
+}
+
+func TestLoadGradleConfig(t *testing.T) {
+	saveServerGlobals(t)
+
+	t.Setenv("UPLOADER_GRADLE_CREDENTIALS", "gradle:pw")
+	t.Setenv("UPLOADER_GRADLE_MAX_ENTRY_SIZE", "50MB")
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "gradle:pw", cfg.gradle.credentials)
+	assert.Equal(t, "50MB", cfg.gradle.maxEntrySize)
+
+	t.Setenv("UPLOADER_GRADLE_MAX_ENTRY_SIZE", "lots")
+
+	_, err = loadConfig()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "UPLOADER_GRADLE_MAX_ENTRY_SIZE")
+}
@@ -0,0 +1,205 @@
+package uploader
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/v1/list is the JSON listing hideStagingFS deliberately does not
+// offer: a page of entries below a directory, in walk order, with an
+// opaque cursor to resume from. It is off unless UPLOADER_LIST_API is set
+// and sits behind the upload credentials.
+const (
+	listRoute        = "/api/v1/list"
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+type listConfig struct {
+	enabled bool
+}
+
+func loadListConfig(authEnabled bool) (listConfig, error) {
+	var cfg listConfig
+
+	if v := os.Getenv("UPLOADER_LIST_API"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid UPLOADER_LIST_API %q: %w", v, err)
+		}
+
+		cfg.enabled = enabled
+	}
+
+	if cfg.enabled && !authEnabled {
+		return cfg, errors.New("UPLOADER_LIST_API requires UPLOADER_UPLOAD_CREDENTIALS, UPLOADER_AUTH_FILE or UPLOADER_SA_AUDIENCE")
+	}
+
+	return cfg, nil
+}
+
+func registerListRoutes(e *echo.Echo, cfg listConfig) {
+	if !cfg.enabled {
+		return
+	}
+
+	e.GET(listRoute, listEntries)
+}
+
+type listEntry struct {
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Size   int64     `json:"size"`
+	MTime  time.Time `json:"mtime"`
+	SHA256 string    `json:"sha256,omitempty"`
+}
+
+type listResponse struct {
+	Path       string      `json:"path"`
+	Entries    []listEntry `json:"entries"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func listEntries(c echo.Context) error {
+	key, err := safeKey(c.QueryParam("path"))
+	if err != nil {
+		return err
+	}
+
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return err
+	}
+
+	recursive := c.QueryParam("recursive") == "true"
+
+	limit := defaultListLimit
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxListLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+		}
+	}
+
+	after, err := decodeListCursor(c.QueryParam("cursor"))
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return storageHTTPError(err)
+	}
+
+	if !info.IsDir() {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is not a directory", c.QueryParam("path")))
+	}
+
+	res := listResponse{Path: key, Entries: make([]listEntry, 0, min(limit, 64))}
+
+	walkErr := fs.WalkDir(storeTreeFS{ctx: ctx, root: key}, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		// Whole subtrees before the cursor are skipped without listing them.
+		if after != "" && !walkOrderAfter(name, after) {
+			if d.IsDir() && !strings.HasPrefix(after, name+"/") {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		if len(res.Entries) == limit {
+			res.NextCursor = encodeListCursor(res.Entries[limit-1].Name)
+			return fs.SkipAll
+		}
+
+		// Entries a read ACL hides are left out, names, sizes and digests
+		// alike; a walk still descends, since a deeper rule may open up.
+		if checkACL(principalFrom(ctx), scopeRead, joinKey(key, name)) != nil {
+			if d.IsDir() && !recursive {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		res.Entries = append(res.Entries, newListEntry(c, key, name, info))
+
+		if d.IsDir() && !recursive {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+	if walkErr != nil {
+		return storageHTTPError(walkErr)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func newListEntry(c echo.Context, root, name string, info fs.FileInfo) listEntry {
+	entry := listEntry{Name: name, Type: "file", Size: info.Size(), MTime: info.ModTime().UTC()}
+
+	if info.IsDir() {
+		entry.Type = "dir"
+		entry.Size = 0
+
+		return entry
+	}
+
+	entry.SHA256 = lookupDigest(c.Request().Context(), joinKey(root, name), info)
+
+	return entry
+}
+
+// walkOrderAfter reports whether name comes after cursor in fs.WalkDir
+// order: segment by segment, with a directory before everything below it.
+// Plain string order differs ("a-b" < "a/c" but a/c is walked first).
+func walkOrderAfter(name, cursor string) bool {
+	a, b := strings.Split(name, "/"), strings.Split(cursor, "/")
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+
+	return len(a) > len(b)
+}
+
+// Cursors are the last returned name, encoded so clients treat them as
+// opaque.
+func encodeListCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeListCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	name, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(name) == 0 {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+	}
+
+	return string(name), nil
+}
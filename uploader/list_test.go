@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func listServer(t *testing.T) *echo.Echo {
+	t.Helper()
+
+	e, _ := configuredServer(t, serverConfig{credentials: "ci:secret", list: listConfig{enabled: true}})
+
+	for _, name := range []string{"a-b.txt", "a/c.txt", "a/d/e.txt", "z.txt"} {
+		rec := rawPut(e, "/"+name, []byte(name), map[string]string{"Authorization": basicAuth("ci", "secret")})
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	return e
+}
+
+func list(t *testing.T, e *echo.Echo, query url.Values) listResponse {
+	t.Helper()
+
+	rec := getWithHeaders(e, http.MethodGet, listRoute+"?"+query.Encode(), map[string]string{"Authorization": basicAuth("ci", "secret")})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var res listResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	return res
+}
+
+func entryNames(entries []listEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+func TestListDirectChildren(t *testing.T) {
+	e := listServer(t)
+
+	res := list(t, e, url.Values{})
+	assert.Equal(t, []string{"a", "a-b.txt", "z.txt"}, entryNames(res.Entries), "staging and digest dirs stay hidden")
+	assert.Empty(t, res.NextCursor)
+
+	assert.Equal(t, "dir", res.Entries[0].Type)
+	assert.Equal(t, "file", res.Entries[1].Type)
+	assert.EqualValues(t, len("a-b.txt"), res.Entries[1].Size)
+	assert.Equal(t, sha256Hex([]byte("a-b.txt")), res.Entries[1].SHA256)
+	assert.False(t, res.Entries[1].MTime.IsZero())
+
+	res = list(t, e, url.Values{"path": {"a"}})
+	assert.Equal(t, []string{"c.txt", "d"}, entryNames(res.Entries))
+}
+
+func TestListRecursivePagination(t *testing.T) {
+	e := listServer(t)
+
+	var (
+		names  []string
+		cursor string
+		pages  int
+	)
+
+	for {
+		q := url.Values{"recursive": {"true"}, "limit": {"2"}}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+
+		res := list(t, e, q)
+		names = append(names, entryNames(res.Entries)...)
+		pages++
+
+		if res.NextCursor == "" {
+			break
+		}
+
+		cursor = res.NextCursor
+	}
+
+	assert.Equal(t, []string{"a", "a/c.txt", "a/d", "a/d/e.txt", "a-b.txt", "z.txt"}, names)
+	assert.Equal(t, 3, pages)
+}
+
+func TestListRequiresCredentialsAndValidInput(t *testing.T) {
+	e := listServer(t)
+
+	rec := getWithHeaders(e, http.MethodGet, listRoute, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	auth := map[string]string{"Authorization": basicAuth("ci", "secret")}
+
+	for target, want := range map[string]int{
+		listRoute + "?path=a/c.txt":         http.StatusBadRequest,
+		listRoute + "?path=missing":         http.StatusNotFound,
+		listRoute + "?path=" + stagingDir:   http.StatusForbidden,
+		listRoute + "?path=../outside":      http.StatusForbidden,
+		listRoute + "?limit=0":              http.StatusBadRequest,
+		listRoute + "?cursor=%21not-base64": http.StatusBadRequest,
+	} {
+		rec = getWithHeaders(e, http.MethodGet, target, auth)
+		assert.Equal(t, want, rec.Code, target)
+	}
+}
+
+func TestListIsOffByDefault(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := getWithHeaders(e, http.MethodGet, listRoute, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestLoadListConfig(t *testing.T) {
+	t.Setenv("UPLOADER_LIST_API", "true")
+
+	_, err := loadListConfig(false)
+	require.Error(t, err, "listing without credentials would expose the tree")
+
+	cfg, err := loadListConfig(true)
+	require.NoError(t, err)
+	assert.True(t, cfg.enabled)
+
+	t.Setenv("UPLOADER_LIST_API", "maybe")
+
+	_, err = loadListConfig(true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,416 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Content digests are recorded at publish time in a sidecar tree that
+// mirrors the cache: the record for key "a/b" lives at ".meta/a/b". Records
+// go through the Storage like everything else, so they persist on every
+// backend, and a key is always either a record or a directory of records,
+// never both. The tree is reserved like the staging dir: hidden from
+// listings and refused by safeJoin.
+const (
+	metaDir       = ".meta"
+	metaDirPrefix = metaDir + "/"
+)
+
+func isMetaPath(p string) bool {
+	trimmed := strings.TrimPrefix(filepath.ToSlash(p), "/")
+	return trimmed == metaDir || strings.HasPrefix(trimmed, metaDirPrefix)
+}
+
+// isReservedPath reports paths clients must never address directly.
+func isReservedPath(p string) bool {
+	return isStagingPath(p) || isMetaPath(p)
+}
+
+func metaKey(key string) string { return metaDirPrefix + key }
+
+// digestRecord pins a digest to the size and mtime of the object it was
+// computed for. A record that no longer matches its object (replaced by a
+// writer that bypassed the publish helpers, or lost a race) is ignored
+// rather than trusted, so a stale record can never yield a wrong ETag.
+type digestRecord struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// keyLocks serializes publishes within this process, so the record written
+// after a publish always describes the object that landed and not a
+// concurrent writer's. A held key covers its whole subtree: a publish of
+// a/b waits for one of a and the other way round, so a check made under
+// the lock holds for everything the publish replaces or reads.
+var keyLocks = newKeyLockTable()
+
+type keyLockTable struct {
+	sync.Mutex
+	released *sync.Cond
+	held     map[string]bool
+}
+
+func newKeyLockTable() *keyLockTable {
+	t := &keyLockTable{held: make(map[string]bool)}
+	t.released = sync.NewCond(&t.Mutex)
+
+	return t
+}
+
+// lockKey blocks until neither key nor an ancestor or descendant of it is
+// locked and returns its unlock func. The key's eviction unit is pinned
+// against eviction for as long.
+func lockKey(key string) func() {
+	return lockKeys(key)
+}
+
+// lockKeys takes the locks of several keys at once. Waiting for all of
+// them together instead of one by one means two callers with overlapping
+// sets cannot deadlock.
+func lockKeys(keys ...string) func() {
+	keys = slices.Compact(slices.Sorted(slices.Values(keys)))
+
+	releases := make([]func(), 0, len(keys))
+	for _, key := range keys {
+		releases = append(releases, holdEntry(key))
+	}
+
+	keyLocks.Lock()
+
+	for keysConflict(keys) {
+		keyLocks.released.Wait()
+	}
+
+	for _, key := range keys {
+		keyLocks.held[key] = true
+	}
+
+	keyLocks.Unlock()
+
+	return func() {
+		keyLocks.Lock()
+		for _, key := range keys {
+			delete(keyLocks.held, key)
+		}
+		keyLocks.released.Broadcast()
+		keyLocks.Unlock()
+
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// keysConflict reports whether a held key is one of keys, or above or
+// below one of them. keyLocks must be held.
+func keysConflict(keys []string) bool {
+	for held := range keyLocks.held {
+		for _, key := range keys {
+			if keyWithin(key, held) || keyWithin(held, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// publishFileDigest publishes a staged file and records its digest. sum is
+// the hex SHA-256 computed while staging; callers that staged without
+// hashing pass "" and pay for one extra read of the staged file. cond and
+// the immutable prefixes are checked under the key lock.
+func publishFileDigest(ctx context.Context, key, staged, sum string, cond writeCondition) error {
+	return publishFileRecord(ctx, key, staged, sum, cond, "", nil)
+}
+
+// publishFileRecord is publishFileDigest for protocols that keep a record
+// next to the object (Turborepo tags, Actions cache entries). The record
+// is stored at recordKey under the same lock, once the publish went
+// through, so a refused publish leaves no record behind.
+func publishFileRecord(ctx context.Context, key, staged, sum string, cond writeCondition, recordKey string, record []byte) error {
+	if sum == "" {
+		var err error
+		if sum, err = hashFile(staged, sha256.New()); err != nil {
+			return fmt.Errorf("hash staged: %w", err)
+		}
+	}
+
+	unlock := lockKey(key)
+	defer unlock()
+
+	if err := checkWrite(ctx, key, cond); err != nil {
+		return err
+	}
+
+	if err := store.PublishFile(ctx, key, staged); err != nil {
+		return err
+	}
+
+	recordDigest(ctx, key, sum)
+
+	if recordKey == "" {
+		return nil
+	}
+
+	if _, err := store.Put(ctx, recordKey, bytes.NewReader(record)); err != nil {
+		return fmt.Errorf("publish record: %w", err)
+	}
+
+	return nil
+}
+
+// publishDirDigests hashes a staged tree, replaces key with it and records
+// a digest for every file in it. Hashing happens before the publish because
+// the local backend moves the stage dir away.
+func publishDirDigests(ctx context.Context, key, stage string, cond writeCondition) error {
+	sums, err := hashTree(stage)
+	if err != nil {
+		return fmt.Errorf("hash staged tree: %w", err)
+	}
+
+	unlock := lockKey(key)
+	defer unlock()
+
+	if err := checkWrite(ctx, key, cond); err != nil {
+		return err
+	}
+
+	if err := store.PublishDir(ctx, key, stage); err != nil {
+		return err
+	}
+
+	forgetDigests(ctx, key)
+
+	for rel, sum := range sums {
+		recordDigest(ctx, joinKey(key, rel), sum)
+	}
+
+	return nil
+}
+
+// putDigest is Storage.Put with the digest computed on the way through,
+// checked and published under the key lock like publishFileDigest. It
+// returns the size and hex SHA-256 of what was stored.
+func putDigest(ctx context.Context, key string, r io.Reader, cond writeCondition) (int64, string, error) {
+	unlock := lockKey(key)
+	defer unlock()
+
+	if err := checkWrite(ctx, key, cond); err != nil {
+		return 0, "", err
+	}
+
+	h := sha256.New()
+
+	n, err := store.Put(ctx, key, io.TeeReader(r, h))
+	if err != nil {
+		return n, "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	recordDigest(ctx, key, sum)
+
+	return n, sum, nil
+}
+
+// deleteKey removes key together with the digest records below it.
+func deleteKey(ctx context.Context, key string) error {
+	if err := store.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	forgetDigests(ctx, key)
+
+	return nil
+}
+
+// recordDigest is best effort: the object is already published, and a
+// missing record only costs clients the ETag.
+func recordDigest(ctx context.Context, key, sum string) {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		log.Printf("digest record for %s: stat: %v", key, err)
+		return
+	}
+
+	// A directory of records left by a tree this file replaced would make
+	// the Put fail.
+	if old, err := store.Stat(ctx, metaKey(key)); err == nil && old.IsDir() {
+		forgetDigests(ctx, key)
+	}
+
+	data, err := json.Marshal(digestRecord{SHA256: sum, Size: info.Size(), ModTime: info.ModTime()})
+	if err != nil {
+		log.Printf("digest record for %s: %v", key, err)
+		return
+	}
+
+	if _, err := store.Put(ctx, metaKey(key), bytes.NewReader(data)); err != nil {
+		log.Printf("digest record for %s: %v", key, err)
+	}
+}
+
+func forgetDigests(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+
+	if err := store.Delete(ctx, metaKey(key)); err != nil {
+		log.Printf("failed to delete digest records for %s: %v", key, err)
+	}
+}
+
+// lookupDigest returns the recorded hex SHA-256 of the object described by
+// info, or "" when there is no record that still matches it.
+func lookupDigest(ctx context.Context, key string, info fs.FileInfo) string {
+	if key == "" || info.IsDir() {
+		return ""
+	}
+
+	obj, err := store.Open(ctx, metaKey(key))
+	if err != nil {
+		return ""
+	}
+
+	defer func() {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing digest record for %s: %v", key, closeErr)
+		}
+	}()
+
+	var rec digestRecord
+	if err := json.NewDecoder(io.LimitReader(obj, 4096)).Decode(&rec); err != nil {
+		return ""
+	}
+
+	if rec.Size != info.Size() || !rec.ModTime.Equal(info.ModTime()) || !isSHA256Hex(rec.SHA256) {
+		return ""
+	}
+
+	return rec.SHA256
+}
+
+// setDigestHeaders exposes a digest as a strong ETag and an RFC 3230 Digest
+// header. http.ServeContent reads the ETag back to answer If-None-Match
+// with 304 and to honor If-Range.
+func setDigestHeaders(h http.Header, sum string) {
+	if sum == "" {
+		return
+	}
+
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return
+	}
+
+	h.Set("ETag", `"`+sum+`"`)
+	h.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(raw))
+}
+
+// hashTree returns the hex SHA-256 of every regular file below root, keyed
+// by slash-separated path relative to root.
+func hashTree(root string) (map[string]string, error) {
+	sums := make(map[string]string)
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		sum, err := hashFile(p, sha256.New())
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		sums[filepath.ToSlash(rel)] = sum
+
+		return nil
+	})
+
+	return sums, err
+}
+
+// hashFile returns the hex digest of the file at p under h.
+func hashFile(p string, h hash.Hash) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			log.Printf("error closing %s: %v", p, closeErr)
+		}
+	}()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestFS decorates the file system behind the download handler: every
+// file it opens gets the digest headers of that exact handle, so the ETag
+// can never describe a different version than the bytes being served.
+type digestFS struct {
+	root   http.FileSystem
+	ctx    context.Context
+	header http.Header
+}
+
+func (d digestFS) Open(name string) (http.File, error) {
+	f, err := d.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := f.Stat(); err == nil {
+		key := strings.TrimPrefix(path.Clean("/"+name), "/")
+		setDigestHeaders(d.header, lookupDigest(d.ctx, key, info))
+		recordAccess(key)
+	}
+
+	return f, nil
+}
+
+// serveFiles is the catch-all download handler.
+func serveFiles(root http.FileSystem) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Reserved and escaping paths are left to root, which hides them.
+		if key, err := safeKey(c.Request().URL.Path); err == nil {
+			if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+				return err
+			}
+		}
+
+		fsys := digestFS{root: root, ctx: c.Request().Context(), header: c.Response().Header()}
+		http.FileServer(fsys).ServeHTTP(c.Response(), c.Request())
+
+		return nil
+	}
+}
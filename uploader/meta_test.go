@@ -0,0 +1,229 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getWithHeaders(e http.Handler, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestDownloadCarriesDigestAndRevalidates(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	content := []byte("etag me")
+	etag := `"` + sha256Hex(content) + `"`
+
+	rec := rawPut(e, "/dir/file.txt", content, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = getWithHeaders(e, http.MethodGet, "/dir/file.txt", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+	assert.Equal(t, "sha-256="+base64SHA256(content), rec.Header().Get("Digest"))
+	assert.Equal(t, content, rec.Body.Bytes())
+
+	rec = getWithHeaders(e, http.MethodGet, "/dir/file.txt", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+
+	rec = getWithHeaders(e, http.MethodGet, "/dir/file.txt", map[string]string{"If-None-Match": `"stale"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = rawPut(e, "/dir/file.txt", []byte("changed"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, "/dir/file.txt", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, rec.Code, "a replaced file no longer matches the old ETag")
+	assert.Equal(t, `"`+sha256Hex([]byte("changed"))+`"`, rec.Header().Get("ETag"))
+}
+
+func TestHeadReportsSizeAndDigest(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	content := []byte("head me")
+
+	req := buildUploadRequest(t, "head.txt", content, "")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodHead, "/head.txt", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "7", rec.Header().Get(echo.HeaderContentLength))
+	assert.Equal(t, `"`+sha256Hex(content)+`"`, rec.Header().Get("ETag"))
+	assert.Equal(t, "sha-256="+base64SHA256(content), rec.Header().Get("Digest"))
+	assert.NotEmpty(t, rec.Header().Get(echo.HeaderLastModified))
+}
+
+func TestStaleDigestRecordIsIgnored(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/f.txt", []byte("published"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// A writer that bypasses the publish helpers leaves the record behind.
+	require.NoError(t, os.WriteFile(filepath.Join(tempdir, "f.txt"), []byte("rewritten by hand"), 0o644))
+
+	rec = getWithHeaders(e, http.MethodGet, "/f.txt", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("ETag"))
+	assert.Empty(t, rec.Header().Get("Digest"))
+}
+
+func TestExtractedFilesGetDigests(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	req := buildUploadRequest(t, "site", makeTarGz(t, "M", 2), "true")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = getWithHeaders(e, http.MethodGet, "/site/M-1.txt", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"`+sha256Hex([]byte("M/file-1-content"))+`"`, rec.Header().Get("ETag"))
+
+	req = buildDeleteRequest(t, "/upload", map[string]string{"path": "site"})
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, metaDir, "site"))
+	assert.True(t, os.IsNotExist(err), "records go with the deleted tree")
+}
+
+func TestProtocolDownloadsCarryDigest(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	blob := []byte("cas blob")
+	target := "/cas/" + sha256Hex(blob)
+
+	req := httptest.NewRequest(http.MethodPut, target, strings.NewReader(string(blob)))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, target, map[string]string{"If-None-Match": `"` + sha256Hex(blob) + `"`})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+}
+
+func TestMetaDirIsReserved(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/x.txt", []byte("x"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, "/"+metaDir+"/x.txt", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = rawPut(e, "/"+metaDir+"/x.txt", []byte("forged"), nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	infos, err := localStorage{}.List(context.Background(), "")
+	require.NoError(t, err)
+
+	for _, info := range infos {
+		assert.NotEqual(t, metaDir, info.Name())
+	}
+
+	req := buildDeleteRequest(t, "/delete", map[string]string{"path": "", "days": "0", "recursive": "true"})
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	assert.Contains(t, rec.Body.String(), `"count":1`, "the sweep sees x.txt but not the records")
+
+	_, err = os.Stat(filepath.Join(tempdir, metaDir, "x.txt"))
+	assert.True(t, os.IsNotExist(err), "deleting a file drops its record")
+}
+
+func TestLockKeySerializesAndReleases(t *testing.T) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		inside  int
+		maxSeen int
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			unlock := lockKey("k")
+			defer unlock()
+
+			mu.Lock()
+			inside++
+			maxSeen = max(maxSeen, inside)
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			inside--
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 1, maxSeen)
+
+	keyLocks.Lock()
+	defer keyLocks.Unlock()
+	assert.Empty(t, keyLocks.held)
+}
+
+func TestLockKeyCoversTheSubtree(t *testing.T) {
+	for _, pair := range [][2]string{{"a", "a/b"}, {"a/b", "a"}, {"", "x/y"}, {"a", "a"}} {
+		unlock := lockKey(pair[0])
+
+		locked := make(chan func())
+		go func() { locked <- lockKey(pair[1]) }()
+
+		select {
+		case <-locked:
+			t.Fatalf("%q was locked while %q was held", pair[1], pair[0])
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		unlock()
+		(<-locked)()
+	}
+
+	unlock := lockKey("a")
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		lockKeys("ab", "b/c")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("siblings must not wait for each other")
+	}
+}
@@ -0,0 +1,128 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A minimal Prometheus text exposition. The server only has a handful of
+// series, which does not justify the client library. It lives below the
+// reserved digest dir, so no stored key can shadow it and no public prefix
+// can open it when reads need credentials.
+const metricsPath = "/" + metaDirPrefix + "metrics"
+
+type metricKind string
+
+const (
+	metricCounter metricKind = "counter"
+	metricGauge   metricKind = "gauge"
+)
+
+// metricFamily holds the samples of one metric name, keyed by their
+// rendered label set.
+type metricFamily struct {
+	name   string
+	help   string
+	kind   metricKind
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var metricRegistry struct {
+	sync.Mutex
+	families []*metricFamily
+}
+
+func newMetric(kind metricKind, name, help string) *metricFamily {
+	m := &metricFamily{name: name, help: help, kind: kind, values: make(map[string]float64)}
+
+	metricRegistry.Lock()
+	metricRegistry.families = append(metricRegistry.families, m)
+	metricRegistry.Unlock()
+
+	return m
+}
+
+// add increments the sample for labels, given as name/value pairs.
+func (m *metricFamily) add(v float64, labels ...string) {
+	key := renderLabels(labels)
+
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metricFamily) set(v float64, labels ...string) {
+	key := renderLabels(labels)
+
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func (m *metricFamily) get(labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[renderLabels(labels)]
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeMetrics(w io.Writer) error {
+	metricRegistry.Lock()
+	families := append([]*metricFamily(nil), metricRegistry.families...)
+	metricRegistry.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+
+	for _, m := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", m.name, k, strconv.FormatFloat(m.values[k], 'g', -1, 64))
+		}
+		m.mu.Unlock()
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func serveMetrics(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+
+	return writeMetrics(c.Response())
+}
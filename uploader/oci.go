@@ -0,0 +1,690 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OCI distribution spec (https://github.com/opencontainers/distribution-spec),
+// the subset registry cache exporters (BuildKit --cache-to type=registry,
+// kaniko --cache-repo) need: blob pull/push with monolithic and chunked
+// uploads, and manifest push/pull by tag and digest. Layout in the cache root:
+//
+//	oci/blobs/{alg}/{hex}                                   content-addressed blobs and manifests
+//	oci/repositories/{name}/_manifests/revisions/{alg}/{hex}  manifest media type
+//	oci/repositories/{name}/_manifests/tags/{tag}           manifest digest
+//
+// Blobs are shared across repositories. Upload sessions are plain files in
+// the staging dir named after the session ID, so no session state is kept
+// in memory; a session that sees no chunk for ociSessionTTL is reclaimed.
+// Every upload is hashed and checked against the client's digest before it
+// is published.
+const (
+	ociRoutePrefix     = "/v2"
+	ociKeyPrefix       = "oci"
+	ociStagingPrefix   = "oci-"
+	maxOCIManifestSize = 4 << 20
+	maxOCITagLength    = 128
+	// Each chunk bumps the session file's mtime, so this is idle time.
+	ociSessionTTL = 24 * time.Hour
+)
+
+// Error codes from the distribution spec.
+const (
+	ociBlobUnknown       = "BLOB_UNKNOWN"
+	ociBlobUploadUnknown = "BLOB_UPLOAD_UNKNOWN"
+	ociBlobUploadInvalid = "BLOB_UPLOAD_INVALID"
+	ociDigestInvalid     = "DIGEST_INVALID"
+	ociManifestInvalid   = "MANIFEST_INVALID"
+	ociManifestUnknown   = "MANIFEST_UNKNOWN"
+	ociNameInvalid       = "NAME_INVALID"
+	ociUnsupported       = "UNSUPPORTED"
+)
+
+type ociErrorBody struct {
+	Errors []ociErrorEntry `json:"errors"`
+}
+
+type ociErrorEntry struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ociError is rendered by echo's error handler as the spec's error body.
+func ociError(status int, code, msg string) *echo.HTTPError {
+	return echo.NewHTTPError(status, ociErrorBody{Errors: []ociErrorEntry{{Code: code, Message: msg}}})
+}
+
+func registerOCIRoutes(e *echo.Echo) {
+	e.GET(ociRoutePrefix+"/*", ociDispatch)
+	e.HEAD(ociRoutePrefix+"/*", ociDispatch)
+	e.POST(ociRoutePrefix+"/*", ociDispatch)
+	e.PATCH(ociRoutePrefix+"/*", ociDispatch)
+	e.PUT(ociRoutePrefix+"/*", ociDispatch)
+	e.DELETE(ociRoutePrefix+"/*", ociDispatch)
+}
+
+type ociRoute struct {
+	name string
+	kind string // "base", "blob", "upload" or "manifest"
+	ref  string // digest, upload session ID or manifest reference
+}
+
+// parseOCIRoute splits /v2/{name}/{kind}/{ref}. Repository names contain
+// slashes, so the kind marker is searched from the right.
+func parseOCIRoute(rest string) (ociRoute, error) {
+	if rest == "" {
+		return ociRoute{kind: "base"}, nil
+	}
+
+	var r ociRoute
+
+	switch {
+	case strings.Contains(rest, "/blobs/uploads"):
+		i := strings.LastIndex(rest, "/blobs/uploads")
+		r = ociRoute{name: rest[:i], kind: "upload", ref: strings.TrimPrefix(rest[i+len("/blobs/uploads"):], "/")}
+	case strings.Contains(rest, "/blobs/"):
+		i := strings.LastIndex(rest, "/blobs/")
+		r = ociRoute{name: rest[:i], kind: "blob", ref: rest[i+len("/blobs/"):]}
+	case strings.Contains(rest, "/manifests/"):
+		i := strings.LastIndex(rest, "/manifests/")
+		r = ociRoute{name: rest[:i], kind: "manifest", ref: rest[i+len("/manifests/"):]}
+	default:
+		return r, echo.ErrNotFound
+	}
+
+	if !isOCIRepositoryName(r.name) {
+		return r, ociError(http.StatusBadRequest, ociNameInvalid, "invalid repository name")
+	}
+
+	return r, nil
+}
+
+func ociDispatch(c echo.Context) error {
+	r, err := parseOCIRoute(c.Param("*"))
+	if err != nil {
+		return err
+	}
+
+	method := c.Request().Method
+
+	switch {
+	case r.kind == "base" && (method == http.MethodGet || method == http.MethodHead):
+		c.Response().Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		return c.JSON(http.StatusOK, struct{}{})
+	case r.kind == "blob" && (method == http.MethodGet || method == http.MethodHead):
+		return ociGetBlob(c, r)
+	case r.kind == "upload":
+		return ociUpload(c, r, method)
+	case r.kind == "manifest" && (method == http.MethodGet || method == http.MethodHead):
+		return ociGetManifest(c, r)
+	case r.kind == "manifest" && method == http.MethodPut:
+		return ociPutManifest(c, r)
+	default:
+		return ociError(http.StatusMethodNotAllowed, ociUnsupported, "operation not supported")
+	}
+}
+
+func ociUpload(c echo.Context, r ociRoute, method string) error {
+	switch {
+	case r.ref == "" && method == http.MethodPost:
+		return ociStartUpload(c, r)
+	case r.ref == "":
+		return ociError(http.StatusMethodNotAllowed, ociUnsupported, "operation not supported")
+	}
+
+	tmp, err := ociSessionPath(r.ref)
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case http.MethodGet:
+		return ociUploadStatus(c, r, tmp, http.StatusNoContent)
+	case http.MethodPatch:
+		return ociPatchUpload(c, r, tmp)
+	case http.MethodPut:
+		return ociFinishUpload(c, r, tmp)
+	case http.MethodDelete:
+		if err := os.Remove(tmp); err != nil {
+			return ociError(http.StatusNotFound, ociBlobUploadUnknown, "upload session not found")
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	default:
+		return ociError(http.StatusMethodNotAllowed, ociUnsupported, "operation not supported")
+	}
+}
+
+// isOCIRepositoryName implements the spec's name grammar:
+// [a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(\/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*
+func isOCIRepositoryName(name string) bool {
+	if name == "" || len(name) > 255 {
+		return false
+	}
+
+	for _, comp := range strings.Split(name, "/") {
+		if !isOCINameComponent(comp) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isOCINameComponent checks one path component: alphanumeric runs joined
+// by ".", "_", "__" or any number of dashes.
+func isOCINameComponent(s string) bool {
+	isLowerAlnum := func(b byte) bool { return ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') }
+
+	i := 0
+
+	for {
+		runStart := i
+		for i < len(s) && isLowerAlnum(s[i]) {
+			i++
+		}
+
+		if i == runStart {
+			return false
+		}
+
+		if i == len(s) {
+			return true
+		}
+
+		sepStart := i
+		for i < len(s) && strings.IndexByte(".-_", s[i]) >= 0 {
+			i++
+		}
+
+		switch sep := s[sepStart:i]; {
+		case sep == ".", sep == "_", sep == "__", strings.Trim(sep, "-") == "":
+		default:
+			return false
+		}
+	}
+}
+
+func isOCITag(s string) bool {
+	if s == "" || len(s) > maxOCITagLength || s[0] == '.' || s[0] == '-' {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !isAlphaNum(c) && c != '_' && c != '.' && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseOCIDigest accepts sha256 and sha512 digests in lowercase hex.
+func parseOCIDigest(d string) (string, string, bool) {
+	alg, encoded, ok := strings.Cut(d, ":")
+	if !ok {
+		return "", "", false
+	}
+
+	want := map[string]int{"sha256": sha256.Size * 2, "sha512": sha512.Size * 2}[alg]
+	if want == 0 || len(encoded) != want {
+		return "", "", false
+	}
+
+	if !isHex(encoded) {
+		return "", "", false
+	}
+
+	return alg, encoded, true
+}
+
+func newOCIHash(alg string) hash.Hash {
+	if alg == "sha512" {
+		return sha512.New()
+	}
+
+	return sha256.New()
+}
+
+func ociBlobKey(digest string) string {
+	alg, encoded, _ := parseOCIDigest(digest)
+	return ociKeyPrefix + "/blobs/" + alg + "/" + encoded
+}
+
+func ociManifestsKey(name string) string {
+	return ociKeyPrefix + "/repositories/" + name + "/_manifests"
+}
+
+func ociRevisionKey(name, digest string) string {
+	alg, encoded, _ := parseOCIDigest(digest)
+	return ociManifestsKey(name) + "/revisions/" + alg + "/" + encoded
+}
+
+func ociGetBlob(c echo.Context, r ociRoute) error {
+	if _, _, ok := parseOCIDigest(r.ref); !ok {
+		return ociError(http.StatusBadRequest, ociDigestInvalid, "invalid digest")
+	}
+
+	key := ociBlobKey(r.ref)
+
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return err
+	}
+
+	if _, err := store.Stat(c.Request().Context(), key); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ociError(http.StatusNotFound, ociBlobUnknown, "blob unknown to registry")
+		}
+
+		return storageHTTPError(err)
+	}
+
+	c.Response().Header().Set("Docker-Content-Digest", r.ref)
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+
+	if c.Request().Method == http.MethodHead {
+		return statStoredFile(c, key)
+	}
+
+	return serveStoredFile(c, key)
+}
+
+// ociStartUpload opens a session, or completes the upload in one request
+// when the client sends ?digest= (monolithic) or ?mount= for a blob that
+// is already stored.
+func ociStartUpload(c echo.Context, r ociRoute) error {
+	if mount := c.QueryParam("mount"); mount != "" {
+		if _, _, ok := parseOCIDigest(mount); ok {
+			if _, err := store.Stat(c.Request().Context(), ociBlobKey(mount)); err == nil {
+				return ociBlobCreated(c, r, mount)
+			}
+		}
+	}
+
+	if digest := c.QueryParam("digest"); digest != "" {
+		return ociMonolithicUpload(c, r, digest)
+	}
+
+	reclaimExpiredOCISessions(time.Now())
+
+	tmp, err := reserveStagingName(ociStagingPrefix)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := os.WriteFile(tmp, nil, 0o644); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("create upload session: %s", err))
+	}
+
+	return ociUploadStatus(c, ociRoute{name: r.name, kind: r.kind, ref: strings.TrimPrefix(filepath.Base(tmp), ociStagingPrefix)},
+		tmp, http.StatusAccepted)
+}
+
+func ociMonolithicUpload(c echo.Context, r ociRoute, digest string) error {
+	alg, encoded, ok := parseOCIDigest(digest)
+	if !ok {
+		return ociError(http.StatusBadRequest, ociDigestInvalid, "invalid digest")
+	}
+
+	h := newOCIHash(alg)
+	tmp, _, _, err := streamPartToStagedTemp(io.TeeReader(c.Request().Body, h))
+
+	defer removeStaged(tmp)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("stage upload: %s", err))
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != encoded {
+		return ociError(http.StatusBadRequest, ociDigestInvalid, "content does not match digest")
+	}
+
+	return ociPublishBlob(c, r, tmp, digest)
+}
+
+// ociSessionPath maps a session ID from the URL onto its staging file. IDs
+// are the hex suffix reserveStagingName generated.
+func ociSessionPath(id string) (string, error) {
+	if len(id) != 16 || !isHex(id) {
+		return "", ociError(http.StatusNotFound, ociBlobUploadUnknown, "upload session not found")
+	}
+
+	tmp := filepath.Join(absStagePath, ociStagingPrefix+id)
+
+	if _, err := os.Stat(tmp); err != nil {
+		return "", ociError(http.StatusNotFound, ociBlobUploadUnknown, "upload session not found")
+	}
+
+	return tmp, nil
+}
+
+// reclaimExpiredOCISessions removes upload sessions that went idle while
+// the server runs; the startup sweep covers the rest.
+func reclaimExpiredOCISessions(now time.Time) {
+	entries, err := os.ReadDir(absStagePath)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ociStagingPrefix) {
+			continue
+		}
+
+		if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > ociSessionTTL {
+			removeStaged(filepath.Join(absStagePath, e.Name()))
+		}
+	}
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ociUploadStatus(c echo.Context, r ociRoute, tmp string, status int) error {
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return ociError(http.StatusNotFound, ociBlobUploadUnknown, "upload session not found")
+	}
+
+	end := info.Size()
+	if end > 0 {
+		end--
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderLocation, ociRoutePrefix+"/"+r.name+"/blobs/uploads/"+r.ref)
+	h.Set("Docker-Upload-UUID", r.ref)
+	h.Set("Range", fmt.Sprintf("0-%d", end))
+	h.Set(echo.HeaderContentLength, "0")
+
+	return c.NoContent(status)
+}
+
+// ociPatchUpload appends a chunk. Chunks must arrive in order; a
+// Content-Range that does not start at the current size is refused with
+// 416 so the client can resume from the reported Range.
+func ociPatchUpload(c echo.Context, r ociRoute, tmp string) error {
+	if err := appendOCIChunk(c, tmp); err != nil {
+		return err
+	}
+
+	return ociUploadStatus(c, r, tmp, http.StatusAccepted)
+}
+
+func appendOCIChunk(c echo.Context, tmp string) error {
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return ociError(http.StatusNotFound, ociBlobUploadUnknown, "upload session not found")
+	}
+
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			log.Printf("error closing upload session %s: %v", tmp, closeErr)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if cr := c.Request().Header.Get("Content-Range"); cr != "" {
+		startStr, _, _ := strings.Cut(cr, "-")
+
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil || start != info.Size() {
+			return ociError(http.StatusRequestedRangeNotSatisfiable, ociBlobUploadInvalid,
+				fmt.Sprintf("chunk must start at offset %d", info.Size()))
+		}
+	}
+
+	if _, err := io.Copy(f, c.Request().Body); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("write chunk: %s", err))
+	}
+
+	return nil
+}
+
+// ociFinishUpload takes the optional last chunk, checks the digest over the
+// whole session file and publishes it.
+func ociFinishUpload(c echo.Context, r ociRoute, tmp string) error {
+	digest := c.QueryParam("digest")
+
+	alg, encoded, ok := parseOCIDigest(digest)
+	if !ok {
+		return ociError(http.StatusBadRequest, ociDigestInvalid, "digest query parameter is required")
+	}
+
+	if err := appendOCIChunk(c, tmp); err != nil {
+		return err
+	}
+
+	sum, err := hashFile(tmp, newOCIHash(alg))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if sum != encoded {
+		removeStaged(tmp)
+		return ociError(http.StatusBadRequest, ociDigestInvalid, "content does not match digest")
+	}
+
+	defer removeStaged(tmp)
+
+	return ociPublishBlob(c, r, tmp, digest)
+}
+
+func ociPublishBlob(c echo.Context, r ociRoute, tmp, digest string) error {
+	// A sha256 digest has just been verified and doubles as the record.
+	var sum string
+	if alg, encoded, _ := parseOCIDigest(digest); alg == "sha256" {
+		sum = encoded
+	}
+
+	if err := publishFileDigest(c.Request().Context(), ociBlobKey(digest), tmp, sum, writeCondition{}); err != nil {
+		return publishHTTPError(err)
+	}
+
+	return ociBlobCreated(c, r, digest)
+}
+
+func ociBlobCreated(c echo.Context, r ociRoute, digest string) error {
+	h := c.Response().Header()
+	h.Set(echo.HeaderLocation, ociRoutePrefix+"/"+r.name+"/blobs/"+digest)
+	h.Set("Docker-Content-Digest", digest)
+	h.Set(echo.HeaderContentLength, "0")
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// ociResolveManifest turns a tag or digest reference into a digest that has
+// been pushed to this repository.
+func ociResolveManifest(c echo.Context, r ociRoute) (string, string, error) {
+	ctx := c.Request().Context()
+	digest := r.ref
+
+	if _, _, ok := parseOCIDigest(r.ref); !ok {
+		if !isOCITag(r.ref) {
+			return "", "", ociError(http.StatusBadRequest, ociManifestInvalid, "invalid reference")
+		}
+
+		link, err := readSmallObject(c, ociManifestsKey(r.name)+"/tags/"+r.ref)
+		if err != nil {
+			return "", "", ociManifestError(err)
+		}
+
+		digest = strings.TrimSpace(link)
+		if _, _, ok := parseOCIDigest(digest); !ok {
+			return "", "", ociError(http.StatusNotFound, ociManifestUnknown, "manifest unknown")
+		}
+	}
+
+	mediaType, err := readSmallObject(c, ociRevisionKey(r.name, digest))
+	if err != nil {
+		return "", "", ociManifestError(err)
+	}
+
+	if _, err := store.Stat(ctx, ociBlobKey(digest)); err != nil {
+		return "", "", ociManifestError(err)
+	}
+
+	return digest, mediaType, nil
+}
+
+func ociManifestError(err error) error {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return ociError(http.StatusNotFound, ociManifestUnknown, "manifest unknown")
+	}
+
+	return storageHTTPError(err)
+}
+
+// readSmallObject reads a tag or revision record. Either tells which
+// manifest a repository holds, so it takes the same read access.
+func readSmallObject(c echo.Context, key string) (string, error) {
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return "", err
+	}
+
+	obj, err := store.Open(c.Request().Context(), key)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing %s: %v", key, closeErr)
+		}
+	}()
+
+	b, err := io.ReadAll(io.LimitReader(obj, maxOCIManifestSize))
+
+	return string(b), err
+}
+
+func ociGetManifest(c echo.Context, r ociRoute) error {
+	digest, mediaType, err := ociResolveManifest(c, r)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Docker-Content-Digest", digest)
+	c.Response().Header().Set(echo.HeaderContentType, mediaType)
+
+	if c.Request().Method == http.MethodHead {
+		return statStoredFile(c, ociBlobKey(digest))
+	}
+
+	return serveStoredFile(c, ociBlobKey(digest))
+}
+
+// ociPutManifest stores the manifest as a blob, then its revision link and
+// finally the tag, so a tag never points at a manifest that is not
+// readable yet. Referenced blobs are not checked: cache exporters push
+// layers first, and a cache miss on a missing layer is harmless. Every
+// write is checked before the first one lands, so a refused tag leaves
+// nothing behind; If-Match and If-None-Match apply to the reference
+// pushed, the tag or the digest.
+func ociPutManifest(c echo.Context, r ociRoute) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxOCIManifestSize+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("read manifest: %s", err))
+	}
+
+	if len(body) > maxOCIManifestSize {
+		return ociError(http.StatusRequestEntityTooLarge, ociManifestInvalid, "manifest exceeds 4 MiB")
+	}
+
+	if !json.Valid(body) {
+		return ociError(http.StatusBadRequest, ociManifestInvalid, "manifest is not valid JSON")
+	}
+
+	alg := "sha256"
+	tag := ""
+
+	if refAlg, _, ok := parseOCIDigest(r.ref); ok {
+		alg = refAlg
+	} else if isOCITag(r.ref) {
+		tag = r.ref
+	} else {
+		return ociError(http.StatusBadRequest, ociManifestInvalid, "invalid reference")
+	}
+
+	h := newOCIHash(alg)
+	h.Write(body)
+	digest := alg + ":" + hex.EncodeToString(h.Sum(nil))
+
+	if tag == "" && digest != r.ref {
+		return ociError(http.StatusBadRequest, ociDigestInvalid, "manifest does not match digest")
+	}
+
+	mediaType := c.Request().Header.Get(echo.HeaderContentType)
+	if mediaType == "" {
+		mediaType = "application/vnd.oci.image.manifest.v1+json"
+	}
+
+	ctx := c.Request().Context()
+
+	type manifestWrite struct {
+		key, data string
+		cond      writeCondition
+	}
+
+	cond := writeConditionFromRequest(c.Request().Header)
+	writes := []manifestWrite{
+		{key: ociBlobKey(digest), data: string(body)},
+		{key: ociRevisionKey(r.name, digest), data: mediaType},
+	}
+
+	if tag != "" {
+		writes = append(writes, manifestWrite{key: ociManifestsKey(r.name) + "/tags/" + tag, data: digest, cond: cond})
+	} else {
+		writes[0].cond = cond
+	}
+
+	for _, w := range writes {
+		if err := checkWrite(ctx, w.key, w.cond); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range writes {
+		if _, _, err := putDigest(ctx, w.key, strings.NewReader(w.data), w.cond); err != nil {
+			return publishHTTPError(err)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, ociRoutePrefix+"/"+r.name+"/manifests/"+digest)
+	c.Response().Header().Set("Docker-Content-Digest", digest)
+
+	return c.NoContent(http.StatusCreated)
+}
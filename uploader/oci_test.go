@@ -0,0 +1,235 @@
+package uploader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ociRequest(e *echo.Echo, method, target string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestOCIMonolithicBlobUpload(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	blob := []byte("layer-bytes")
+	digest := "sha256:" + sha256Hex(blob)
+
+	rec := ociRequest(e, http.MethodGet, "/v2/", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "registry/2.0", rec.Header().Get("Docker-Distribution-API-Version"))
+
+	rec = ociRequest(e, http.MethodHead, "/v2/team/app/blobs/"+digest, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = ociRequest(e, http.MethodPost, "/v2/team/app/blobs/uploads/?digest=sha256:"+strings.Repeat("0", 64), blob, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "wrong digest must not publish")
+	assert.Contains(t, rec.Body.String(), ociDigestInvalid)
+
+	rec = ociRequest(e, http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+digest, blob, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, "/v2/team/app/blobs/"+digest, rec.Header().Get(echo.HeaderLocation))
+
+	got, err := os.ReadFile(filepath.Join(tempdir, ociKeyPrefix, "blobs", "sha256", sha256Hex(blob)))
+	require.NoError(t, err)
+	assert.Equal(t, blob, got)
+
+	rec = ociRequest(e, http.MethodGet, "/v2/team/app/blobs/"+digest, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, blob, rec.Body.Bytes())
+	assert.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+
+	rec = ociRequest(e, http.MethodHead, "/v2/team/app/blobs/"+digest, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "11", rec.Header().Get(echo.HeaderContentLength))
+
+	rec = ociRequest(e, http.MethodPost, "/v2/other/blobs/uploads/?mount="+digest+"&from=team/app", nil, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code, "blobs are shared, so mounts succeed")
+}
+
+func TestOCIChunkedBlobUpload(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	blob := []byte("0123456789abcdef")
+	digest := "sha256:" + sha256Hex(blob)
+
+	rec := ociRequest(e, http.MethodPost, "/v2/cache/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	location := rec.Header().Get(echo.HeaderLocation)
+	require.True(t, strings.HasPrefix(location, "/v2/cache/blobs/uploads/"), location)
+
+	rec = ociRequest(e, http.MethodPatch, location, blob[:10], map[string]string{"Content-Range": "0-9"})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	assert.Equal(t, "0-9", rec.Header().Get("Range"))
+
+	rec = ociRequest(e, http.MethodPatch, location, blob[10:], map[string]string{"Content-Range": "5-10"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code, "out-of-order chunk")
+
+	rec = ociRequest(e, http.MethodGet, location, nil, nil)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "0-9", rec.Header().Get("Range"))
+
+	rec = ociRequest(e, http.MethodPut, location+"?digest="+digest, blob[10:], nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+
+	got, err := os.ReadFile(filepath.Join(tempdir, ociKeyPrefix, "blobs", "sha256", sha256Hex(blob)))
+	require.NoError(t, err)
+	assert.Equal(t, blob, got)
+
+	rec = ociRequest(e, http.MethodGet, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "session is gone once published")
+
+	leftovers, err := filepath.Glob(filepath.Join(tempdir, stagingDir, ociStagingPrefix+"*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestOCIChunkedUploadDigestMismatch(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := ociRequest(e, http.MethodPost, "/v2/cache/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	location := rec.Header().Get(echo.HeaderLocation)
+
+	rec = ociRequest(e, http.MethodPut, location+"?digest=sha256:"+strings.Repeat("a", 64), []byte("data"), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, ociKeyPrefix, "blobs"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOCIIdleUploadSessionsExpire(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := ociRequest(e, http.MethodPost, "/v2/cache/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	idle := rec.Header().Get(echo.HeaderLocation)
+
+	rec = ociRequest(e, http.MethodPost, "/v2/cache/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	active := rec.Header().Get(echo.HeaderLocation)
+
+	old := time.Now().Add(-ociSessionTTL - time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(absStagePath, ociStagingPrefix+filepath.Base(idle)), old, old))
+
+	rec = ociRequest(e, http.MethodPost, "/v2/cache/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	rec = ociRequest(e, http.MethodGet, idle, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "the idle session is reclaimed")
+
+	rec = ociRequest(e, http.MethodGet, active, nil, nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code, "a recent session is kept")
+}
+
+func TestOCIManifestByTagAndDigest(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	digest := "sha256:" + sha256Hex(manifest)
+	mediaType := "application/vnd.oci.image.index.v1+json"
+
+	rec := ociRequest(e, http.MethodGet, "/v2/team/app/manifests/buildcache", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), ociManifestUnknown)
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/app/manifests/buildcache", manifest,
+		map[string]string{echo.HeaderContentType: mediaType})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+
+	for _, ref := range []string{"buildcache", digest} {
+		rec = ociRequest(e, http.MethodGet, "/v2/team/app/manifests/"+ref, nil, nil)
+		require.Equal(t, http.StatusOK, rec.Code, ref)
+		assert.Equal(t, manifest, rec.Body.Bytes())
+		assert.Equal(t, mediaType, rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+
+		rec = ociRequest(e, http.MethodHead, "/v2/team/app/manifests/"+ref, nil, nil)
+		assert.Equal(t, http.StatusOK, rec.Code, ref)
+	}
+
+	rec = ociRequest(e, http.MethodGet, "/v2/team/other/manifests/"+digest, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "manifests are scoped to their repository")
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/app/manifests/sha256:"+strings.Repeat("b", 64), manifest, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "digest reference must match the body")
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/app/manifests/bad", []byte("{not json"), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestOCIManifestWritesArePublishes(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{immutablePrefixes: []string{ociManifestsKey("team/release") + "/tags"}})
+	t.Cleanup(func() { setImmutablePrefixes(nil) })
+
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	other := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[],"annotations":{}}`)
+
+	rec := ociRequest(e, http.MethodPut, "/v2/team/app/manifests/latest", manifest, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = ociRequest(e, http.MethodGet, "/v2/team/app/manifests/latest", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"`+sha256Hex(manifest)+`"`, rec.Header().Get("ETag"), "the manifest has a digest record")
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/app/manifests/latest", other, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code, "the precondition applies to the tag")
+
+	rec = ociRequest(e, http.MethodGet, "/v2/team/app/manifests/sha256:"+sha256Hex(other), nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "a refused tag leaves no manifest behind")
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/release/manifests/v1", manifest, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = ociRequest(e, http.MethodPut, "/v2/team/release/manifests/v1", other, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "tags below an immutable prefix cannot move")
+
+	rec = ociRequest(e, http.MethodGet, "/v2/team/release/manifests/v1", nil, nil)
+	assert.Equal(t, manifest, rec.Body.Bytes())
+}
+
+func TestOCIWritesRequireCredentials(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{credentials: "user:pass"})
+
+	blob := []byte("x")
+
+	rec := ociRequest(e, http.MethodPost, "/v2/app/blobs/uploads/?digest=sha256:"+sha256Hex(blob), blob, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = ociRequest(e, http.MethodGet, "/v2/", nil, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestOCIRepositoryNames(t *testing.T) {
+	for _, name := range []string{"app", "team/app", "a.b_c__d---e/f0"} {
+		assert.True(t, isOCIRepositoryName(name), name)
+	}
+
+	for _, name := range []string{"", "App", "team//app", "-app", "app-", "a..b", "a___b", "a._b", "../x", "a/_manifests"} {
+		assert.False(t, isOCIRepositoryName(name), name)
+	}
+}
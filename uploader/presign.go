@@ -0,0 +1,246 @@
+package uploader
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+)
+
+// Presigned URLs hand a single operation on a single path to a caller
+// without credentials, like S3's. POST /api/v1/presign mints them for an
+// authenticated caller; the query carries the method, expiry, optional
+// size cap and the caller's name, and an HMAC-SHA256 over all of them and
+// the path under UPLOADER_PRESIGN_KEY. A valid signature stands in for
+// credentials: the request runs as the caller, narrowed to that path and
+// method, so the ACLs still apply. The caller is looked up again on every
+// use, so revoking or narrowing their credentials revokes their URLs.
+const (
+	presignRoute            = "/api/v1/presign"
+	defaultPresignExpiry    = 15 * time.Minute
+	maxPresignExpiry        = 7 * 24 * time.Hour
+	minPresignKeyLength     = 32
+	presignMethodParam      = "X-Krci-Method"
+	presignExpiresParam     = "X-Krci-Expires"
+	presignMaxSizeParam     = "X-Krci-Max-Size"
+	presignPrincipalParam   = "X-Krci-Principal"
+	presignSignatureParam   = "X-Krci-Signature"
+	presignSignatureVersion = "krci-presign-v1"
+)
+
+type presignConfig struct {
+	key []byte
+}
+
+func loadPresignConfig(authEnabled bool) (presignConfig, error) {
+	var cfg presignConfig
+
+	v := os.Getenv("UPLOADER_PRESIGN_KEY")
+	if v == "" {
+		return cfg, nil
+	}
+
+	if len(v) < minPresignKeyLength {
+		return cfg, fmt.Errorf("UPLOADER_PRESIGN_KEY must be at least %d characters", minPresignKeyLength)
+	}
+
+	if !authEnabled {
+		return cfg, errors.New("UPLOADER_PRESIGN_KEY requires UPLOADER_UPLOAD_CREDENTIALS, UPLOADER_AUTH_FILE or UPLOADER_SA_AUDIENCE")
+	}
+
+	cfg.key = []byte(v)
+
+	return cfg, nil
+}
+
+func (cfg presignConfig) enabled() bool { return len(cfg.key) > 0 }
+
+// presignedRequest is what a signature covers.
+type presignedRequest struct {
+	method    string
+	key       string
+	expires   int64
+	maxSize   int64
+	principal string
+}
+
+func (cfg presignConfig) sign(r presignedRequest) string {
+	mac := hmac.New(sha256.New, cfg.key)
+	fmt.Fprintf(mac, "%s\n%s\n/%s\n%d\n%d\n%s", presignSignatureVersion, r.method, r.key, r.expires, r.maxSize, r.principal)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// presignedMethods are the operations a URL can carry: downloads and raw
+// PUT uploads, the ones addressed by the URL path alone.
+var presignedMethods = map[string]authScope{
+	http.MethodGet:  scopeRead,
+	http.MethodHead: scopeRead,
+	http.MethodPut:  scopeWrite,
+}
+
+func registerPresignRoutes(e *echo.Echo, cfg presignConfig) {
+	if !cfg.enabled() {
+		return
+	}
+
+	e.POST(presignRoute, func(c echo.Context) error { return mintPresignedURL(c, cfg) })
+}
+
+func mintPresignedURL(c echo.Context, cfg presignConfig) error {
+	p := principalFrom(c.Request().Context())
+	if p == nil {
+		return echo.ErrUnauthorized
+	}
+
+	method := strings.ToUpper(c.FormValue("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	scope, ok := presignedMethods[method]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("method %q cannot be presigned (want GET, HEAD or PUT)", method))
+	}
+
+	key, err := safeKey(c.FormValue("path"))
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "path is required")
+	}
+
+	// Nobody can hand out more than they have.
+	if err := authorizeKey(c.Request().Context(), scope, key); err != nil {
+		return err
+	}
+
+	expiry := defaultPresignExpiry
+
+	if v := c.FormValue("expires_in"); v != "" {
+		if expiry, err = time.ParseDuration(v); err != nil || expiry <= 0 || expiry > maxPresignExpiry {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expires_in must be a duration up to %s", maxPresignExpiry))
+		}
+	}
+
+	r := presignedRequest{method: method, key: key, principal: p.name}
+
+	if v := c.FormValue("max_size"); v != "" {
+		if method != http.MethodPut {
+			return echo.NewHTTPError(http.StatusBadRequest, "max_size only applies to PUT")
+		}
+
+		if r.maxSize, err = bytes.Parse(v); err != nil || r.maxSize <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid max_size %q", v))
+		}
+	}
+
+	expiresAt := time.Now().Add(expiry).Truncate(time.Second)
+	r.expires = expiresAt.Unix()
+
+	q := url.Values{
+		presignMethodParam:    {r.method},
+		presignExpiresParam:   {strconv.FormatInt(r.expires, 10)},
+		presignPrincipalParam: {r.principal},
+		presignSignatureParam: {cfg.sign(r)},
+	}
+
+	if r.maxSize > 0 {
+		q.Set(presignMaxSizeParam, strconv.FormatInt(r.maxSize, 10))
+	}
+
+	u := url.URL{Scheme: c.Scheme(), Host: c.Request().Host, Path: "/" + key, RawQuery: q.Encode()}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"url":        u.String(),
+		"method":     r.method,
+		"expires_at": expiresAt.UTC(),
+	})
+}
+
+func isPresigned(req *http.Request) bool {
+	return req.URL.Query().Has(presignSignatureParam)
+}
+
+// verifyPresigned checks the signature on req and returns the principal
+// it runs as. Any mismatch is a 403 with the reason, never a fallback to
+// other credentials.
+func (cfg presignConfig) verifyPresigned(req *http.Request) (*principal, error) {
+	if !cfg.enabled() {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "presigned URLs are not enabled")
+	}
+
+	q := req.URL.Query()
+	r := presignedRequest{
+		method:    q.Get(presignMethodParam),
+		key:       strings.Trim(path.Clean("/"+req.URL.Path), "/"),
+		principal: q.Get(presignPrincipalParam),
+	}
+
+	expires, err := strconv.ParseInt(q.Get(presignExpiresParam), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "presigned URL: invalid expiry")
+	}
+
+	r.expires = expires
+
+	if v := q.Get(presignMaxSizeParam); v != "" {
+		if r.maxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, echo.NewHTTPError(http.StatusForbidden, "presigned URL: invalid max size")
+		}
+	}
+
+	if r.key == "" || !hmac.Equal([]byte(cfg.sign(r)), []byte(q.Get(presignSignatureParam))) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "presigned URL: signature does not match")
+	}
+
+	if time.Now().Unix() > r.expires {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "presigned URL: expired")
+	}
+
+	if req.Method != r.method {
+		return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("presigned URL: signed for %s, not %s", r.method, req.Method))
+	}
+
+	if r.maxSize > 0 {
+		if req.ContentLength < 0 {
+			return nil, echo.NewHTTPError(http.StatusLengthRequired, "presigned URL: Content-Length is required")
+		}
+
+		if req.ContentLength > r.maxSize {
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("presigned URL: body exceeds %d bytes", r.maxSize))
+		}
+	}
+
+	return &principal{name: r.principal, scopes: presignedMethods[r.method], prefixes: []string{r.key}}, nil
+}
+
+// verifyPresigned checks the signature on req and that the caller who
+// minted it still exists and still holds the scope and a prefix covering
+// the path.
+func (a *authenticator) verifyPresigned(req *http.Request) (*principal, error) {
+	signed, err := a.presign.verifyPresigned(req)
+	if err != nil {
+		return nil, err
+	}
+
+	live := a.lookup(signed.name)
+	if live == nil || live.scopes&signed.scopes == 0 || !live.allows(signed.prefixes[0]) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("presigned URL: %s no longer has access", signed.name))
+	}
+
+	return signed, nil
+}
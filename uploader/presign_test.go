@@ -0,0 +1,209 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPresign = presignConfig{key: []byte(strings.Repeat("k", minPresignKeyLength))}
+
+func presignServer(t *testing.T) *echo.Echo {
+	t.Helper()
+
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "ci:secret",
+		readAuth:    readAuthConfig{required: true},
+		presign:     testPresign,
+	})
+
+	rec := rawPut(e, "/builds/a.txt", []byte("artifact"), map[string]string{"Authorization": basicAuth("ci", "secret")})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	return e
+}
+
+func mint(t *testing.T, e *echo.Echo, auth string, fields url.Values) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, presignRoute, strings.NewReader(fields.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var res struct {
+		URL string `json:"url"`
+	}
+
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+
+	return rec, res.URL
+}
+
+func TestPresignedDownload(t *testing.T) {
+	e := presignServer(t)
+
+	rec, signed := mint(t, e, basicAuth("ci", "secret"), url.Values{"path": {"builds/a.txt"}, "expires_in": {"5m"}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.True(t, strings.HasPrefix(signed, "http://example.com/builds/a.txt?"), signed)
+
+	rec = getWithHeaders(e, http.MethodGet, signed, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "artifact", rec.Body.String())
+
+	rec = getWithHeaders(e, http.MethodHead, signed, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the method is signed")
+
+	rec = getWithHeaders(e, http.MethodGet, strings.Replace(signed, "/builds/a.txt", "/builds/b.txt", 1), nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the path is signed")
+
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+
+	q := u.Query()
+	q.Set(presignExpiresParam, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	u.RawQuery = q.Encode()
+
+	rec = getWithHeaders(e, http.MethodGet, u.String(), nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the expiry is signed")
+	assert.Contains(t, rec.Body.String(), "signature does not match")
+}
+
+func TestPresignedURLExpires(t *testing.T) {
+	e := presignServer(t)
+
+	r := presignedRequest{method: http.MethodGet, key: "builds/a.txt", expires: time.Now().Add(-time.Minute).Unix(), principal: "ci"}
+	q := url.Values{
+		presignMethodParam:    {r.method},
+		presignExpiresParam:   {strconv.FormatInt(r.expires, 10)},
+		presignPrincipalParam: {r.principal},
+		presignSignatureParam: {testPresign.sign(r)},
+	}
+
+	rec := getWithHeaders(e, http.MethodGet, "/builds/a.txt?"+q.Encode(), nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "expired")
+}
+
+func TestPresignedUploadHonorsMaxSize(t *testing.T) {
+	e := presignServer(t)
+
+	rec, signed := mint(t, e, basicAuth("ci", "secret"), url.Values{"path": {"drop/x.bin"}, "method": {"put"}, "max_size": {"10B"}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, signed, []byte("small"), nil)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, signed, bytes.Repeat([]byte("x"), 20), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, "/drop/x.bin", map[string]string{"Authorization": basicAuth("ci", "secret")})
+	assert.Equal(t, "small", rec.Body.String())
+}
+
+func TestMintPresignedURLChecksCaller(t *testing.T) {
+	e := presignServer(t)
+
+	rec, _ := mint(t, e, "", url.Values{"path": {"builds/a.txt"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	for _, fields := range []url.Values{
+		{"path": {"builds/a.txt"}, "method": {"DELETE"}},
+		{"path": {""}},
+		{"path": {"builds/a.txt"}, "expires_in": {"720h"}},
+		{"path": {"builds/a.txt"}, "max_size": {"1MB"}},
+	} {
+		rec, _ = mint(t, e, basicAuth("ci", "secret"), fields)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, fields.Encode())
+	}
+}
+
+func TestMintPresignedURLWithinScopes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "auth.yaml")
+	writeCredentialFile(t, p, "tokens:\n  - name: reader\n    sha256: "+sha256Hex([]byte("r"))+"\n    scopes: [read]\n")
+
+	f, err := loadCredentialFile(p, 0)
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{credentialFile: f, presign: testPresign})
+
+	rec, _ := mint(t, e, "Bearer r", url.Values{"path": {"builds/a.txt"}})
+	assert.Equal(t, http.StatusCreated, rec.Code, "a read-only caller can share downloads")
+
+	rec, _ = mint(t, e, "Bearer r", url.Values{"path": {"builds/a.txt"}, "method": {"PUT"}})
+	assert.Equal(t, http.StatusForbidden, rec.Code, "but not uploads")
+}
+
+func TestPresignedURLFollowsTheSignersCredentials(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "auth.yaml")
+	credentials := func(prefixes string) string {
+		return "tokens:\n  - name: team-a\n    sha256: " + sha256Hex([]byte("a")) + "\n    prefixes: [" + prefixes + "]\n"
+	}
+
+	writeCredentialFile(t, p, credentials("builds"))
+
+	f, err := loadCredentialFile(p, 0)
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{credentialFile: f, readAuth: readAuthConfig{required: true}, presign: testPresign})
+
+	rec := rawPut(e, "/builds/a.txt", []byte("artifact"), bearer("a"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec, signed := mint(t, e, "Bearer a", url.Values{"path": {"builds/a.txt"}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = getWithHeaders(e, http.MethodGet, signed, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	writeCredentialFile(t, p, credentials("releases, tools"))
+
+	rec = getWithHeaders(e, http.MethodGet, signed, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the signer no longer covers the path")
+
+	writeCredentialFile(t, p, "tokens: []\n")
+
+	rec = getWithHeaders(e, http.MethodGet, signed, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the signer is gone")
+
+	writeCredentialFile(t, p, credentials("builds, tools"))
+
+	rec = getWithHeaders(e, http.MethodGet, signed, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestLoadPresignConfig(t *testing.T) {
+	cfg, err := loadPresignConfig(true)
+	require.NoError(t, err)
+	assert.False(t, cfg.enabled())
+
+	t.Setenv("UPLOADER_PRESIGN_KEY", "short")
+
+	_, err = loadPresignConfig(true)
+	require.Error(t, err)
+
+	t.Setenv("UPLOADER_PRESIGN_KEY", strings.Repeat("k", minPresignKeyLength))
+
+	_, err = loadPresignConfig(false)
+	require.Error(t, err, "minting needs an authenticated caller")
+
+	cfg, err = loadPresignConfig(true)
+	require.NoError(t, err)
+	assert.True(t, cfg.enabled())
+}
@@ -42,7 +42,7 @@ func reserveStagingName(prefix string) (string, error) {
 
 // Only entries with these prefixes are swept on startup; anything else in
 // .tmp/ is assumed to be human-placed and preserved.
-var stagingArtifactPrefixes = []string{"up-", "tar-", "old-"}
+var stagingArtifactPrefixes = []string{"up-", "tar-", "old-", actionsStagingPrefix, ociStagingPrefix, tusStagingPrefix, snapshotStagingPrefix}
 
 func looksLikeStagingArtifact(name string) bool {
 	for _, p := range stagingArtifactPrefixes {
@@ -117,6 +117,11 @@ func sweepStagingOrphans(stage string) {
 			continue
 		}
 
+		// Resumable uploads outlive restarts until they expire.
+		if strings.HasPrefix(e.Name(), tusStagingPrefix) && !tusUploadExpired(stage, e.Name(), time.Now()) {
+			continue
+		}
+
 		full := filepath.Join(stage, e.Name())
 		if err := os.RemoveAll(full); err != nil {
 			log.Printf("staging sweep: failed to remove %s: %v", full, err)
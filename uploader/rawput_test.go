@@ -0,0 +1,104 @@
+package uploader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rawPut(e http.Handler, target string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, target, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestRawPutStoresBody(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/builds/app/report.txt", []byte("raw body"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"size":8`)
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "builds", "app", "report.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "raw body", string(got))
+
+	rec = rawPut(e, "/builds/app/report.txt", []byte("replaced"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	got, err = os.ReadFile(filepath.Join(tempdir, "builds", "app", "report.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "replaced", string(got))
+}
+
+func TestRawPutExtractsTarGz(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	rec := rawPut(e, "/site", makeTarGz(t, "R", 2), map[string]string{extractHeader: "tar.gz"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "site", "R-1.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "R/file-1-content", string(got))
+
+	rec = rawPut(e, "/broken", []byte("not gzip"), map[string]string{extractHeader: "tar.gz"})
+	assert.GreaterOrEqual(t, rec.Code, http.StatusBadRequest)
+
+	_, err = os.Stat(filepath.Join(tempdir, "broken"))
+	assert.True(t, os.IsNotExist(err), "failed extraction must not publish")
+
+	leftovers, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestRawPutRejectsBadRequests(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempdir, "guard.txt"), []byte("keep"), 0o644))
+
+	for _, tc := range []struct {
+		name, target, extract string
+		want                  int
+	}{
+		{"staging dir", "/.tmp/x", "", http.StatusForbidden},
+		{"traversal", "/a/../../etc/passwd", "", http.StatusForbidden},
+		{"upload root", "/", "", http.StatusBadRequest},
+		{"unknown format", "/x.rar", "rar", http.StatusBadRequest},
+	} {
+		rec := rawPut(e, tc.target, []byte("x"), map[string]string{extractHeader: tc.extract})
+		assert.Equal(t, tc.want, rec.Code, tc.name)
+	}
+
+	_, err := os.Stat(filepath.Join(tempdir, "guard.txt"))
+	assert.NoError(t, err, "upload root must survive")
+}
+
+func TestRawPutRequiresCredentials(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{credentials: "user:pass"})
+
+	rec := rawPut(e, "/a.txt", []byte("x"), nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req := httptest.NewRequest(http.MethodPut, "/a.txt", bytes.NewReader([]byte("x")))
+	req.SetBasicAuth("user", "pass")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	_, err := os.Stat(filepath.Join(tempdir, "a.txt"))
+	assert.NoError(t, err)
+}
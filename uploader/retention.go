@@ -0,0 +1,365 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Retention policies replace the external cron on DELETE /delete. Rules
+// come from the YAML file named by UPLOADER_RETENTION_CONFIG:
+//
+//	interval: 1h
+//	rules:
+//	  - prefix: releases        # no limits: keep forever
+//	  - prefix: builds
+//	    pattern: "*/*"          # builds/{app}/{build}
+//	    max_age: 7d
+//	    max_count: 20           # newest 20 per builds/{app}
+//
+// A rule matches the entries below prefix whose relative path matches
+// pattern (path.Match, so the number of segments picks the depth; default
+// "*"). The first rule matching an entry decides its fate, and no rule
+// deletes an entry that contains a keep-forever prefix.
+const defaultRetentionInterval = time.Hour
+
+type retentionRule struct {
+	Name     string `yaml:"name"`
+	Prefix   string `yaml:"prefix"`
+	Pattern  string `yaml:"pattern"`
+	MaxAge   string `yaml:"max_age"`
+	MaxCount int    `yaml:"max_count"`
+
+	maxAge time.Duration
+}
+
+type retentionConfig struct {
+	Interval string          `yaml:"interval"`
+	Rules    []retentionRule `yaml:"rules"`
+
+	interval time.Duration
+}
+
+func (r retentionRule) keepsForever() bool { return r.maxAge == 0 && r.MaxCount == 0 }
+
+func loadRetentionConfig() (retentionConfig, error) {
+	var cfg retentionConfig
+
+	p := os.Getenv("UPLOADER_RETENTION_CONFIG")
+	if p == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return cfg, fmt.Errorf("UPLOADER_RETENTION_CONFIG: %w", err)
+	}
+
+	if cfg, err = parseRetentionConfig(data); err != nil {
+		return cfg, fmt.Errorf("UPLOADER_RETENTION_CONFIG %s: %w", p, err)
+	}
+
+	return cfg, nil
+}
+
+func parseRetentionConfig(data []byte) (retentionConfig, error) {
+	var cfg retentionConfig
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, err
+	}
+
+	cfg.interval = defaultRetentionInterval
+
+	if cfg.Interval != "" {
+		d, err := parseRetentionDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid interval %q", cfg.Interval)
+		}
+
+		cfg.interval = d
+	}
+
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].validate(); err != nil {
+			return cfg, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (r *retentionRule) validate() error {
+	prefix := strings.Trim(path.Clean("/"+r.Prefix), "/")
+	if strings.Contains(r.Prefix, "..") || isReservedPath(prefix) {
+		return fmt.Errorf("invalid prefix %q", r.Prefix)
+	}
+
+	r.Prefix = prefix
+
+	if r.Pattern == "" {
+		r.Pattern = "*"
+	}
+
+	if _, err := path.Match(r.Pattern, ""); err != nil || strings.HasPrefix(r.Pattern, "/") {
+		return fmt.Errorf("invalid pattern %q", r.Pattern)
+	}
+
+	if r.MaxAge != "" {
+		d, err := parseRetentionDuration(r.MaxAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid max_age %q", r.MaxAge)
+		}
+
+		r.maxAge = d
+	}
+
+	if r.MaxCount < 0 {
+		return fmt.Errorf("invalid max_count %d", r.MaxCount)
+	}
+
+	if r.Name == "" {
+		r.Name = joinKey(r.Prefix, r.Pattern)
+	}
+
+	return nil
+}
+
+// parseRetentionDuration is time.ParseDuration plus a "d" suffix for days,
+// the unit retention is usually written in.
+func parseRetentionDuration(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(v)
+}
+
+var (
+	retentionRuns = newMetric(metricCounter, "krci_cache_retention_runs_total",
+		"Retention runs, by result.")
+	retentionDeleted = newMetric(metricCounter, "krci_cache_retention_deleted_total",
+		"Entries deleted by retention, by rule.")
+	retentionLastRun = newMetric(metricGauge, "krci_cache_retention_last_run_timestamp_seconds",
+		"Unix time the last retention run finished.")
+	retentionLastDuration = newMetric(metricGauge, "krci_cache_retention_last_run_duration_seconds",
+		"Duration of the last retention run.")
+)
+
+func runRetention(ctx context.Context, cfg retentionConfig) {
+	log.Printf("retention: %d rules, every %s", len(cfg.Rules), cfg.interval)
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		_, _ = applyRetention(ctx, cfg.Rules, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// retentionEntry is a stored entry matched by a rule.
+type retentionEntry struct {
+	key     string
+	parent  string
+	modTime time.Time
+}
+
+// applyRetention runs every rule once and returns the deleted keys. Rules
+// keep going past failures; the error joins them for the caller.
+func applyRetention(ctx context.Context, rules []retentionRule, now time.Time) ([]string, error) {
+	start := time.Now()
+
+	var (
+		deleted []string
+		errs    []error
+		claimed = make(map[string]bool)
+	)
+
+	for _, rule := range rules {
+		entries, err := matchRetentionRule(ctx, rule, claimed)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+
+		for _, e := range expiredEntries(rule, entries, now) {
+			if protectedByRetention(e.key, rules) {
+				continue
+			}
+
+			if err := deleteRetained(ctx, e.key); err != nil {
+				errs = append(errs, fmt.Errorf("rule %s: delete %s: %w", rule.Name, e.key, err))
+				continue
+			}
+
+			deleted = append(deleted, e.key)
+			retentionDeleted.add(1, "rule", rule.Name)
+			log.Printf("retention: rule %s deleted %s (modified %s)", rule.Name, e.key, e.modTime.UTC().Format(time.RFC3339))
+		}
+	}
+
+	err := errors.Join(errs...)
+
+	result := "success"
+	if err != nil {
+		result = "error"
+		log.Printf("retention: %v", err)
+	}
+
+	retentionRuns.add(1, "result", result)
+	retentionLastRun.set(float64(time.Now().Unix()))
+	retentionLastDuration.set(time.Since(start).Seconds())
+	log.Printf("retention: run finished in %s, %d entries deleted", time.Since(start).Round(time.Millisecond), len(deleted))
+
+	return deleted, err
+}
+
+// matchRetentionRule walks below the rule prefix as deep as the pattern
+// reaches and returns the entries it matches that no earlier rule claimed.
+func matchRetentionRule(ctx context.Context, rule retentionRule, claimed map[string]bool) ([]retentionEntry, error) {
+	depth := strings.Count(rule.Pattern, "/") + 1
+
+	var entries []retentionEntry
+
+	err := fs.WalkDir(storeTreeFS{ctx: ctx, root: rule.Prefix}, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+
+			return err
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		level := strings.Count(name, "/") + 1
+
+		if ok, _ := path.Match(rule.Pattern, name); ok && level == depth {
+			key := joinKey(rule.Prefix, name)
+			if !claimed[key] {
+				claimed[key] = true
+
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+
+				modTime := info.ModTime()
+				if info.IsDir() && modTime.IsZero() {
+					if modTime, err = newestModTime(ctx, key); err != nil {
+						return err
+					}
+				}
+
+				entries = append(entries, retentionEntry{key: key, parent: path.Dir(key), modTime: modTime})
+			}
+		}
+
+		if d.IsDir() && level >= depth {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+// newestModTime judges a directory of a backend that keeps no mtime for
+// it (an object store) by the newest file below it.
+func newestModTime(ctx context.Context, key string) (time.Time, error) {
+	var newest time.Time
+
+	err := fs.WalkDir(storeTreeFS{ctx: ctx, root: key}, ".", func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+
+		return err
+	})
+
+	return newest, err
+}
+
+// expiredEntries applies max_age and max_count (per parent directory,
+// newest first) to the matched entries.
+func expiredEntries(rule retentionRule, entries []retentionEntry, now time.Time) []retentionEntry {
+	if rule.keepsForever() {
+		return nil
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].modTime.After(entries[j].modTime) })
+
+	var (
+		expired []retentionEntry
+		kept    = make(map[string]int)
+	)
+
+	for _, e := range entries {
+		tooOld := rule.maxAge > 0 && now.Sub(e.modTime) > rule.maxAge
+		tooMany := rule.MaxCount > 0 && kept[e.parent] >= rule.MaxCount
+
+		if tooOld || tooMany {
+			expired = append(expired, e)
+			continue
+		}
+
+		kept[e.parent]++
+	}
+
+	return expired
+}
+
+// protectedByRetention reports whether deleting key would take a
+// keep-forever prefix with it.
+func protectedByRetention(key string, rules []retentionRule) bool {
+	for _, r := range rules {
+		if r.keepsForever() && keyWithin(r.Prefix, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deleteRetained deletes under the key lock, so a publish of the same key
+// is never cut in half.
+func deleteRetained(ctx context.Context, key string) error {
+	unlock := lockKey(key)
+	defer unlock()
+
+	return deleteKey(ctx, key)
+}
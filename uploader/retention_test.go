@@ -0,0 +1,190 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ageEntries backdates stored paths (dirs included) by the given ages.
+func ageEntries(t *testing.T, root string, ages map[string]time.Duration) {
+	t.Helper()
+
+	now := time.Now()
+	for name, age := range ages {
+		require.NoError(t, os.Chtimes(filepath.Join(root, name), now.Add(-age), now.Add(-age)))
+	}
+}
+
+func retentionRules(t *testing.T, doc string) []retentionRule {
+	t.Helper()
+
+	cfg, err := parseRetentionConfig([]byte(doc))
+	require.NoError(t, err)
+
+	return cfg.Rules
+}
+
+func sorted(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	putEntries(t, e, "builds/app/1", "builds/app/2", "builds/lib/1")
+	ageEntries(t, tempdir, map[string]time.Duration{
+		"builds/app/1": 10 * 24 * time.Hour,
+		"builds/app/2": time.Hour,
+		"builds/lib/1": 8 * 24 * time.Hour,
+	})
+
+	rules := retentionRules(t, `
+rules:
+  - prefix: builds
+    pattern: "*/*"
+    max_age: 7d
+`)
+
+	deleted, err := applyRetention(context.Background(), rules, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"builds/app/1", "builds/lib/1"}, sorted(deleted))
+
+	_, err = os.Stat(filepath.Join(tempdir, "builds", "app", "2", "blob"))
+	assert.NoError(t, err)
+}
+
+func TestRetentionMaxCountPerDirectory(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	putEntries(t, e, "builds/app/1", "builds/app/2", "builds/app/3", "builds/lib/1")
+	ageEntries(t, tempdir, map[string]time.Duration{
+		"builds/app/1": 3 * time.Hour,
+		"builds/app/2": 2 * time.Hour,
+		"builds/app/3": time.Hour,
+		"builds/lib/1": 4 * time.Hour,
+	})
+
+	rules := retentionRules(t, `
+rules:
+  - name: keep-two
+    prefix: builds
+    pattern: "*/*"
+    max_count: 2
+`)
+
+	before := retentionDeleted.get("rule", "keep-two")
+
+	deleted, err := applyRetention(context.Background(), rules, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"builds/app/1"}, deleted, "each directory keeps its newest two")
+	assert.Equal(t, before+1, retentionDeleted.get("rule", "keep-two"))
+}
+
+func TestRetentionKeepsForeverPrefixes(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	putEntries(t, e, "releases/v1", "tmp/x")
+	ageEntries(t, tempdir, map[string]time.Duration{
+		"releases": 30 * 24 * time.Hour,
+		"tmp":      30 * 24 * time.Hour,
+	})
+
+	rules := retentionRules(t, `
+rules:
+  - prefix: releases/v1
+  - pattern: "*"
+    max_age: 1d
+`)
+
+	deleted, err := applyRetention(context.Background(), rules, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tmp"}, deleted, "releases holds a keep-forever prefix")
+
+	_, err = os.Stat(filepath.Join(tempdir, "releases", "v1", "blob"))
+	assert.NoError(t, err)
+}
+
+func TestParseRetentionConfig(t *testing.T) {
+	cfg, err := parseRetentionConfig([]byte(`
+interval: 15m
+rules:
+  - prefix: /builds/
+    max_age: 36h
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, cfg.interval)
+	require.Len(t, cfg.Rules, 1)
+	assert.Equal(t, "builds", cfg.Rules[0].Prefix)
+	assert.Equal(t, "*", cfg.Rules[0].Pattern)
+	assert.Equal(t, "builds/*", cfg.Rules[0].Name)
+	assert.Equal(t, 36*time.Hour, cfg.Rules[0].maxAge)
+
+	cfg, err = parseRetentionConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRetentionInterval, cfg.interval)
+
+	for _, doc := range []string{
+		"rules:\n  - prefix: ../up\n",
+		"rules:\n  - prefix: " + stagingDir + "\n",
+		"rules:\n  - pattern: \"[\"\n",
+		"rules:\n  - max_age: soon\n",
+		"rules:\n  - max_count: -1\n",
+		"rules:\n  - max_size: 1\n",
+		"interval: 0s\n",
+	} {
+		_, err := parseRetentionConfig([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestRetentionMetricsExposed(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{retention: retentionConfig{Rules: retentionRules(t, "rules: [{max_age: 1d}]")}})
+
+	_, err := applyRetention(context.Background(), nil, time.Now())
+	require.NoError(t, err)
+
+	rec := getWithHeaders(e, http.MethodGet, metricsPath, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "# TYPE krci_cache_retention_runs_total counter\n")
+	assert.Contains(t, rec.Body.String(), `krci_cache_retention_runs_total{result="success"} `)
+	assert.Contains(t, rec.Body.String(), "krci_cache_retention_last_run_timestamp_seconds ")
+}
+
+func TestMetricsDoNotShadowStoredKeys(t *testing.T) {
+	e, _ := concurrencyServer(t)
+
+	rec := getWithHeaders(e, http.MethodGet, metricsPath, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "no retention rules, no metrics")
+
+	e, _ = configuredServer(t, serverConfig{retention: retentionConfig{Rules: retentionRules(t, "rules: [{max_age: 1d}]")}})
+
+	rec = rawPut(e, "/metrics", []byte("a stored file"), nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = getWithHeaders(e, http.MethodGet, "/metrics", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "a stored file", rec.Body.String())
+}
+
+func TestMetricsNeedReadCredentials(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{
+		credentials: "ci:secret",
+		readAuth:    readAuthConfig{required: true},
+		retention:   retentionConfig{Rules: retentionRules(t, "rules: [{max_age: 1d}]")},
+	})
+
+	rec := getWithHeaders(e, http.MethodGet, metricsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = getWithHeaders(e, http.MethodGet, metricsPath, map[string]string{"Authorization": basicAuth("ci", "secret")})
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,324 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeS3Bucket = "cache"
+	fakeS3Key    = "AKIDEXAMPLE"
+	fakeS3Secret = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	fakeS3Region = "eu-central-1"
+)
+
+// fakeS3 is an in-process, path-style S3 stand-in covering the calls
+// s3Storage makes. It verifies request signatures from the wire so URL
+// escaping bugs surface here rather than against a real bucket.
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string]fakeS3Object
+	uploads  map[string]map[int][]byte
+	nextID   int
+	pageSize int
+	// listCalls counts list requests, so tests can bound how much a
+	// listing costs.
+	listCalls int
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+
+	f := &fakeS3{
+		t:        t,
+		objects:  make(map[string]fakeS3Object),
+		uploads:  make(map[string]map[int][]byte),
+		pageSize: 1000,
+	}
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, srv
+}
+
+func newFakeS3Storage(t *testing.T, partSize int64) (*fakeS3, *s3Storage) {
+	t.Helper()
+
+	f, srv := newFakeS3(t)
+
+	s, err := newS3Storage(s3Config{
+		endpoint:  srv.URL,
+		bucket:    fakeS3Bucket,
+		region:    fakeS3Region,
+		pathStyle: true,
+		partSize:  partSize,
+		creds:     s3Credentials{accessKeyID: fakeS3Key, secretAccessKey: fakeS3Secret},
+	})
+	require.NoError(t, err)
+
+	return f, s
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if msg := f.verifySignature(r, body); msg != "" {
+		f.t.Errorf("fake s3: %s %s: %s", r.Method, r.URL, msg)
+		writeFakeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		f.uploadPart(w, q, body)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.complete(w, key, q.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = fakeS3Object{data: body, modTime: time.Now().UTC().Truncate(time.Second)}
+		w.Header().Set("ETag", fakeETag(body))
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", fakeETag(obj.data))
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, q map[string][]string, body []byte) {
+	parts, ok := f.uploads[first(q["uploadId"])]
+	if !ok {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	n, _ := strconv.Atoi(first(q["partNumber"]))
+	parts[n] = body
+	w.Header().Set("ETag", fakeETag(body))
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, id string, body []byte) {
+	parts, ok := f.uploads[id]
+	if !ok {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var req s3CompleteRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeFakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var data []byte
+
+	for i, p := range req.Parts {
+		chunk, ok := parts[p.PartNumber]
+		if !ok || p.ETag != fakeETag(chunk) {
+			writeFakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+
+		if i < len(req.Parts)-1 && len(chunk) < minS3PartSize {
+			writeFakeS3Error(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+
+		data = append(data, chunk...)
+	}
+
+	delete(f.uploads, id)
+	f.objects[key] = fakeS3Object{data: data, modTime: time.Now().UTC().Truncate(time.Second)}
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+}
+
+// list pages through keys and, with a delimiter, the common prefixes that
+// roll up everything below them, in one lexicographic sequence as S3 does.
+func (f *fakeS3) list(w http.ResponseWriter, q map[string][]string) {
+	prefix := first(q["prefix"])
+	delimiter := first(q["delimiter"])
+	after := first(q["continuation-token"])
+
+	pageSize := f.pageSize
+	if n, err := strconv.Atoi(first(q["max-keys"])); err == nil && n < pageSize {
+		pageSize = n
+	}
+
+	f.listCalls++
+
+	seen := make(map[string]bool)
+	items := make([]string, 0, len(f.objects))
+
+	for k := range f.objects {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+
+		item := k
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			item = prefix + rest[:i+len(delimiter)]
+		}
+
+		if item > after && !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+
+	sort.Strings(items)
+
+	var res s3ListResult
+
+	if len(items) > pageSize {
+		items = items[:pageSize]
+		res.IsTruncated = true
+		res.NextContinuationToken = items[len(items)-1]
+	}
+
+	for _, k := range items {
+		obj, ok := f.objects[k]
+		if !ok {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: k})
+			continue
+		}
+
+		res.Contents = append(res.Contents, s3ObjectEntry{Key: k, LastModified: obj.modTime, Size: int64(len(obj.data)), ETag: fakeETag(obj.data)})
+	}
+
+	out, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: res})
+	_, _ = w.Write(out)
+}
+
+// verifySignature recomputes the SigV4 signature server-side from the
+// headers named in SignedHeaders, exactly as S3 does.
+func (f *fakeS3) verifySignature(r *http.Request, body []byte) string {
+	auth := r.Header.Get("Authorization")
+
+	fields := map[string]string{}
+
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, s3SignAlgorithm+" "), ", ") {
+		k, v, _ := strings.Cut(kv, "=")
+		fields[k] = v
+	}
+
+	if !strings.HasPrefix(fields["Credential"], fakeS3Key+"/") {
+		return "bad credential " + fields["Credential"]
+	}
+
+	sum := sha256.Sum256(body)
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(sum[:]) {
+		return "payload hash mismatch"
+	}
+
+	var headers strings.Builder
+
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method, r.URL.EscapedPath(), canonicalQuery(r.URL.Query()),
+		headers.String(), fields["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	scope := amzDate[:8] + "/" + fakeS3Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonical))
+	toSign := s3SignAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+fakeS3Secret), amzDate[:8])
+	for _, part := range []string{fakeS3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	want := hex.EncodeToString(hmacSHA256(key, toSign))
+	if !hmac.Equal([]byte(want), []byte(fields["Signature"])) {
+		return "signature mismatch"
+	}
+
+	return ""
+}
+
+func fakeETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func first(v []string) string {
+	if len(v) == 0 {
+		return ""
+	}
+
+	return v[0]
+}
@@ -0,0 +1,102 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serveStoredFile streams the object at key with Range/conditional support
+// from http.ServeContent, validated by the recorded digest when there is
+// one. Directories are reported as missing so protocol endpoints never
+// expose listings.
+func serveStoredFile(c echo.Context, key string) error {
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return err
+	}
+
+	obj, err := store.Open(c.Request().Context(), key)
+	if err != nil {
+		return storageHTTPError(err)
+	}
+
+	defer func() {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing %s: %v", key, closeErr)
+		}
+	}()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return storageHTTPError(err)
+	}
+
+	if info.IsDir() {
+		return echo.ErrNotFound
+	}
+
+	setDigestHeaders(c.Response().Header(), lookupDigest(c.Request().Context(), key, info))
+	recordAccess(key)
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), obj)
+
+	return nil
+}
+
+// statStoredFile answers HEAD for protocol endpoints: 200 with the size for
+// regular files, 404 otherwise.
+func statStoredFile(c echo.Context, key string) error {
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return err
+	}
+
+	info, err := store.Stat(c.Request().Context(), key)
+	if err != nil {
+		return storageHTTPError(err)
+	}
+
+	if info.IsDir() {
+		return echo.ErrNotFound
+	}
+
+	c.Response().Header().Set(echo.HeaderContentLength, fmt.Sprint(info.Size()))
+	c.Response().Header().Set(echo.HeaderLastModified, info.ModTime().UTC().Format(http.TimeFormat))
+	setDigestHeaders(c.Response().Header(), lookupDigest(c.Request().Context(), key, info))
+
+	return c.NoContent(http.StatusOK)
+}
+
+// publishHTTPError keeps the status of a refused publish (immutable path,
+// failed precondition) and reports anything else as a server error.
+func publishHTTPError(err error) error {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+
+	return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("publish: %s", err))
+}
+
+func storageHTTPError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return echo.ErrNotFound
+	}
+
+	return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("storage error: %s", err))
+}
+
+// removeStaged discards a temp file left behind by a failed or rejected
+// upload; a no-op once the file has been published.
+func removeStaged(tmp string) {
+	if tmp == "" {
+		return
+	}
+
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove staged file %s: %v", tmp, err)
+	}
+}
@@ -0,0 +1,480 @@
+package uploader
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipeline pods can authenticate with their projected ServiceAccount
+// token instead of a password. Tokens are JWTs checked offline against the
+// cluster's signing keys, from the JWKS file named by UPLOADER_SA_JWKS_FILE
+// or the OIDC discovery document of UPLOADER_SA_ISSUER, and must carry the
+// audience UPLOADER_SA_AUDIENCE. The caller is named after the token
+// subject, system:serviceaccount:<namespace>:<name>, and is confined to
+// the UPLOADER_SA_PREFIXES templates, "{namespace}" by default.
+const (
+	saSubjectPrefix     = "system:serviceaccount:"
+	defaultSAPrefix     = "{namespace}"
+	jwksRefreshInterval = time.Minute
+	jwtLeeway           = 30 * time.Second
+	oidcDiscoveryPath   = "/.well-known/openid-configuration"
+	inClusterCAFile     = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	maxJWKSSize         = 1 << 20
+)
+
+// Kubernetes names, which end up in paths: namespaces are DNS labels,
+// service accounts DNS subdomains.
+var (
+	saNamespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	saNamePattern      = regexp.MustCompile(`^[a-z0-9]([-.a-z0-9]*[a-z0-9])?$`)
+)
+
+type serviceAccountAuth struct {
+	audience string
+	issuer   string
+	prefixes []string
+	scopes   authScope
+	keys     *jwksCache
+}
+
+func loadServiceAccountAuth() (*serviceAccountAuth, error) {
+	audience := os.Getenv("UPLOADER_SA_AUDIENCE")
+	if audience == "" {
+		return nil, nil
+	}
+
+	sa := &serviceAccountAuth{audience: audience, issuer: os.Getenv("UPLOADER_SA_ISSUER")}
+
+	templates := []string{defaultSAPrefix}
+	if v := os.Getenv("UPLOADER_SA_PREFIXES"); v != "" {
+		templates = strings.Split(v, ",")
+	}
+
+	for _, raw := range templates {
+		raw = strings.TrimSpace(raw)
+
+		// Placeholders expand to validated names, so checking the
+		// template with a stand-in checks every expansion.
+		stand := strings.NewReplacer("{namespace}", "ns", "{serviceaccount}", "sa").Replace(raw)
+		if strings.ContainsAny(stand, "{}") {
+			return nil, fmt.Errorf("invalid UPLOADER_SA_PREFIXES entry %q: unknown placeholder", raw)
+		}
+
+		if _, err := parsePrefixes([]string{stand}); err != nil {
+			return nil, fmt.Errorf("invalid UPLOADER_SA_PREFIXES entry %q: %w", raw, err)
+		}
+
+		sa.prefixes = append(sa.prefixes, raw)
+	}
+
+	var scopes []string
+	if v := os.Getenv("UPLOADER_SA_SCOPES"); v != "" {
+		scopes = strings.Split(v, ",")
+	}
+
+	s, err := parseScopes(scopes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPLOADER_SA_SCOPES %q: %w", os.Getenv("UPLOADER_SA_SCOPES"), err)
+	}
+
+	sa.scopes = s
+
+	switch jwksFile := os.Getenv("UPLOADER_SA_JWKS_FILE"); {
+	case jwksFile != "":
+		sa.keys = &jwksCache{fetch: func() ([]byte, error) { return os.ReadFile(jwksFile) }}
+	case sa.issuer != "":
+		client, err := discoveryClient()
+		if err != nil {
+			return nil, err
+		}
+
+		sa.keys = &jwksCache{fetch: func() ([]byte, error) { return discoverJWKS(client, sa.issuer) }}
+	default:
+		return nil, errors.New("UPLOADER_SA_AUDIENCE requires UPLOADER_SA_JWKS_FILE or UPLOADER_SA_ISSUER")
+	}
+
+	if err := sa.keys.refresh(); err != nil {
+		return nil, fmt.Errorf("service account keys: %w", err)
+	}
+
+	return sa, nil
+}
+
+// discoveryClient trusts the cluster CA when running in a pod, where the
+// issuer is usually the API server.
+func discoveryClient() (*http.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if pem, err := os.ReadFile(inClusterCAFile); err == nil && !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates", inClusterCAFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, nil
+}
+
+func discoverJWKS(client *http.Client, issuer string) ([]byte, error) {
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+
+	data, err := fetchJSON(client, strings.TrimSuffix(issuer, "/")+oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("discovery document: %w", err)
+	}
+
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, issuer)
+	}
+
+	if doc.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	return fetchJSON(client, doc.JWKSURI)
+}
+
+func fetchJSON(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// signingKey is a verification key and the JWT algorithm it serves.
+type signingKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// parseJWKS keeps the keys a Kubernetes issuer signs with, RS256 and
+// ES256, and skips the rest.
+func parseJWKS(data []byte) ([]signingKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	var keys []signingKey
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var (
+			sk  = signingKey{kid: k.Kid}
+			err error
+		)
+
+		switch {
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			sk.alg = "RS256"
+			sk.key, err = k.rsaKey()
+		case k.Kty == "EC" && k.Crv == "P-256" && (k.Alg == "" || k.Alg == "ES256"):
+			sk.alg = "ES256"
+			sk.key, err = k.ecKey()
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: %w", k.Kid, err)
+		}
+
+		keys = append(keys, sk)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no RS256 or ES256 signing keys")
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := new(big.Int).SetBytes(e)
+	if len(n) < 256 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported RSA key")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+func (k jsonWebKey) ecKey() (*ecdsa.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("P-256 coordinates must be 32 bytes")
+	}
+
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+}
+
+// jwksCache holds the issuer's keys. A token signed with a key it does not
+// know triggers a refetch, rate limited, so rotated keys are picked up
+// without a restart and garbage tokens cannot hammer the issuer.
+type jwksCache struct {
+	fetch func() ([]byte, error)
+
+	mu      sync.Mutex
+	keys    []signingKey
+	fetched time.Time
+}
+
+func (c *jwksCache) refresh() error {
+	data, err := c.fetch()
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	c.keys = keys
+
+	return nil
+}
+
+func (c *jwksCache) find(kid, alg string) []signingKey {
+	var out []signingKey
+
+	for _, k := range c.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			out = append(out, k)
+		}
+	}
+
+	return out
+}
+
+func (c *jwksCache) lookup(kid, alg string) []signingKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if keys := c.find(kid, alg); len(keys) > 0 {
+		return keys
+	}
+
+	if time.Since(c.fetched) < jwksRefreshInterval {
+		return nil
+	}
+
+	c.fetched = time.Now()
+
+	if err := c.refresh(); err != nil {
+		log.Printf("service account keys not refreshed: %v", err)
+		return nil
+	}
+
+	return c.find(kid, alg)
+}
+
+// jwtAudience is the aud claim, a string or a list of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+type serviceAccountClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	Expiry    int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+}
+
+// isJWT tells a JWT from an opaque token before any parsing.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify checks token and returns the service account it stands for, or
+// an error saying why it does not.
+func (sa *serviceAccountAuth) verify(token string, now time.Time) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	if !sa.checkSignature(header.Kid, header.Alg, parts[0]+"."+parts[1], sig) {
+		return nil, errors.New("signature does not verify")
+	}
+
+	var claims serviceAccountClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+
+	if sa.issuer != "" && claims.Issuer != sa.issuer {
+		return nil, fmt.Errorf("issuer %q", claims.Issuer)
+	}
+
+	found := false
+
+	for _, aud := range claims.Audience {
+		found = found || aud == sa.audience
+	}
+
+	if !found {
+		return nil, fmt.Errorf("audience %q", claims.Audience)
+	}
+
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(jwtLeeway)) {
+		return nil, errors.New("expired")
+	}
+
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("not valid yet")
+	}
+
+	return sa.principalFor(claims.Subject)
+}
+
+// principalFor is the principal a service account token with the given
+// subject authenticates as.
+func (sa *serviceAccountAuth) principalFor(subject string) (*principal, error) {
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(subject, saSubjectPrefix), ":")
+	if !strings.HasPrefix(subject, saSubjectPrefix) || !ok ||
+		!saNamespacePattern.MatchString(namespace) || !saNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("subject %q is not a service account", subject)
+	}
+
+	expand := strings.NewReplacer("{namespace}", namespace, "{serviceaccount}", name)
+	prefixes := make([]string, 0, len(sa.prefixes))
+
+	for _, t := range sa.prefixes {
+		prefixes = append(prefixes, expand.Replace(t))
+	}
+
+	p, err := parsePrefixes(prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal{name: subject, scopes: sa.scopes, prefixes: p}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (sa *serviceAccountAuth) checkSignature(kid, alg, signed string, sig []byte) bool {
+	if alg != "RS256" && alg != "ES256" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(signed))
+
+	for _, k := range sa.keys.lookup(kid, alg) {
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if len(sig) == 64 && ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
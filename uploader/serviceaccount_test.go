@@ -0,0 +1,323 @@
+package uploader
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSAAudience = "krci-cache"
+	testSAIssuer   = "https://kubernetes.default.svc.cluster.local"
+)
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+// testJWK is a locally generated signing key, the way a cluster's
+// service account issuer holds one.
+type testJWK struct {
+	kid string
+	key crypto.Signer
+}
+
+func newRSAJWK(t *testing.T, kid string) testJWK {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	return testJWK{kid: kid, key: key}
+}
+
+func newECJWK(t *testing.T, kid string) testJWK {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return testJWK{kid: kid, key: key}
+}
+
+func (k testJWK) public() map[string]string {
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		return map[string]string{"kty": "RSA", "kid": k.kid, "use": "sig", "alg": "RS256",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		return map[string]string{"kty": "EC", "kid": k.kid, "use": "sig", "alg": "ES256", "crv": "P-256",
+			"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+	}
+
+	return nil
+}
+
+func jwks(t *testing.T, keys ...testJWK) []byte {
+	t.Helper()
+
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.public())
+	}
+
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	return data
+}
+
+func (k testJWK) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	alg := "RS256"
+	if _, ok := k.key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": k.kid, "typ": "JWT"})
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		require.NoError(t, err)
+
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+// saClaims are the claims of a projected token for namespace/name.
+func saClaims(namespace, name string) map[string]interface{} {
+	now := time.Now()
+
+	return map[string]interface{}{
+		"iss": testSAIssuer,
+		"sub": saSubjectPrefix + namespace + ":" + name,
+		"aud": []string{testSAAudience},
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+		"kubernetes.io": map[string]interface{}{
+			"namespace":      namespace,
+			"serviceaccount": map[string]string{"name": name},
+		},
+	}
+}
+
+func withClaim(claims map[string]interface{}, key string, v interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(claims))
+	for k, c := range claims {
+		out[k] = c
+	}
+
+	out[key] = v
+
+	return out
+}
+
+func jwksFileServer(t *testing.T, keys ...testJWK) *echo.Echo {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(p, jwks(t, keys...), 0o600))
+
+	t.Setenv("UPLOADER_SA_AUDIENCE", testSAAudience)
+	t.Setenv("UPLOADER_SA_ISSUER", testSAIssuer)
+	t.Setenv("UPLOADER_SA_JWKS_FILE", p)
+
+	sa, err := loadServiceAccountAuth()
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{serviceAccounts: sa})
+
+	return e
+}
+
+func TestServiceAccountTokenFromJWKSFile(t *testing.T) {
+	key := newRSAJWK(t, "k1")
+	e := jwksFileServer(t, key)
+
+	token := key.sign(t, saClaims("team-a", "builder"))
+
+	rec := rawPut(e, "/team-a/app.tar", []byte("a"), bearer(token))
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, "/team-b/app.tar", []byte("a"), bearer(token))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "system:serviceaccount:team-a:builder may not access /team-b/app.tar")
+
+	other := newRSAJWK(t, "k1")
+	claims := saClaims("team-a", "builder")
+	parts := strings.Split(token, ".")
+	forged := strings.Split(key.sign(t, saClaims("team-b", "builder")), ".")
+
+	for name, bad := range map[string]string{
+		"audience":      key.sign(t, withClaim(claims, "aud", "kubernetes")),
+		"issuer":        key.sign(t, withClaim(claims, "iss", "https://elsewhere")),
+		"expired":       key.sign(t, withClaim(claims, "exp", time.Now().Add(-time.Hour).Unix())),
+		"not yet valid": key.sign(t, withClaim(claims, "nbf", time.Now().Add(time.Hour).Unix())),
+		"subject":       key.sign(t, withClaim(claims, "sub", "system:node:worker-1")),
+		"namespace":     key.sign(t, withClaim(claims, "sub", saSubjectPrefix+"../x:builder")),
+		"foreign key":   other.sign(t, claims),
+		"swapped":       parts[0] + "." + forged[1] + "." + parts[2],
+		"unsigned":      b64([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".",
+	} {
+		rec = rawPut(e, "/team-a/app.tar", []byte("a"), bearer(bad))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, name)
+	}
+}
+
+func TestServiceAccountTokenFromDiscovery(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		keys  = []testJWK{newECJWK(t, "k1")}
+		srv   *httptest.Server
+		jwksN int
+	)
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case oidcDiscoveryPath:
+			_ = json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/openid/v1/jwks"})
+		case "/openid/v1/jwks":
+			jwksN++
+			_, _ = w.Write(jwks(t, keys...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("UPLOADER_SA_AUDIENCE", testSAAudience)
+	t.Setenv("UPLOADER_SA_ISSUER", srv.URL)
+	t.Setenv("UPLOADER_SA_PREFIXES", "ci/{namespace}/{serviceaccount}, shared")
+	t.Setenv("UPLOADER_SA_SCOPES", "read,write")
+
+	sa, err := loadServiceAccountAuth()
+	require.NoError(t, err)
+
+	e, _ := configuredServer(t, serverConfig{serviceAccounts: sa})
+
+	claims := withClaim(saClaims("team-a", "builder"), "iss", srv.URL)
+	token := keys[0].sign(t, withClaim(claims, "aud", testSAAudience))
+
+	for _, key := range []string{"/ci/team-a/builder/x.txt", "/shared/x.txt"} {
+		rec := rawPut(e, key, []byte("x"), bearer(token))
+		assert.Equal(t, http.StatusCreated, rec.Code, key)
+	}
+
+	rec := rawPut(e, "/ci/team-a/deployer/x.txt", []byte("x"), bearer(token))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	req := buildDeleteRequest(t, "/upload", map[string]string{"path": "ci/team-a/builder/x.txt"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "UPLOADER_SA_SCOPES leaves out delete")
+
+	// The issuer rotates its key: the first token signed with the new
+	// one refetches the JWKS, later unknown keys wait for the interval.
+	mu.Lock()
+	keys = append(keys, newECJWK(t, "k2"))
+	rotated := keys[1].sign(t, claims)
+	mu.Unlock()
+
+	rec = rawPut(e, "/ci/team-a/builder/y.txt", []byte("y"), bearer(rotated))
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = rawPut(e, "/ci/team-a/builder/y.txt", []byte("y"), bearer(newECJWK(t, "k3").sign(t, claims)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	mu.Lock()
+	assert.Equal(t, 2, jwksN, "one fetch at startup, one for the rotation")
+	mu.Unlock()
+}
+
+func TestLoadServiceAccountAuth(t *testing.T) {
+	sa, err := loadServiceAccountAuth()
+	require.NoError(t, err)
+	assert.Nil(t, sa)
+
+	t.Setenv("UPLOADER_SA_AUDIENCE", testSAAudience)
+
+	_, err = loadServiceAccountAuth()
+	require.Error(t, err, "keys come from a JWKS file or the issuer")
+
+	p := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(p, jwks(t, newECJWK(t, "k1")), 0o600))
+	t.Setenv("UPLOADER_SA_JWKS_FILE", p)
+
+	sa, err = loadServiceAccountAuth()
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultSAPrefix}, sa.prefixes)
+	assert.Equal(t, allScopes, sa.scopes)
+
+	for env, v := range map[string]string{
+		"UPLOADER_SA_PREFIXES":  "{pod}",
+		"UPLOADER_SA_SCOPES":    "admin",
+		"UPLOADER_SA_JWKS_FILE": filepath.Join(t.TempDir(), "missing.json"),
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, v)
+
+			_, err := loadServiceAccountAuth()
+			assert.Error(t, err, v)
+		})
+	}
+
+	for _, v := range []string{"../{namespace}", stagingDir + "/{namespace}", ""} {
+		t.Setenv("UPLOADER_SA_PREFIXES", v+",")
+
+		_, err = loadServiceAccountAuth()
+		assert.Error(t, err, v)
+	}
+}
+
+func TestParseJWKSRejectsBadKeys(t *testing.T) {
+	for _, doc := range []string{
+		`{"keys":[]}`,
+		`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`,
+		`{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`,
+		`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`not json`,
+	} {
+		_, err := parseJWKS([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
@@ -5,14 +5,14 @@ import (
 	"os"
 )
 
-// Hides the staging dir from static serving and refuses directory opens
-// (so http.FileServer cannot render listings).
+// Hides the staging dir and the digest records from static serving and
+// refuses directory opens (so http.FileServer cannot render listings).
 type hideStagingFS struct {
 	root http.FileSystem
 }
 
 func (fs hideStagingFS) Open(name string) (http.File, error) {
-	if isStagingPath(name) {
+	if isReservedPath(name) {
 		return nil, os.ErrNotExist
 	}
 
@@ -0,0 +1,223 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Storage is the persistence layer behind the HTTP handlers. Keys are
+// slash-separated paths relative to the cache root that have already passed
+// safeJoin; "" addresses the root itself. Missing keys are reported with
+// errors that satisfy errors.Is(err, fs.ErrNotExist).
+//
+// Put is for callers that know the key before the body arrives and can
+// stream straight through, such as plain raw PUT uploads.
+// Uploads that must be extracted or verified, and multipart uploads, whose
+// later parts can still add a digest or turn them into a batch, are
+// spooled into the local staging dir first (streamPartToStagedTemp,
+// streamTarToStageDir) and handed over as a finished file or tree.
+type Storage interface {
+	// Put streams r to key and publishes it atomically: readers see either
+	// the previous object or the complete new one.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// PublishFile consumes a staged temp file and publishes it at key.
+	PublishFile(ctx context.Context, key, staged string) error
+	// PublishDir consumes a staged directory tree and replaces key with it.
+	PublishDir(ctx context.Context, key, stage string) error
+	Open(ctx context.Context, key string) (Object, error)
+	Stat(ctx context.Context, key string) (fs.FileInfo, error)
+	// Delete removes key and, for directories, everything below it.
+	Delete(ctx context.Context, key string) error
+	// RemoveDir removes the directory at key only if nothing is below it
+	// and fails otherwise. Backends whose directories are implied by their
+	// children succeed when there are none.
+	RemoveDir(ctx context.Context, key string) error
+	// List returns the direct children of the directory at key. Backends
+	// whose directories are implied by their children report those with
+	// no size or mtime.
+	List(ctx context.Context, key string) ([]fs.FileInfo, error)
+}
+
+// Object is an open, seekable handle on a stored file.
+type Object interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+const (
+	storageLocal = "local"
+	storageS3    = "s3"
+)
+
+type storageConfig struct {
+	kind string
+	s3   s3Config
+}
+
+func loadStorageConfig() (storageConfig, error) {
+	cfg := storageConfig{kind: storageLocal}
+
+	if v := os.Getenv("UPLOADER_STORAGE"); v != "" {
+		cfg.kind = v
+	}
+
+	switch cfg.kind {
+	case storageLocal:
+		return cfg, nil
+	case storageS3:
+		s3cfg, err := loadS3Config()
+		cfg.s3 = s3cfg
+
+		return cfg, err
+	default:
+		return cfg, fmt.Errorf("invalid UPLOADER_STORAGE %q (want %q or %q)", cfg.kind, storageLocal, storageS3)
+	}
+}
+
+func newStorage(cfg storageConfig) (Storage, error) {
+	if cfg.kind == storageS3 {
+		return newS3Storage(cfg.s3)
+	}
+
+	return localStorage{}, nil
+}
+
+// Backend used by the handlers. The local filesystem is the default;
+// Uploader() and tests swap it via setStorage.
+var store Storage = localStorage{}
+
+func setStorage(s Storage) { store = s }
+
+// safeKey is safeJoin for handlers that address the Storage: same checks,
+// but returns the cleaned slash-separated key instead of an absolute path.
+func safeKey(rel string) (string, error) {
+	abspath, err := safeJoin(rel)
+	if err != nil {
+		return "", err
+	}
+
+	return storageKey(abspath), nil
+}
+
+func storageKey(abspath string) string {
+	rel, err := filepath.Rel(absRootDir, abspath)
+	if err != nil || rel == "." {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func joinKey(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+
+	return parent + "/" + name
+}
+
+// localStorage is the filesystem backend rooted at UPLOADER_DIRECTORY. It
+// reads absRootDir/absStagePath on every call so setUploadDirectory (and the
+// tests that rely on it) keeps working without rebuilding the backend.
+type localStorage struct{}
+
+func localPath(key string) string {
+	return filepath.Join(absRootDir, filepath.FromSlash(key))
+}
+
+func (localStorage) Put(_ context.Context, key string, r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	err := publishFile(localPath(key), cr)
+
+	return cr.n, err
+}
+
+func (localStorage) PublishFile(_ context.Context, key, staged string) error {
+	return publishStaged(staged, localPath(key))
+}
+
+func (localStorage) PublishDir(ctx context.Context, key, stage string) error {
+	return publishDir(ctx, localPath(key), stage)
+}
+
+func (localStorage) Open(_ context.Context, key string) (Object, error) {
+	return os.Open(localPath(key))
+}
+
+func (localStorage) Stat(_ context.Context, key string) (fs.FileInfo, error) {
+	return os.Stat(localPath(key))
+}
+
+func (localStorage) Delete(_ context.Context, key string) error {
+	return os.RemoveAll(localPath(key))
+}
+
+func (localStorage) RemoveDir(_ context.Context, key string) error {
+	return os.Remove(localPath(key))
+}
+
+func (localStorage) List(_ context.Context, key string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(localPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+
+	for _, e := range entries {
+		// The staging dir is an implementation detail of this backend; hide
+		// it so a misconfigured cron (path="", recursive=true, days=0) can't
+		// wipe in-flight uploads. The digest records are hidden likewise.
+		if key == "" && (e.Name() == stagingDir || e.Name() == metaDir) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// storageFS adapts a Storage to http.FileSystem so http.FileServer can serve
+// any backend. Wrap it in hideStagingFS to keep directory opens refused.
+type storageFS struct {
+	s Storage
+}
+
+func (sfs storageFS) Open(name string) (http.File, error) {
+	key := strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	obj, err := sfs.s.Open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	// *os.File already is an http.File; keeping it unwrapped preserves the
+	// sendfile fast path in net/http.
+	if f, ok := obj.(http.File); ok {
+		return f, nil
+	}
+
+	return objectFile{obj}, nil
+}
+
+type objectFile struct {
+	Object
+}
+
+func (objectFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errors.New("directory listing not supported")
+}
@@ -0,0 +1,240 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memStorage is an in-memory Storage for handler tests that should not
+// depend on rename semantics of the host filesystem. Directories are
+// implied by key prefixes, as in an object store.
+type memStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string]memObject)}
+}
+
+func (m *memStorage) Put(_ context.Context, key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	m.mu.Lock()
+	m.objects[key] = memObject{data: data, modTime: time.Now()}
+	m.mu.Unlock()
+
+	return int64(len(data)), nil
+}
+
+func (m *memStorage) PublishFile(ctx context.Context, key, staged string) error {
+	data, err := os.ReadFile(staged)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	return os.Remove(staged)
+}
+
+func (m *memStorage) PublishDir(_ context.Context, key, stage string) error {
+	next := make(map[string]memObject)
+
+	err := filepath.WalkDir(stage, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(stage, p)
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		next[joinKey(key, filepath.ToSlash(rel))] = memObject{data: data, modTime: time.Now()}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.deleteLocked(key)
+
+	for k, v := range next {
+		m.objects[k] = v
+	}
+	m.mu.Unlock()
+
+	return os.RemoveAll(stage)
+}
+
+func (m *memStorage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := m.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	obj := m.objects[key]
+	m.mu.RUnlock()
+
+	return &memReader{Reader: bytes.NewReader(obj.data), info: info}, nil
+}
+
+func (m *memStorage) Stat(_ context.Context, key string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if obj, ok := m.objects[key]; ok {
+		return memInfo{name: path.Base(key), size: int64(len(obj.data)), modTime: obj.modTime}, nil
+	}
+
+	prefix := key + "/"
+
+	for k, obj := range m.objects {
+		if key == "" || strings.HasPrefix(k, prefix) {
+			return memInfo{name: path.Base(key), modTime: obj.modTime, dir: true}, nil
+		}
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+}
+
+func (m *memStorage) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	m.deleteLocked(key)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *memStorage) RemoveDir(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k := range m.objects {
+		if key == "" || strings.HasPrefix(k, key+"/") {
+			return &fs.PathError{Op: "rmdir", Path: key, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	return nil
+}
+
+func (m *memStorage) deleteLocked(key string) {
+	delete(m.objects, key)
+
+	for k := range m.objects {
+		if key == "" || strings.HasPrefix(k, key+"/") {
+			delete(m.objects, k)
+		}
+	}
+}
+
+func (m *memStorage) List(ctx context.Context, key string) ([]fs.FileInfo, error) {
+	if _, err := m.Stat(ctx, key); err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]fs.FileInfo)
+
+	for k, obj := range m.objects {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+
+		child, _, nested := strings.Cut(rest, "/")
+		if key == "" && child == metaDir {
+			continue
+		}
+
+		if nested {
+			seen[child] = memInfo{name: child, modTime: obj.modTime, dir: true}
+		} else {
+			seen[rest] = memInfo{name: rest, size: int64(len(obj.data)), modTime: obj.modTime}
+		}
+	}
+
+	infos := make([]fs.FileInfo, 0, len(seen))
+	for _, info := range seen {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+// touch backdates an object so age-based handlers can be exercised.
+func (m *memStorage) touch(key string, t time.Time) {
+	m.mu.Lock()
+	obj := m.objects[key]
+	obj.modTime = t
+	m.objects[key] = obj
+	m.mu.Unlock()
+}
+
+type memReader struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (r *memReader) Close() error               { return nil }
+func (r *memReader) Stat() (fs.FileInfo, error) { return r.info, nil }
+
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+
+	return 0o644
+}
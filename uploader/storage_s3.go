@@ -0,0 +1,780 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 16 << 20
+	// S3 rejects non-final multipart parts smaller than 5 MiB.
+	minS3PartSize = 5 << 20
+)
+
+type s3Config struct {
+	endpoint  string
+	bucket    string
+	region    string
+	prefix    string
+	pathStyle bool
+	partSize  int64
+	creds     s3Credentials
+}
+
+// s3Storage stores the cache in an S3-compatible bucket (AWS S3, MinIO,
+// Ceph RGW). Bodies are streamed as multipart uploads, one part buffered in
+// memory at a time, so memory use is bounded by partSize regardless of
+// artifact size.
+//
+// Object stores have no rename, so PublishDir is not atomic here: new
+// entries are uploaded first and stale ones deleted afterwards, and a
+// reader racing a publish may briefly see a mix of both trees.
+type s3Storage struct {
+	cfg    s3Config
+	base   *url.URL
+	client *http.Client
+}
+
+func newS3Storage(cfg s3Config) (*s3Storage, error) {
+	if cfg.bucket == "" {
+		return nil, errors.New("UPLOADER_S3_BUCKET is required when UPLOADER_STORAGE=s3")
+	}
+
+	if cfg.region == "" {
+		cfg.region = defaultS3Region
+	}
+
+	if cfg.endpoint == "" {
+		cfg.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.region)
+	}
+
+	if cfg.partSize == 0 {
+		cfg.partSize = defaultS3PartSize
+	}
+
+	if cfg.partSize < minS3PartSize {
+		return nil, fmt.Errorf("UPLOADER_S3_PART_SIZE must be at least %d bytes", minS3PartSize)
+	}
+
+	base, err := url.Parse(cfg.endpoint)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid UPLOADER_S3_ENDPOINT %q", cfg.endpoint)
+	}
+
+	cfg.prefix = strings.Trim(cfg.prefix, "/")
+
+	return &s3Storage{cfg: cfg, base: base, client: &http.Client{}}, nil
+}
+
+func (s *s3Storage) objectKey(key string) string {
+	if s.cfg.prefix == "" || key == "" {
+		return firstNonEmpty(key, s.cfg.prefix)
+	}
+
+	return joinKey(s.cfg.prefix, key)
+}
+
+// dirPrefix is the object-key prefix under which the children of key live.
+func (s *s3Storage) dirPrefix(key string) string {
+	if k := s.objectKey(key); k != "" {
+		return k + "/"
+	}
+
+	return ""
+}
+
+func (s *s3Storage) objectURL(objectKey string, query url.Values) *url.URL {
+	u := *s.base
+	basePath := strings.TrimSuffix(u.Path, "/")
+
+	var p string
+
+	if s.cfg.pathStyle {
+		p = basePath + "/" + s.cfg.bucket
+	} else {
+		u.Host = s.cfg.bucket + "." + u.Host
+		p = basePath
+	}
+
+	if objectKey != "" {
+		p += "/" + objectKey
+	} else if !s.cfg.pathStyle {
+		p += "/"
+	}
+
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return &u
+}
+
+// do signs and sends a request. body must be nil or fully buffered so its
+// hash can be signed; only the response body is streamed.
+func (s *s3Storage) do(ctx context.Context, method, objectKey string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var rdr io.Reader
+
+	payloadHash := emptyPayloadHash
+
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+		rdr = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(objectKey, query).String(), rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	signV4(req, s.cfg.creds, s.cfg.region, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, objectKey, err)
+	}
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		defer drainClose(resp.Body)
+		return nil, s3ResponseError(method, objectKey, resp)
+	}
+
+	return resp, nil
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func s3ResponseError(method, objectKey string, resp *http.Response) error {
+	var apiErr s3Error
+
+	if resp.Body != nil {
+		_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr)
+	}
+
+	err := fmt.Errorf("s3 %s %s: %s %s %s", method, objectKey, resp.Status, apiErr.Code, apiErr.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+
+	return err
+}
+
+func drainClose(rc io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(rc, 64<<10))
+	_ = rc.Close()
+}
+
+// Put uploads r as a single PutObject when it fits in one part and as a
+// multipart upload otherwise; the object only becomes visible on complete.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	objectKey := s.objectKey(key)
+	buf := make([]byte, s.cfg.partSize)
+
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		resp, putErr := s.do(ctx, http.MethodPut, objectKey, nil, nil, buf[:n])
+		if putErr != nil {
+			return int64(n), putErr
+		}
+
+		drainClose(resp.Body)
+
+		return int64(n), nil
+	}
+
+	if err != nil {
+		return int64(n), fmt.Errorf("read body: %w", err)
+	}
+
+	return s.putMultipart(ctx, objectKey, buf, r)
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// putMultipart uploads first (already filled) and then the rest of r in
+// partSize chunks. Any failure aborts the upload so the bucket is not left
+// holding orphaned parts.
+func (s *s3Storage) putMultipart(ctx context.Context, objectKey string, first []byte, r io.Reader) (int64, error) {
+	resp, err := s.do(ctx, http.MethodPost, objectKey, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var initiated s3InitiateResult
+
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	drainClose(resp.Body)
+
+	if err != nil || initiated.UploadID == "" {
+		return 0, fmt.Errorf("s3 initiate multipart %s: bad response: %v", objectKey, err)
+	}
+
+	uploadID := initiated.UploadID
+	total, parts, err := s.uploadParts(ctx, objectKey, uploadID, first, r)
+
+	if err == nil {
+		err = s.completeMultipart(ctx, objectKey, uploadID, parts)
+	}
+
+	if err != nil {
+		// The request context may be the reason we failed; abort on a
+		// fresh one so the parts are still released.
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if resp, abortErr := s.do(abortCtx, http.MethodDelete, objectKey, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr == nil {
+			drainClose(resp.Body)
+		}
+
+		return total, err
+	}
+
+	return total, nil
+}
+
+func (s *s3Storage) uploadParts(ctx context.Context, objectKey, uploadID string, buf []byte, r io.Reader) (int64, []s3CompletedPart, error) {
+	var (
+		total int64
+		parts []s3CompletedPart
+		chunk = buf
+	)
+
+	for partNumber := 1; ; partNumber++ {
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+
+		resp, err := s.do(ctx, http.MethodPut, objectKey, query, nil, chunk)
+		if err != nil {
+			return total, nil, err
+		}
+
+		drainClose(resp.Body)
+
+		total += int64(len(chunk))
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, buf)
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return total, parts, nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			chunk = buf[:n]
+		case err != nil:
+			return total, nil, fmt.Errorf("read body: %w", err)
+		default:
+			chunk = buf
+		}
+	}
+}
+
+func (s *s3Storage) completeMultipart(ctx context.Context, objectKey, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteRequest{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/xml"}}
+
+	resp, err := s.do(ctx, http.MethodPost, objectKey, url.Values{"uploadId": {uploadID}}, header, body)
+	if err != nil {
+		return err
+	}
+
+	defer drainClose(resp.Body)
+
+	// CompleteMultipartUpload can fail after a 200 status line; the error
+	// is then reported in the body.
+	var apiErr s3Error
+	if decodeErr := xml.NewDecoder(resp.Body).Decode(&apiErr); decodeErr == nil && apiErr.Code != "" {
+		return fmt.Errorf("s3 complete multipart %s: %s %s", objectKey, apiErr.Code, apiErr.Message)
+	}
+
+	return nil
+}
+
+func (s *s3Storage) PublishFile(ctx context.Context, key, staged string) error {
+	f, err := os.Open(staged)
+	if err != nil {
+		return fmt.Errorf("open staged: %w", err)
+	}
+
+	_, err = s.Put(ctx, key, f)
+	_ = f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(staged)
+}
+
+// PublishDir uploads every file under stage below key, then deletes objects
+// left over from the previous tree (and a plain object at key, if any).
+func (s *s3Storage) PublishDir(ctx context.Context, key, stage string) error {
+	fresh := make(map[string]struct{})
+
+	err := filepath.WalkDir(stage, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(stage, p)
+		if err != nil {
+			return err
+		}
+
+		child := joinKey(key, filepath.ToSlash(rel))
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.Put(ctx, child, f)
+		_ = f.Close()
+
+		if err != nil {
+			return err
+		}
+
+		fresh[s.objectKey(child)] = struct{}{}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stale, err := s.listObjects(ctx, s.dirPrefix(key))
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range stale {
+		if _, ok := fresh[obj.Key]; ok {
+			continue
+		}
+
+		if err := s.deleteObject(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+
+	if err := s.deleteObject(ctx, s.objectKey(key)); err != nil {
+		return err
+	}
+
+	go removeAllLogged(stage)
+
+	return nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{s: s, ctx: ctx, objectKey: s.objectKey(key), info: info}, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (fs.FileInfo, error) {
+	if key != "" {
+		resp, err := s.do(ctx, http.MethodHead, s.objectKey(key), nil, nil, nil)
+		if err == nil {
+			drainClose(resp.Body)
+			return s3InfoFromHeader(path.Base(key), resp.Header), nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	// No object at key: it is a directory if anything lives below it.
+	found, err := s.hasObjects(ctx, s.dirPrefix(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if !found && key != "" {
+		return nil, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+
+	return s3Info{name: path.Base(key), dir: true}, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	objects, err := s.listObjects(ctx, s.dirPrefix(key))
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		if err := s.deleteObject(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+
+	if key == "" {
+		return nil
+	}
+
+	return s.deleteObject(ctx, s.objectKey(key))
+}
+
+func (s *s3Storage) RemoveDir(ctx context.Context, key string) error {
+	found, err := s.hasObjects(ctx, s.dirPrefix(key))
+	if err != nil {
+		return err
+	}
+
+	if found {
+		return &fs.PathError{Op: "rmdir", Path: key, Err: syscall.ENOTEMPTY}
+	}
+
+	return nil
+}
+
+func (s *s3Storage) deleteObject(ctx context.Context, objectKey string) error {
+	resp, err := s.do(ctx, http.MethodDelete, objectKey, nil, nil, nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	drainClose(resp.Body)
+
+	return nil
+}
+
+// List returns the direct children of key from one delimited listing:
+// objects are files and common prefixes directories, so a call costs one
+// request per page of children however deep the tree below them is.
+// Directories carry no size or mtime; object stores keep none for them.
+func (s *s3Storage) List(ctx context.Context, key string) ([]fs.FileInfo, error) {
+	prefix := s.dirPrefix(key)
+
+	res, err := s.list(ctx, prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Contents) == 0 && len(res.CommonPrefixes) == 0 && key != "" {
+		if _, err := s.Stat(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+
+	infos := make([]fs.FileInfo, 0, len(res.Contents)+len(res.CommonPrefixes))
+
+	for _, obj := range res.Contents {
+		if name := strings.TrimPrefix(obj.Key, prefix); name != "" {
+			infos = append(infos, s3Info{name: name, size: obj.Size, modTime: obj.LastModified, etag: obj.ETag})
+		}
+	}
+
+	for _, p := range res.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+		if name == "" || (key == "" && name == metaDir) {
+			continue
+		}
+
+		infos = append(infos, s3Info{name: name, dir: true})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+type s3ListResult struct {
+	Contents              []s3ObjectEntry  `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	NextContinuationToken string           `xml:"NextContinuationToken"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ObjectEntry struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+}
+
+// listObjects returns every object under prefix, following continuation
+// tokens. Keys come back in lexicographic order. It costs a request per
+// thousand objects in the whole subtree, so only deletes use it.
+func (s *s3Storage) listObjects(ctx context.Context, prefix string) ([]s3ObjectEntry, error) {
+	res, err := s.list(ctx, prefix, "", 0)
+	return res.Contents, err
+}
+
+// hasObjects reports whether anything lives under prefix with a listing
+// of at most one key.
+func (s *s3Storage) hasObjects(ctx context.Context, prefix string) (bool, error) {
+	res, err := s.list(ctx, prefix, "", 1)
+	return len(res.Contents) > 0, err
+}
+
+// list runs ListObjectsV2 under prefix. With a delimiter, keys below the
+// next one are rolled up into CommonPrefixes. maxKeys > 0 returns only the
+// first page of at most that many entries.
+func (s *s3Storage) list(ctx context.Context, prefix, delimiter string, maxKeys int) (s3ListResult, error) {
+	var (
+		all   s3ListResult
+		token string
+	)
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return all, err
+		}
+
+		var page s3ListResult
+
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		drainClose(resp.Body)
+
+		if err != nil {
+			return all, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+
+		all.Contents = append(all.Contents, page.Contents...)
+		all.CommonPrefixes = append(all.CommonPrefixes, page.CommonPrefixes...)
+
+		if maxKeys > 0 || !page.IsTruncated || page.NextContinuationToken == "" {
+			return all, nil
+		}
+
+		token = page.NextContinuationToken
+	}
+}
+
+// s3Object is a lazily opened object reader. Seek only moves the offset;
+// the next Read issues a ranged GET from there, which is how
+// http.ServeContent serves Range requests without downloading everything.
+type s3Object struct {
+	s         *s3Storage
+	ctx       context.Context
+	objectKey string
+	info      fs.FileInfo
+	offset    int64
+	body      io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.info.IsDir() {
+		return 0, errors.New("is a directory")
+	}
+
+	if o.offset >= o.info.Size() {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+
+		// Every ranged GET reads the version Open saw, never a replacement.
+		if info, ok := o.info.(s3Info); ok && info.etag != "" {
+			header.Set("If-Match", info.etag)
+		}
+
+		resp, err := o.s.do(o.ctx, http.MethodGet, o.objectKey, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = o.offset + offset
+	case io.SeekEnd:
+		next = o.info.Size() + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if next != o.offset && o.body != nil {
+		_ = o.body.Close()
+		o.body = nil
+	}
+
+	o.offset = next
+
+	return next, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	err := o.body.Close()
+	o.body = nil
+
+	return err
+}
+
+func (o *s3Object) Stat() (fs.FileInfo, error) { return o.info, nil }
+
+type s3Info struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	etag    string
+}
+
+func s3InfoFromHeader(name string, h http.Header) s3Info {
+	size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(h.Get("Last-Modified"))
+
+	return s3Info{name: name, size: size, modTime: modTime, etag: h.Get("ETag")}
+}
+
+func (i s3Info) Name() string       { return i.name }
+func (i s3Info) Size() int64        { return i.size }
+func (i s3Info) ModTime() time.Time { return i.modTime }
+func (i s3Info) IsDir() bool        { return i.dir }
+func (i s3Info) Sys() any           { return nil }
+
+// ETag identifies the object version the info describes; directories
+// have none.
+func (i s3Info) ETag() string { return i.etag }
+
+func (i s3Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+
+	return 0o644
+}
+
+// loadS3Config reads the UPLOADER_S3_* variables. Credentials fall back to
+// the standard AWS_* variables so IRSA-style env injection works unchanged.
+func loadS3Config() (s3Config, error) {
+	cfg := s3Config{
+		endpoint: os.Getenv("UPLOADER_S3_ENDPOINT"),
+		bucket:   os.Getenv("UPLOADER_S3_BUCKET"),
+		region:   firstNonEmpty(os.Getenv("UPLOADER_S3_REGION"), os.Getenv("AWS_REGION")),
+		prefix:   os.Getenv("UPLOADER_S3_PREFIX"),
+		creds: s3Credentials{
+			accessKeyID:     firstNonEmpty(os.Getenv("UPLOADER_S3_ACCESS_KEY_ID"), os.Getenv("AWS_ACCESS_KEY_ID")),
+			secretAccessKey: firstNonEmpty(os.Getenv("UPLOADER_S3_SECRET_ACCESS_KEY"), os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+
+	// Custom endpoints are almost always MinIO/Ceph, which want path-style.
+	cfg.pathStyle = cfg.endpoint != ""
+
+	if v := os.Getenv("UPLOADER_S3_PATH_STYLE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid UPLOADER_S3_PATH_STYLE %q: %w", v, err)
+		}
+
+		cfg.pathStyle = b
+	}
+
+	if v := os.Getenv("UPLOADER_S3_PART_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid UPLOADER_S3_PART_SIZE %q: %w", v, err)
+		}
+
+		cfg.partSize = n
+	}
+
+	if cfg.bucket == "" {
+		return cfg, errors.New("UPLOADER_S3_BUCKET is required when UPLOADER_STORAGE=s3")
+	}
+
+	return cfg, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
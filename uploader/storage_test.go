@@ -0,0 +1,149 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memServer wires the production routes to a memStorage. Uploads still
+// spool through the real staging dir, so one is created under a temp root.
+func memServer(t *testing.T) (*echo.Echo, *memStorage) {
+	t.Helper()
+
+	withStagingDir(t)
+	require.NoError(t, setupStagingDir())
+
+	mem := newMemStorage()
+	original := store
+
+	setStorage(mem)
+	t.Cleanup(func() { setStorage(original) })
+
+	e := echo.New()
+	e.HideBanner = true
+	registerRoutes(e, serverConfig{}, hideStagingFS{root: storageFS{mem}})
+
+	return e, mem
+}
+
+func TestMemStorageUploadGetDelete(t *testing.T) {
+	e, mem := memServer(t)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, buildUploadRequest(t, "dir/hello.txt", []byte("hello"), ""))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	info, err := mem.Stat(context.Background(), "dir/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dir/hello.txt", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/dir", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get(echo.HeaderLastModified))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, buildDeleteRequest(t, "/upload", map[string]string{"path": "dir"}))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	_, err = mem.Stat(context.Background(), "dir/hello.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMemStorageTarExtract(t *testing.T) {
+	e, mem := memServer(t)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, buildUploadRequest(t, "bundle", makeTarGz(t, "M", 3), "true"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	infos, err := mem.List(context.Background(), "bundle")
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+
+	// A second archive replaces the whole tree, not just overlapping names.
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, buildUploadRequest(t, "bundle", makeTarGz(t, "N", 1), "true"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	infos, err = mem.List(context.Background(), "bundle")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "N-0.txt", infos[0].Name())
+}
+
+func TestMemStorageDeleteOldFiles(t *testing.T) {
+	e, mem := memServer(t)
+
+	ctx := context.Background()
+	_, err := mem.Put(ctx, "logs/old.log", strings.NewReader("old"))
+	require.NoError(t, err)
+	_, err = mem.Put(ctx, "logs/new.log", strings.NewReader("new"))
+	require.NoError(t, err)
+
+	mem.touch("logs/old.log", time.Now().Add(-10*24*time.Hour))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, buildDeleteRequest(t, "/delete", map[string]string{"path": "logs", "days": "7"}))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	_, err = mem.Stat(ctx, "logs/old.log")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = mem.Stat(ctx, "logs/new.log")
+	assert.NoError(t, err)
+}
+
+func TestLocalStorageListHidesStagingDir(t *testing.T) {
+	dir := withStagingDir(t)
+	require.NoError(t, setupStagingDir())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644))
+
+	infos, err := localStorage{}.List(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "a.txt", infos[0].Name())
+}
+
+func TestLocalStoragePutReportsSize(t *testing.T) {
+	dir := withStagingDir(t)
+	require.NoError(t, setupStagingDir())
+
+	n, err := localStorage{}.Put(context.Background(), "nested/out.bin", strings.NewReader("12345"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	got, err := os.ReadFile(filepath.Join(dir, "nested", "out.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "12345", string(got))
+}
+
+func TestLocalStorageRemoveDirIsNotRecursive(t *testing.T) {
+	dir := withStagingDir(t)
+	require.NoError(t, setupStagingDir())
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "logs", "empty"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "logs", "a.txt"), []byte("a"), 0o644))
+
+	ctx := context.Background()
+
+	assert.ErrorIs(t, localStorage{}.RemoveDir(ctx, "logs"), syscall.ENOTEMPTY)
+	require.NoError(t, localStorage{}.RemoveDir(ctx, "logs/empty"))
+
+	_, err := os.Stat(filepath.Join(dir, "logs", "a.txt"))
+	assert.NoError(t, err)
+}
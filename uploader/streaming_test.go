@@ -112,9 +112,10 @@ func TestUploadRejectsOversizedField(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), "exceeds")
 }
 
-// Pins the contract: a second `file` part is rejected, not silently overwritten.
-func TestUploadRejectsMultipleFileParts(t *testing.T) {
-	e, _ := concurrencyServer(t)
+// Pins the contract: a second `file` part gets its own destination; the
+// `path` field binds to the first part only, so nothing is silently overwritten.
+func TestUploadMultipleFilePartsKeepOwnDestinations(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
 
 	body := &bytes.Buffer{}
 	w := multipart.NewWriter(body)
@@ -138,7 +139,15 @@ func TestUploadRejectsMultipleFileParts(t *testing.T) {
 	rec := httptest.NewRecorder()
 	e.ServeHTTP(rec, req)
 
-	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "out.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "aaa", string(got))
+
+	got, err = os.ReadFile(filepath.Join(tempdir, "b.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "bbb", string(got))
 }
 
 func TestUploadRejectsNonMultipart(t *testing.T) {
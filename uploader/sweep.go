@@ -0,0 +1,196 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+// oldFileSweep is one DELETE /delete run. Files are judged by their own
+// mtime, never by their directory's. With recursive set it descends the
+// whole tree and removes the directories it leaves empty; with dryRun it
+// only reports what it would delete. Entries the ACLs keep the caller from
+// deleting are left in place.
+type oldFileSweep struct {
+	root      string
+	days      int
+	recursive bool
+	dryRun    bool
+	include   []string
+	exclude   []string
+
+	deleted []string
+}
+
+// parseSweepGlobs validates the include/exclude patterns of a request.
+func parseSweepGlobs(name string, patterns []string) ([]string, error) {
+	var globs []string
+
+	for _, p := range patterns {
+		for _, g := range strings.Split(p, ",") {
+			if g = strings.TrimSpace(g); g == "" {
+				continue
+			}
+
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s pattern %q", name, g))
+			}
+
+			globs = append(globs, g)
+		}
+	}
+
+	return globs, nil
+}
+
+// matchSweepGlob matches a pattern with a slash against the path below the
+// sweep root and any other pattern against the base name, so "*.log"
+// selects log files at every depth.
+func matchSweepGlob(globs []string, rel string) bool {
+	for _, g := range globs {
+		name := path.Base(rel)
+		if strings.Contains(g, "/") {
+			name = rel
+		}
+
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *oldFileSweep) selects(rel string) bool {
+	if len(s.include) > 0 && !matchSweepGlob(s.include, rel) {
+		return false
+	}
+
+	return !matchSweepGlob(s.exclude, rel)
+}
+
+func (s *oldFileSweep) rel(key string) string {
+	if s.root == "" {
+		return key
+	}
+
+	return strings.TrimPrefix(key, s.root+"/")
+}
+
+// sweep cleans the directory at dir and reports whether nothing is left
+// in it, counting what a dry run would have deleted as gone. Storage.List
+// never returns the staging dir, so sweeping the upload root cannot touch
+// in-flight uploads.
+func (s *oldFileSweep) sweep(ctx context.Context, dir string) (bool, error) {
+	infos, err := store.List(ctx, dir)
+	if err != nil {
+		return false, err
+	}
+
+	remaining := 0
+
+	for _, info := range infos {
+		key := joinKey(dir, info.Name())
+
+		switch {
+		case info.IsDir() && s.recursive:
+			before := len(s.deleted)
+
+			empty, err := s.sweep(ctx, key)
+			if err != nil {
+				log.Printf("failed to sweep %s: %v", key, err)
+				remaining++
+
+				continue
+			}
+
+			// A directory is only removed when this sweep emptied it or it
+			// was already empty and old: a fresh mkdir waiting for its
+			// first upload stays.
+			if !empty || (len(s.deleted) == before && !isOlderThanXDays(info.ModTime(), s.days)) || !s.removeDir(ctx, key) {
+				remaining++
+			}
+		case info.Mode().IsRegular() && isOlderThanXDays(info.ModTime(), s.days) && s.selects(s.rel(key)):
+			if !s.removeFile(ctx, key) {
+				remaining++
+			}
+		default:
+			remaining++
+		}
+	}
+
+	return remaining == 0, nil
+}
+
+// removeFile deletes key under its lock after checking it is still old, so
+// a file republished since the listing survives.
+func (s *oldFileSweep) removeFile(ctx context.Context, key string) bool {
+	if err := authorizeKey(ctx, scopeDelete, key); err != nil {
+		return false
+	}
+
+	if s.dryRun {
+		s.deleted = append(s.deleted, key)
+		return true
+	}
+
+	unlock := lockKey(key)
+	defer unlock()
+
+	info, err := store.Stat(ctx, key)
+	if err != nil || !isOlderThanXDays(info.ModTime(), s.days) {
+		return false
+	}
+
+	if err := deleteKey(ctx, key); err != nil {
+		log.Printf("failed to delete %s: %v", key, err)
+		return false
+	}
+
+	s.deleted = append(s.deleted, key)
+
+	return true
+}
+
+// removeDir deletes an emptied directory under its lock. The removal is
+// not recursive, so an upload that landed in the directory since it was
+// swept makes it fail instead of being deleted with it. Object stores have
+// no empty directories: one that vanished with its last file counts as
+// removed.
+func (s *oldFileSweep) removeDir(ctx context.Context, key string) bool {
+	if err := authorizeKey(ctx, scopeDelete, key); err != nil {
+		return false
+	}
+
+	if s.dryRun {
+		s.deleted = append(s.deleted, key)
+		return true
+	}
+
+	unlock := lockKey(key)
+	defer unlock()
+
+	if err := store.RemoveDir(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		if !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			log.Printf("failed to delete %s: %v", key, err)
+		}
+
+		return false
+	}
+
+	// The records of the files below went with them; what is left of the
+	// record tree is empty directories on the local backend.
+	_ = store.RemoveDir(ctx, metaKey(key))
+
+	s.deleted = append(s.deleted, key)
+
+	return true
+}
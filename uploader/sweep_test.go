@@ -0,0 +1,173 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sweepResponse struct {
+	Count        int      `json:"count"`
+	DeletedCount int      `json:"deleted_count"`
+	DryRun       bool     `json:"dry_run"`
+	Deleted      []string `json:"deleted"`
+}
+
+// sweepTree lays out files under tempdir and backdates the ones listed in
+// old by 30 days. Directories are backdated too, so only the file mtimes
+// can keep anything alive.
+func sweepTree(t *testing.T, tempdir string, fresh, old []string) {
+	t.Helper()
+
+	past := time.Now().Add(-30 * 24 * time.Hour)
+
+	for _, name := range append(append([]string{}, fresh...), old...) {
+		p := filepath.Join(tempdir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(name), 0o644))
+	}
+
+	for _, name := range old {
+		require.NoError(t, os.Chtimes(filepath.Join(tempdir, filepath.FromSlash(name)), past, past))
+	}
+
+	require.NoError(t, filepath.WalkDir(tempdir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || p == tempdir || strings.Contains(p, stagingDir) {
+			return err
+		}
+
+		return os.Chtimes(p, past, past)
+	}))
+}
+
+// sweepRequest is buildDeleteRequest with repeatable fields.
+func sweepRequest(t *testing.T, e *echo.Echo, fields url.Values) sweepResponse {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	for k, values := range fields {
+		for _, v := range values {
+			require.NoError(t, w.WriteField(k, v))
+		}
+	}
+
+	require.NoError(t, w.Close())
+
+	req := httptest.NewRequest(http.MethodDelete, "/delete", body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	var res sweepResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	return res
+}
+
+func TestDeleteOldFilesJudgesEachFileByItsOwnMtime(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	sweepTree(t, tempdir,
+		[]string{"a/b/new.txt", "a/old-dir/fresh.txt"},
+		[]string{"a/b/c/d/old.txt", "a/b/stale.txt", "top.txt"})
+
+	res := sweepRequest(t, e, url.Values{"path": {""}, "days": {"7"}, "recursive": {"true"}})
+	assert.Equal(t, []string{"a/b/c/d/old.txt", "a/b/c/d", "a/b/c", "a/b/stale.txt", "top.txt"}, res.Deleted)
+	assert.Equal(t, 5, res.DeletedCount)
+
+	for _, kept := range []string{"a/b/new.txt", "a/old-dir/fresh.txt"} {
+		_, err := os.Stat(filepath.Join(tempdir, filepath.FromSlash(kept)))
+		assert.NoError(t, err, "fresh files in old directories stay")
+	}
+
+	_, err := os.Stat(filepath.Join(tempdir, "a", "b", "c"))
+	assert.True(t, os.IsNotExist(err), "emptied directories go")
+}
+
+func TestDeleteOldFilesNonRecursiveOnlyTouchesDirectFiles(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	sweepTree(t, tempdir, nil, []string{"logs/old.log", "logs/nested/old.log"})
+
+	res := sweepRequest(t, e, url.Values{"path": {"logs"}, "days": {"7"}})
+	assert.Equal(t, []string{"logs/old.log"}, res.Deleted)
+
+	_, err := os.Stat(filepath.Join(tempdir, "logs", "nested", "old.log"))
+	assert.NoError(t, err)
+}
+
+func TestDeleteOldFilesDryRun(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	sweepTree(t, tempdir, nil, []string{"a/old.txt"})
+
+	res := sweepRequest(t, e, url.Values{"path": {""}, "days": {"7"}, "recursive": {"true"}, "dry_run": {"true"}})
+	assert.True(t, res.DryRun)
+	assert.Equal(t, []string{"a/old.txt", "a"}, res.Deleted)
+	assert.Equal(t, 2, res.Count)
+	assert.Zero(t, res.DeletedCount)
+
+	_, err := os.Stat(filepath.Join(tempdir, "a", "old.txt"))
+	assert.NoError(t, err, "a dry run deletes nothing")
+}
+
+func TestDeleteOldFilesGlobFilters(t *testing.T) {
+	e, tempdir := concurrencyServer(t)
+
+	sweepTree(t, tempdir, nil, []string{"a/x.log", "a/x.txt", "a/keep/y.log", "b/z.log"})
+
+	res := sweepRequest(t, e, url.Values{
+		"path":      {""},
+		"days":      {"7"},
+		"recursive": {"true"},
+		"include":   {"*.log"},
+		"exclude":   {"a/keep/*", "b/*"},
+	})
+	assert.Equal(t, []string{"a/x.log"}, res.Deleted)
+
+	for _, kept := range []string{"a/x.txt", "a/keep/y.log", "b/z.log"} {
+		_, err := os.Stat(filepath.Join(tempdir, filepath.FromSlash(kept)))
+		assert.NoError(t, err, kept)
+	}
+
+	req := buildDeleteRequest(t, "/delete", map[string]string{"path": "", "days": "7", "include": "["})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestMemStorageDeleteOldFilesRecursive(t *testing.T) {
+	e, mem := memServer(t)
+
+	ctx := context.Background()
+	for _, key := range []string{"logs/a/old.log", "logs/b/old.log", "logs/b/new.log"} {
+		_, err := mem.Put(ctx, key, strings.NewReader(key))
+		require.NoError(t, err)
+	}
+
+	mem.touch("logs/a/old.log", time.Now().Add(-10*24*time.Hour))
+	mem.touch("logs/b/old.log", time.Now().Add(-10*24*time.Hour))
+
+	res := sweepRequest(t, e, url.Values{"path": {"logs"}, "days": {"7"}, "recursive": {"true"}})
+	assert.Equal(t, []string{"logs/a/old.log", "logs/a", "logs/b/old.log"}, res.Deleted)
+
+	_, err := mem.Stat(ctx, "logs/b/new.log")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,298 @@
+package uploader
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Turborepo remote cache API (https://turbo.build/repo/docs/core-concepts/remote-caching#self-hosting),
+// the subset turbo itself calls. Every request names its team with ?teamId=
+// or ?slug= and carries a bearer token that must be configured for that
+// team. Artifacts are stored under turbo/{team}/{hash}; the optional
+// x-artifact-duration and x-artifact-tag headers are kept in a JSON record
+// next to the artifact so signed-artifact verification keeps working.
+const (
+	turboRoutePrefix = "/v8/artifacts"
+	turboKeyPrefix   = "turbo"
+	maxTurboNameLen  = 128
+	maxTurboQuery    = 1 << 20
+)
+
+type turboConfig struct {
+	// token -> teams it may access, from UPLOADER_TURBO_TOKENS. Empty
+	// disables the API.
+	teams map[string][]string
+}
+
+// loadTurboConfig parses UPLOADER_TURBO_TOKENS, a comma-separated list of
+// team:token pairs. A token listed for several teams may access each of them.
+func loadTurboConfig() (turboConfig, error) {
+	cfg := turboConfig{teams: make(map[string][]string)}
+
+	v := os.Getenv("UPLOADER_TURBO_TOKENS")
+	if v == "" {
+		return cfg, nil
+	}
+
+	for _, pair := range strings.Split(v, ",") {
+		team, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || token == "" || !isTurboName(team) {
+			return cfg, fmt.Errorf("UPLOADER_TURBO_TOKENS must be a comma-separated list of 'team:token' pairs, got %q", pair)
+		}
+
+		cfg.teams[token] = append(cfg.teams[token], team)
+	}
+
+	return cfg, nil
+}
+
+func registerTurboRoutes(e *echo.Echo, cfg turboConfig) {
+	if len(cfg.teams) == 0 {
+		return
+	}
+
+	g := e.Group(turboRoutePrefix, turboAuth(cfg))
+	g.GET("/status", turboStatus)
+	g.POST("", turboQuery)
+	g.GET("/:hash", turboGet)
+	g.HEAD("/:hash", turboHead)
+	g.PUT("/:hash", turboPut)
+}
+
+func isTurboRoute(routePath string) bool {
+	return routePath == turboRoutePrefix || strings.HasPrefix(routePath, turboRoutePrefix+"/")
+}
+
+// Hashes and team names end up as path segments, so only [A-Za-z0-9_-]
+// is accepted; that also keeps hashes from colliding with the .json records.
+func isTurboName(s string) bool {
+	if s == "" || len(s) > maxTurboNameLen {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !isAlphaNum(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// turboAuth resolves the team from the query and checks that the bearer
+// token is configured for it. The resolved team is stored on the context.
+func turboAuth(cfg turboConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			team := firstNonEmpty(c.QueryParam("teamId"), c.QueryParam("slug"))
+			if !isTurboName(team) {
+				return echo.NewHTTPError(http.StatusBadRequest, "teamId or slug is required")
+			}
+
+			token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok {
+				return echo.ErrUnauthorized
+			}
+
+			if !turboTokenAllows(cfg, token, team) {
+				return echo.NewHTTPError(http.StatusForbidden, "token is not valid for this team")
+			}
+
+			c.Set("turboTeam", team)
+
+			return next(c)
+		}
+	}
+}
+
+func turboTokenAllows(cfg turboConfig, token, team string) bool {
+	allowed := false
+
+	// Compare against every configured token so the timing does not reveal
+	// which prefix matched.
+	for t, teams := range cfg.teams {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+			continue
+		}
+
+		for _, tm := range teams {
+			if tm == team {
+				allowed = true
+			}
+		}
+	}
+
+	return allowed
+}
+
+// turboMeta is the JSON record stored next to each artifact.
+type turboMeta struct {
+	DurationMs int64  `json:"taskDurationMs"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+func turboKey(c echo.Context, hash string) (string, error) {
+	if !isTurboName(hash) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "invalid artifact hash")
+	}
+
+	return turboKeyPrefix + "/" + c.Get("turboTeam").(string) + "/" + hash, nil
+}
+
+func turboStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "enabled"})
+}
+
+func turboGet(c echo.Context) error {
+	key, err := turboKey(c, c.Param("hash"))
+	if err != nil {
+		return err
+	}
+
+	setTurboHeaders(c, key)
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+
+	return serveStoredFile(c, key)
+}
+
+func turboHead(c echo.Context) error {
+	key, err := turboKey(c, c.Param("hash"))
+	if err != nil {
+		return err
+	}
+
+	setTurboHeaders(c, key)
+
+	return statStoredFile(c, key)
+}
+
+func setTurboHeaders(c echo.Context, key string) {
+	meta, err := readTurboMeta(c, key)
+	if err != nil {
+		return
+	}
+
+	c.Response().Header().Set("x-artifact-duration", strconv.FormatInt(meta.DurationMs, 10))
+
+	if meta.Tag != "" {
+		c.Response().Header().Set("x-artifact-tag", meta.Tag)
+	}
+}
+
+func readTurboMeta(c echo.Context, key string) (turboMeta, error) {
+	var meta turboMeta
+
+	if err := authorizeKey(c.Request().Context(), scopeRead, key+".json"); err != nil {
+		return meta, err
+	}
+
+	obj, err := store.Open(c.Request().Context(), key+".json")
+	if err != nil {
+		return meta, err
+	}
+
+	defer func() {
+		if closeErr := obj.Close(); closeErr != nil {
+			log.Printf("error closing %s.json: %v", key, closeErr)
+		}
+	}()
+
+	err = json.NewDecoder(io.LimitReader(obj, maxTurboQuery)).Decode(&meta)
+
+	return meta, err
+}
+
+// turboPut stages the artifact like /upload does and publishes it with its
+// record. A reader can see the artifact a moment before its tag; the tag
+// is optional to clients, so it is served as empty until then.
+func turboPut(c echo.Context) error {
+	key, err := turboKey(c, c.Param("hash"))
+	if err != nil {
+		return err
+	}
+
+	meta := turboMeta{Tag: c.Request().Header.Get("x-artifact-tag")}
+
+	if v := c.Request().Header.Get("x-artifact-duration"); v != "" {
+		if meta.DurationMs, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid x-artifact-duration")
+		}
+	}
+
+	tmp, _, sum, err := streamPartToStagedTemp(c.Request().Body)
+	defer removeStaged(tmp)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("stage upload: %s", err))
+	}
+
+	ctx := c.Request().Context()
+
+	record, err := json.Marshal(meta)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := publishFileRecord(ctx, key, tmp, sum, writeCondition{}, key+".json", record); err != nil {
+		return publishHTTPError(err)
+	}
+
+	return c.JSON(http.StatusAccepted, map[string][]string{"urls": {c.Request().URL.Path}})
+}
+
+// turboQuery answers POST /v8/artifacts {"hashes": [...]} with the size,
+// duration and tag of each artifact the team has, and an error object for
+// the rest.
+func turboQuery(c echo.Context) error {
+	var req struct {
+		Hashes []string `json:"hashes"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(c.Request().Body, maxTurboQuery)).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+	}
+
+	res := make(map[string]any, len(req.Hashes))
+
+	for _, hash := range req.Hashes {
+		key, err := turboKey(c, hash)
+		if err != nil {
+			res[hash] = turboQueryError("invalid artifact hash")
+			continue
+		}
+
+		if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+			res[hash] = turboQueryError("access denied")
+			continue
+		}
+
+		info, err := store.Stat(c.Request().Context(), key)
+
+		switch {
+		case errors.Is(err, fs.ErrNotExist), err == nil && info.IsDir():
+			res[hash] = turboQueryError("artifact not found")
+		case err != nil:
+			return storageHTTPError(err)
+		default:
+			meta, _ := readTurboMeta(c, key)
+			res[hash] = map[string]any{"size": info.Size(), "taskDurationMs": meta.DurationMs, "tag": meta.Tag}
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func turboQueryError(msg string) map[string]any {
+	return map[string]any{"error": map[string]string{"message": msg}}
+}
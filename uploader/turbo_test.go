@@ -0,0 +1,149 @@
+package uploader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func turboServer(t *testing.T) (*echo.Echo, string) {
+	t.Helper()
+
+	return configuredServer(t, serverConfig{
+		credentials: "user:pass",
+		turbo: turboConfig{teams: map[string][]string{
+			"tok-web":  {"team_web"},
+			"tok-both": {"team_web", "team_api"},
+		}},
+	})
+}
+
+func turboRequest(t *testing.T, e *echo.Echo, method, target, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+
+	req.Header.Set("x-artifact-duration", "1234")
+	req.Header.Set("x-artifact-tag", "sig")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestTurboArtifactRoundTrip(t *testing.T) {
+	e, tempdir := turboServer(t)
+
+	rec := turboRequest(t, e, http.MethodGet, "/v8/artifacts/abc123?teamId=team_web", "tok-web", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "miss before store")
+
+	rec = turboRequest(t, e, http.MethodPut, "/v8/artifacts/abc123?teamId=team_web", "tok-web", "artifact")
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	got, err := os.ReadFile(filepath.Join(tempdir, turboKeyPrefix, "team_web", "abc123"))
+	require.NoError(t, err)
+	assert.Equal(t, "artifact", string(got))
+
+	rec = turboRequest(t, e, http.MethodGet, "/v8/artifacts/abc123?slug=team_web", "tok-both", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "artifact", rec.Body.String())
+	assert.Equal(t, "1234", rec.Header().Get("x-artifact-duration"))
+	assert.Equal(t, "sig", rec.Header().Get("x-artifact-tag"))
+
+	rec = turboRequest(t, e, http.MethodHead, "/v8/artifacts/abc123?teamId=team_web", "tok-web", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = turboRequest(t, e, http.MethodGet, "/v8/artifacts/abc123?teamId=team_api", "tok-both", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "artifacts are per team")
+}
+
+func TestTurboRefusedPutKeepsRecord(t *testing.T) {
+	e, tempdir := configuredServer(t, serverConfig{
+		immutablePrefixes: []string{turboKeyPrefix + "/team_web"},
+		turbo:             turboConfig{teams: map[string][]string{"tok-web": {"team_web"}}},
+	})
+	t.Cleanup(func() { setImmutablePrefixes(nil) })
+
+	rec := turboRequest(t, e, http.MethodPut, "/v8/artifacts/abc123?teamId=team_web", "tok-web", "artifact")
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodPut, "/v8/artifacts/abc123?teamId=team_web", strings.NewReader("other"))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer tok-web")
+	req.Header.Set("x-artifact-tag", "forged")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	record, err := os.ReadFile(filepath.Join(tempdir, turboKeyPrefix, "team_web", "abc123.json"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"tag":"sig","taskDurationMs":1234}`, string(record), "a refused publish leaves the record alone")
+}
+
+func TestTurboTeamScoping(t *testing.T) {
+	e, _ := turboServer(t)
+
+	for _, tc := range []struct {
+		name, target, token string
+		want                int
+	}{
+		{"no token", "/v8/artifacts/abc?teamId=team_web", "", http.StatusUnauthorized},
+		{"unknown token", "/v8/artifacts/abc?teamId=team_web", "nope", http.StatusForbidden},
+		{"other team", "/v8/artifacts/abc?teamId=team_api", "tok-web", http.StatusForbidden},
+		{"no team", "/v8/artifacts/abc", "tok-web", http.StatusBadRequest},
+		{"bad team", "/v8/artifacts/abc?teamId=../x", "tok-web", http.StatusBadRequest},
+		{"bad hash", "/v8/artifacts/a.json?teamId=team_web", "tok-web", http.StatusBadRequest},
+	} {
+		rec := turboRequest(t, e, http.MethodPut, tc.target, tc.token, "x")
+		assert.Equal(t, tc.want, rec.Code, tc.name)
+	}
+}
+
+func TestTurboQuery(t *testing.T) {
+	e, _ := turboServer(t)
+
+	rec := turboRequest(t, e, http.MethodPut, "/v8/artifacts/abc123?teamId=team_web", "tok-web", "artifact")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	rec = turboRequest(t, e, http.MethodPost, "/v8/artifacts?teamId=team_web", "tok-web",
+		`{"hashes":["abc123","missing"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var res map[string]map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.EqualValues(t, 8, res["abc123"]["size"])
+	assert.EqualValues(t, 1234, res["abc123"]["taskDurationMs"])
+	assert.Contains(t, res["missing"], "error")
+
+	rec = turboRequest(t, e, http.MethodGet, "/v8/artifacts/status?teamId=team_web", "tok-web", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"enabled"}`, rec.Body.String())
+}
+
+func TestLoadTurboConfig(t *testing.T) {
+	saveServerGlobals(t)
+
+	t.Setenv("UPLOADER_TURBO_TOKENS", "team_web:a, team_api:a,ops:b")
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"a": {"team_web", "team_api"}, "b": {"ops"}}, cfg.turbo.teams)
+
+	t.Setenv("UPLOADER_TURBO_TOKENS", "team-without-token")
+
+	_, err = loadConfig()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "UPLOADER_TURBO_TOKENS")
+}
@@ -0,0 +1,509 @@
+package uploader
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+)
+
+// tus resumable upload protocol 1.0.0 (https://tus.io/protocols/resumable-upload)
+// with the creation, creation-with-upload, termination and expiration
+// extensions. Each upload is a data file plus a JSON .info record in the
+// staging dir; both survive restarts, and the startup sweep only reclaims
+// uploads whose expiry has passed. Upload-Metadata carries the same fields
+// as the multipart form of /upload ("path", "filename", "extract"), and the
+// finished file is published through the same code.
+const (
+	tusRoutePrefix        = "/tus"
+	tusStagingPrefix      = "tus-"
+	tusInfoSuffix         = ".info"
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,creation-with-upload,termination,expiration"
+	tusOffsetContentType  = "application/offset+octet-stream"
+	defaultTusExpiration  = 24 * time.Hour
+	maxTusMetadataEntries = 16
+	tusOrphanGrace        = time.Hour
+)
+
+type tusConfig struct {
+	expiration time.Duration
+	maxSize    int64 // 0 means unlimited
+}
+
+func loadTusConfig(maxUploadSize string) (tusConfig, error) {
+	cfg := tusConfig{expiration: defaultTusExpiration}
+
+	if v := os.Getenv("UPLOADER_TUS_EXPIRATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid UPLOADER_TUS_EXPIRATION %q: must be a positive duration", v)
+		}
+
+		cfg.expiration = d
+	}
+
+	maxSize, err := bytes.Parse(maxUploadSize)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid UPLOADER_MAX_UPLOAD_SIZE %q: %w", maxUploadSize, err)
+	}
+
+	cfg.maxSize = maxSize
+
+	return cfg, nil
+}
+
+// tusInfo is the persisted state of an upload. The offset is not stored:
+// it is the size of the data file, so bytes that reached the disk before a
+// dropped connection count without further bookkeeping.
+type tusInfo struct {
+	Length      int64             `json:"length"`
+	Metadata    map[string]string `json:"metadata"`
+	RawMetadata string            `json:"rawMetadata,omitempty"`
+	Expires     time.Time         `json:"expires"`
+}
+
+// tusLocks serializes PATCH/DELETE per upload ID inside this process;
+// HEAD reads without it.
+var tusLocks sync.Map
+
+func registerTusRoutes(e *echo.Echo, cfg tusConfig) {
+	if cfg.expiration == 0 {
+		cfg.expiration = defaultTusExpiration
+	}
+
+	t := &tusHandler{cfg: cfg}
+
+	g := e.Group(tusRoutePrefix, tusResumableHeader)
+	g.OPTIONS("", t.options)
+	g.POST("", t.create)
+	g.HEAD("/:id", t.head)
+	g.PATCH("/:id", t.patch)
+	g.DELETE("/:id", t.terminate)
+}
+
+func isTusRoute(routePath string) bool {
+	return routePath == tusRoutePrefix || strings.HasPrefix(routePath, tusRoutePrefix+"/")
+}
+
+type tusHandler struct {
+	cfg tusConfig
+}
+
+// tusResumableHeader enforces the protocol version on every request except
+// OPTIONS discovery and echoes it on every response.
+func tusResumableHeader(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Tus-Resumable", tusVersion)
+
+		if c.Request().Method != http.MethodOptions && c.Request().Header.Get("Tus-Resumable") != tusVersion {
+			c.Response().Header().Set("Tus-Version", tusVersion)
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+		}
+
+		return next(c)
+	}
+}
+
+func (t *tusHandler) options(c echo.Context) error {
+	h := c.Response().Header()
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+
+	if t.cfg.maxSize > 0 {
+		h.Set("Tus-Max-Size", strconv.FormatInt(t.cfg.maxSize, 10))
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(raw string) (map[string]string, error) {
+	meta := make(map[string]string)
+
+	if strings.TrimSpace(raw) == "" {
+		return meta, nil
+	}
+
+	pairs := strings.Split(raw, ",")
+	if len(pairs) > maxTusMetadataEntries {
+		return nil, fmt.Errorf("at most %d metadata entries are allowed", maxTusMetadataEntries)
+	}
+
+	for _, pair := range pairs {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+
+		decoded, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || k == "" {
+			return nil, fmt.Errorf("invalid metadata entry %q", pair)
+		}
+
+		meta[k] = string(decoded)
+	}
+
+	return meta, nil
+}
+
+func (t *tusHandler) create(c echo.Context) error {
+	length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Upload-Length header is required")
+	}
+
+	if t.cfg.maxSize > 0 && length > t.cfg.maxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", t.cfg.maxSize))
+	}
+
+	raw := c.Request().Header.Get("Upload-Metadata")
+
+	meta, err := parseTusMetadata(raw)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// Reject a bad destination or extract format, and a destination the
+	// caller may not write, now rather than after the last byte.
+	_, key, err := resolveDestination(meta, meta["filename"])
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing destination path")
+	}
+
+	if _, err := extractFormat(meta); err != nil {
+		return err
+	}
+
+	if err := checkWrite(c.Request().Context(), key, writeCondition{}); err != nil {
+		return err
+	}
+
+	reclaimExpiredTusUploads(time.Now())
+
+	data, err := reserveStagingName(tusStagingPrefix)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	info := tusInfo{Length: length, Metadata: meta, RawMetadata: raw, Expires: time.Now().Add(t.cfg.expiration).UTC()}
+
+	if err := writeTusInfo(data, info); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("create upload: %s", err))
+	}
+
+	if err := os.WriteFile(data, nil, 0o644); err != nil {
+		removeTusUpload(data)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("create upload: %s", err))
+	}
+
+	id := strings.TrimPrefix(filepath.Base(data), tusStagingPrefix)
+	c.Response().Header().Set(echo.HeaderLocation, tusRoutePrefix+"/"+id)
+
+	// creation-with-upload, and empty uploads that are complete right away.
+	if c.Request().Header.Get(echo.HeaderContentType) == tusOffsetContentType || length == 0 {
+		return t.withUpload(c, id, func(data string, info tusInfo, offset int64) error {
+			return t.appendAndMaybePublish(c, data, info, offset, http.StatusCreated)
+		})
+	}
+
+	c.Response().Header().Set("Upload-Expires", info.Expires.Format(http.TimeFormat))
+	c.Response().Header().Set("Upload-Offset", "0")
+
+	return c.NoContent(http.StatusCreated)
+}
+
+func tusDataPath(id string) (string, error) {
+	if len(id) != 16 || !isHex(id) {
+		return "", echo.ErrNotFound
+	}
+
+	return filepath.Join(absStagePath, tusStagingPrefix+id), nil
+}
+
+func readTusInfo(data string) (tusInfo, error) {
+	var info tusInfo
+
+	b, err := os.ReadFile(data + tusInfoSuffix)
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(b, &info)
+
+	return info, err
+}
+
+// writeTusInfo replaces the record via rename so a crash never leaves a
+// truncated one behind.
+func writeTusInfo(data string, info tusInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp := data + tusInfoSuffix + ".new"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, data+tusInfoSuffix)
+}
+
+func removeTusUpload(data string) {
+	for _, p := range []string{data, data + tusInfoSuffix} {
+		removeStaged(p)
+	}
+}
+
+// withUpload loads an upload under its lock and answers 404 for unknown
+// and 410 for expired uploads. A second concurrent writer of the same
+// upload gets 423 instead of waiting.
+func (t *tusHandler) withUpload(c echo.Context, id string, fn func(data string, info tusInfo, offset int64) error) error {
+	data, err := tusDataPath(id)
+	if err != nil {
+		return err
+	}
+
+	muAny, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+
+	mu, _ := muAny.(*sync.Mutex)
+	if !mu.TryLock() {
+		return echo.NewHTTPError(http.StatusLocked, "upload is being written by another request")
+	}
+	defer mu.Unlock()
+
+	info, offset, err := loadTusUpload(data)
+	if err != nil {
+		var he *echo.HTTPError
+		if errors.As(err, &he) && he.Code == http.StatusGone {
+			removeTusUpload(data)
+			tusLocks.Delete(id)
+		}
+
+		return err
+	}
+
+	return fn(data, info, offset)
+}
+
+// loadTusUpload reads an upload's record and the offset reached so far.
+// It takes no lock: the offset is whatever reached the disk, which is where
+// a client may resume once the running PATCH, if any, has returned.
+func loadTusUpload(data string) (tusInfo, int64, error) {
+	info, err := readTusInfo(data)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return info, 0, echo.ErrNotFound
+		}
+
+		return info, 0, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("read upload: %s", err))
+	}
+
+	if time.Now().After(info.Expires) {
+		return info, 0, echo.NewHTTPError(http.StatusGone, "upload expired")
+	}
+
+	st, err := os.Stat(data)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return info, 0, echo.ErrNotFound
+		}
+
+		return info, 0, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("stat upload: %s", err))
+	}
+
+	// A chunk that ran past Upload-Length is cut back by its writer.
+	return info, min(st.Size(), info.Length), nil
+}
+
+// head answers without the upload lock, so a client can poll the offset
+// while a PATCH is still writing.
+func (t *tusHandler) head(c echo.Context) error {
+	data, err := tusDataPath(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	info, offset, err := loadTusUpload(data)
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	h.Set("Upload-Expires", info.Expires.Format(http.TimeFormat))
+	h.Set(echo.HeaderCacheControl, "no-store")
+
+	if info.RawMetadata != "" {
+		h.Set("Upload-Metadata", info.RawMetadata)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (t *tusHandler) patch(c echo.Context) error {
+	if c.Request().Header.Get(echo.HeaderContentType) != tusOffsetContentType {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be "+tusOffsetContentType)
+	}
+
+	return t.withUpload(c, c.Param("id"), func(data string, info tusInfo, offset int64) error {
+		claimed, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || claimed != offset {
+			c.Response().Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Upload-Offset must be %d", offset))
+		}
+
+		return t.appendAndMaybePublish(c, data, info, offset, http.StatusNoContent)
+	})
+}
+
+// appendAndMaybePublish appends the request body at offset, extends the
+// expiry and publishes the file once all Upload-Length bytes are present.
+// Whatever reached the disk before a read error stays, so the client
+// resumes from there.
+func (t *tusHandler) appendAndMaybePublish(c echo.Context, data string, info tusInfo, offset int64, status int) error {
+	n, err := appendTusChunk(data, c.Request().Body, offset, info.Length)
+	offset += n
+
+	info.Expires = time.Now().Add(t.cfg.expiration).UTC()
+	if infoErr := writeTusInfo(data, info); infoErr != nil {
+		log.Printf("tus: failed to extend expiry of %s: %v", data, infoErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Expires", info.Expires.Format(http.TimeFormat))
+
+	if offset == info.Length {
+		if err := publishTusUpload(c, data, info); err != nil {
+			return err
+		}
+	}
+
+	return c.NoContent(status)
+}
+
+func appendTusChunk(data string, r io.Reader, offset, length int64) (int64, error) {
+	f, err := os.OpenFile(data, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("open upload: %s", err))
+	}
+
+	remaining := length - offset
+	n, copyErr := io.Copy(f, io.LimitReader(r, remaining+1))
+
+	if n > remaining {
+		// The body ran past Upload-Length: drop the excess and refuse.
+		if err := f.Truncate(length); err != nil {
+			log.Printf("tus: failed to truncate %s: %v", data, err)
+		}
+
+		n = remaining
+		copyErr = echo.NewHTTPError(http.StatusRequestEntityTooLarge, "chunk exceeds Upload-Length")
+	}
+
+	if closeErr := f.Close(); closeErr != nil && copyErr == nil {
+		copyErr = echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("close upload: %s", closeErr))
+	}
+
+	var he *echo.HTTPError
+	if copyErr != nil && !errors.As(copyErr, &he) {
+		copyErr = echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("read chunk: %s", copyErr))
+	}
+
+	return n, copyErr
+}
+
+// publishTusUpload publishes a finished upload exactly like /upload would,
+// extracting it when the metadata asked for it.
+func publishTusUpload(c echo.Context, data string, info tusInfo) error {
+	resolvedPath, key, err := resolveDestination(info.Metadata, info.Metadata["filename"])
+	if err != nil {
+		return err
+	}
+
+	format, err := extractFormat(info.Metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := publishConsumed(c.Request().Context(), key, stagedUpload{tmp: data}, format, writeCondition{}); err != nil {
+		return publishHTTPError(fmt.Errorf("%s: %w", resolvedPath, err))
+	}
+
+	removeTusUpload(data)
+	tusLocks.Delete(tusUploadID(filepath.Base(data)))
+
+	return nil
+}
+
+func (t *tusHandler) terminate(c echo.Context) error {
+	id := c.Param("id")
+
+	return t.withUpload(c, id, func(data string, _ tusInfo, _ int64) error {
+		removeTusUpload(data)
+		tusLocks.Delete(id)
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// tusUploadID is the upload ID a tus staging entry belongs to.
+func tusUploadID(name string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".new"), tusInfoSuffix)
+
+	return strings.TrimPrefix(base, tusStagingPrefix)
+}
+
+// tusUploadExpired reports whether the tus staging entry name belongs to
+// an upload past its expiry. An entry without a readable record is judged
+// by its own age, so neither a crash between writing the two files nor a
+// create in progress can pin or lose it.
+func tusUploadExpired(stage, name string, now time.Time) bool {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".new"), tusInfoSuffix)
+
+	info, err := readTusInfo(filepath.Join(stage, base))
+	if err == nil {
+		return now.After(info.Expires)
+	}
+
+	st, statErr := os.Stat(filepath.Join(stage, name))
+
+	return statErr == nil && now.Sub(st.ModTime()) > tusOrphanGrace
+}
+
+// reclaimExpiredTusUploads removes abandoned uploads while the server runs;
+// the startup sweep covers the rest.
+func reclaimExpiredTusUploads(now time.Time) {
+	entries, err := os.ReadDir(absStagePath)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tusStagingPrefix) && tusUploadExpired(absStagePath, e.Name(), now) {
+			removeStaged(filepath.Join(absStagePath, e.Name()))
+			tusLocks.Delete(tusUploadID(e.Name()))
+		}
+	}
+}
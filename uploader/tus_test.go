@@ -0,0 +1,335 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tusServer(t *testing.T) (*echo.Echo, string) {
+	t.Helper()
+
+	return configuredServer(t, serverConfig{tus: tusConfig{expiration: time.Hour, maxSize: 1 << 20}})
+}
+
+func tusRequest(e *echo.Echo, method, target string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func tusMetadata(kv ...string) string {
+	var b bytes.Buffer
+
+	for i := 0; i < len(kv); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(kv[i] + " " + base64.StdEncoding.EncodeToString([]byte(kv[i+1])))
+	}
+
+	return b.String()
+}
+
+func tusCreate(t *testing.T, e *echo.Echo, length int, metadata string) string {
+	t.Helper()
+
+	rec := tusRequest(e, http.MethodPost, tusRoutePrefix, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	return rec.Header().Get(echo.HeaderLocation)
+}
+
+func tusPatch(e *echo.Echo, location string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	return tusRequest(e, http.MethodPatch, location, body, map[string]string{
+		echo.HeaderContentType: tusOffsetContentType,
+		"Upload-Offset":        strconv.Itoa(offset),
+	})
+}
+
+// interruptedReader ends with an error instead of EOF, like a dropped connection.
+type interruptedReader struct {
+	r io.Reader
+}
+
+func (i *interruptedReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func TestTusResumesAfterDroppedConnection(t *testing.T) {
+	e, tempdir := tusServer(t)
+
+	content := []byte("0123456789abcdefghij")
+	location := tusCreate(t, e, len(content), tusMetadata("path", "builds/app.bin"))
+
+	rec := tusPatch(e, location, 0, &interruptedReader{r: bytes.NewReader(content[:7])})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "dropped body")
+
+	rec = tusRequest(e, http.MethodHead, location, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "7", rec.Header().Get("Upload-Offset"), "bytes before the drop are kept")
+	assert.Equal(t, "20", rec.Header().Get("Upload-Length"))
+	assert.Equal(t, "no-store", rec.Header().Get(echo.HeaderCacheControl))
+
+	rec = tusPatch(e, location, 0, bytes.NewReader(content))
+	assert.Equal(t, http.StatusConflict, rec.Code, "stale offset")
+
+	_, err := os.Stat(filepath.Join(tempdir, "builds", "app.bin"))
+	assert.True(t, os.IsNotExist(err), "nothing published before the last byte")
+
+	rec = tusPatch(e, location, 7, bytes.NewReader(content[7:]))
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	assert.Equal(t, "20", rec.Header().Get("Upload-Offset"))
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "builds", "app.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	leftovers, err := filepath.Glob(filepath.Join(tempdir, stagingDir, tusStagingPrefix+"*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+
+	rec = tusRequest(e, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestTusCreationWithUploadExtractsTarGz(t *testing.T) {
+	e, tempdir := tusServer(t)
+
+	archive := makeTarGz(t, "T", 3)
+
+	rec := tusRequest(e, http.MethodPost, tusRoutePrefix, bytes.NewReader(archive), map[string]string{
+		"Upload-Length":        strconv.Itoa(len(archive)),
+		"Upload-Metadata":      tusMetadata("path", "site", "targz", "true"),
+		echo.HeaderContentType: tusOffsetContentType,
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, strconv.Itoa(len(archive)), rec.Header().Get("Upload-Offset"))
+
+	got, err := os.ReadFile(filepath.Join(tempdir, "site", "T-2.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "T/file-2-content", string(got))
+}
+
+func TestTusRejectsOversizedChunk(t *testing.T) {
+	e, _ := tusServer(t)
+
+	location := tusCreate(t, e, 4, tusMetadata("path", "small.bin"))
+
+	rec := tusPatch(e, location, 0, bytes.NewReader([]byte("too long")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = tusRequest(e, http.MethodHead, location, nil, nil)
+	assert.Equal(t, "4", rec.Header().Get("Upload-Offset"), "excess bytes are dropped")
+
+	rec = tusRequest(e, http.MethodPost, tusRoutePrefix, nil, map[string]string{"Upload-Length": strconv.Itoa(2 << 20)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "Upload-Length above the limit")
+}
+
+func TestTusTerminationAndExpiry(t *testing.T) {
+	e, tempdir := tusServer(t)
+
+	location := tusCreate(t, e, 10, tusMetadata("path", "a.bin"))
+
+	rec := tusRequest(e, http.MethodDelete, location, nil, nil)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = tusRequest(e, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	location = tusCreate(t, e, 10, tusMetadata("path", "b.bin"))
+	data := filepath.Join(tempdir, stagingDir, tusStagingPrefix+filepath.Base(location))
+
+	info, err := readTusInfo(data)
+	require.NoError(t, err)
+
+	info.Expires = time.Now().Add(-time.Minute)
+	require.NoError(t, writeTusInfo(data, info))
+
+	rec = tusPatch(e, location, 0, bytes.NewReader([]byte("x")))
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	_, err = os.Stat(data)
+	assert.True(t, os.IsNotExist(err), "expired upload is reclaimed")
+}
+
+func TestTusProtocolHeaders(t *testing.T) {
+	e, _ := configuredServer(t, serverConfig{credentials: "user:pass", tus: tusConfig{maxSize: 1024}})
+
+	req := httptest.NewRequest(http.MethodOptions, tusRoutePrefix, nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code, "discovery needs no credentials")
+	assert.Equal(t, tusExtensions, rec.Header().Get("Tus-Extension"))
+	assert.Equal(t, "1024", rec.Header().Get("Tus-Max-Size"))
+
+	req = httptest.NewRequest(http.MethodPost, tusRoutePrefix, nil)
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Upload-Length", "1")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code, "missing Tus-Resumable")
+
+	rec = tusRequest(e, http.MethodHead, tusRoutePrefix+"/0123456789abcdef", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "HEAD exposes metadata, so it is authenticated")
+}
+
+func TestSweepKeepsUnexpiredTusUploads(t *testing.T) {
+	stage := t.TempDir()
+
+	write := func(name string, info *tusInfo) {
+		require.NoError(t, os.WriteFile(filepath.Join(stage, name), []byte("data"), 0o644))
+
+		if info != nil {
+			require.NoError(t, writeTusInfo(filepath.Join(stage, name), *info))
+		}
+	}
+
+	write("tus-live", &tusInfo{Length: 10, Expires: time.Now().Add(time.Hour)})
+	write("tus-dead", &tusInfo{Length: 10, Expires: time.Now().Add(-time.Hour)})
+	write("tus-fresh-orphan", nil)
+	write("tus-old-orphan", nil)
+	write("up-leftover", nil)
+
+	old := time.Now().Add(-2 * tusOrphanGrace)
+	require.NoError(t, os.Chtimes(filepath.Join(stage, "tus-old-orphan"), old, old))
+
+	sweepStagingOrphans(stage)
+
+	entries, err := os.ReadDir(stage)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	assert.ElementsMatch(t, []string{"tus-live", "tus-live.info", "tus-fresh-orphan"}, names)
+}
+
+func TestTusCreateChecksTheDestination(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "auth.yaml")
+	writeCredentialFile(t, p, `
+tokens:
+  - name: team-a
+    sha256: `+sha256Hex([]byte("a-token"))+`
+    scopes: [read, write]
+    prefixes: [team-a, releases]
+`)
+
+	f, err := loadCredentialFile(p, 0)
+	require.NoError(t, err)
+
+	e, tempdir := configuredServer(t, serverConfig{
+		credentialFile:    f,
+		immutablePrefixes: []string{"releases"},
+		tus:               tusConfig{expiration: time.Hour, maxSize: 1 << 20},
+	})
+
+	rec := rawPut(e, "/releases/v1.bin", []byte("v1"), bearer("a-token"))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	create := func(path string) int {
+		header := bearer("a-token")
+		header["Upload-Length"] = "2"
+		header["Upload-Metadata"] = tusMetadata("path", path)
+
+		return tusRequest(e, http.MethodPost, tusRoutePrefix, nil, header).Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, create("team-b/x.bin"), "a path outside the caller's prefixes")
+	assert.Equal(t, http.StatusConflict, create("releases/v1.bin"), "an immutable path that exists")
+
+	entries, err := os.ReadDir(filepath.Join(tempdir, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "a refused create allocates nothing")
+
+	assert.Equal(t, http.StatusCreated, create("team-a/x.bin"))
+}
+
+func TestTusHeadDuringPatch(t *testing.T) {
+	e, _ := tusServer(t)
+
+	location := tusCreate(t, e, 10, tusMetadata("path", "slow.bin"))
+
+	pr, pw := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+
+	go func() { done <- tusPatch(e, location, 0, pr) }()
+
+	_, err := pw.Write([]byte("01234"))
+	require.NoError(t, err)
+
+	// The write above returns once the PATCH read it, not once it is on
+	// disk, so poll.
+	assert.Eventually(t, func() bool {
+		rec := tusRequest(e, http.MethodHead, location, nil, nil)
+		return rec.Code == http.StatusOK && rec.Header().Get("Upload-Offset") == "5"
+	}, 5*time.Second, 10*time.Millisecond, "HEAD must answer while the PATCH is running")
+
+	rec := tusPatch(e, location, 5, bytes.NewReader([]byte("56789")))
+	assert.Equal(t, http.StatusLocked, rec.Code, "a second writer is still refused")
+
+	require.NoError(t, pw.Close())
+
+	rec = <-done
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+}
+
+func TestTusReclaimDropsTheUploadLock(t *testing.T) {
+	e, tempdir := tusServer(t)
+
+	location := tusCreate(t, e, 10, tusMetadata("path", "a.bin"))
+	id := filepath.Base(location)
+	data := filepath.Join(tempdir, stagingDir, tusStagingPrefix+id)
+
+	rec := tusPatch(e, location, 0, bytes.NewReader([]byte("01234")))
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	_, ok := tusLocks.Load(id)
+	require.True(t, ok)
+
+	info, err := readTusInfo(data)
+	require.NoError(t, err)
+
+	info.Expires = time.Now().Add(-time.Minute)
+	require.NoError(t, writeTusInfo(data, info))
+
+	reclaimExpiredTusUploads(time.Now())
+
+	_, err = os.Stat(data)
+	assert.True(t, os.IsNotExist(err))
+
+	_, ok = tusLocks.Load(id)
+	assert.False(t, ok, "a reclaimed upload leaves no lock behind")
+}
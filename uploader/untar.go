@@ -2,7 +2,6 @@ package uploader
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
@@ -11,7 +10,7 @@ import (
 	"strings"
 )
 
-// Package uploader provides HTTP upload server functionality with support for file uploads and tar.gz extraction.
+// Package uploader provides HTTP upload server functionality with support for file uploads and archive extraction.
 
 const (
 	// MaxFileSize limits individual file size to prevent zip bombs (2GB)
@@ -23,13 +22,19 @@ const (
 // UntarGz safely extracts a tar.gz archive to the destination directory
 // with security protections against path traversal, symlink attacks, and resource exhaustion
 func UntarGz(dst string, r io.Reader) error {
-	absDst, gzr, err := setupExtraction(dst, r)
+	return untar(dst, r, formatTarGz)
+}
+
+// untar is UntarGz for any tar-based format: the protections are the same,
+// only the decompressor in front of the tar reader changes.
+func untar(dst string, r io.Reader, format archiveFormat) error {
+	absDst, dr, err := setupExtraction(dst, r, format)
 	if err != nil {
 		return err
 	}
-	defer closeGzipReader(gzr)
+	defer closeDecompressor(dr)
 
-	tr := tar.NewReader(gzr)
+	tr := tar.NewReader(dr)
 
 	// Track actual bytes written instead of header-declared sizes
 	var totalWritten int64
@@ -42,25 +47,25 @@ func UntarGz(dst string, r io.Reader) error {
 	return extractArchive(tr, absDst, &totalWritten, ensuredDirs)
 }
 
-// setupExtraction prepares the destination and gzip reader
-func setupExtraction(dst string, r io.Reader) (string, *gzip.Reader, error) {
+// setupExtraction prepares the destination and decompressing reader
+func setupExtraction(dst string, r io.Reader, format archiveFormat) (string, io.ReadCloser, error) {
 	absDst, err := filepath.Abs(dst)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to get absolute path for destination: %w", err)
 	}
 
-	gzr, err := gzip.NewReader(r)
+	dr, err := newDecompressor(format, r)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		return "", nil, err
 	}
 
-	return absDst, gzr, nil
+	return absDst, dr, nil
 }
 
-// closeGzipReader safely closes the gzip reader
-func closeGzipReader(gzr *gzip.Reader) {
-	if closeErr := gzr.Close(); closeErr != nil {
-		log.Printf("warning: failed to close gzip reader: %v", closeErr)
+// closeDecompressor safely closes the decompressing reader
+func closeDecompressor(dr io.ReadCloser) {
+	if closeErr := dr.Close(); closeErr != nil {
+		log.Printf("warning: failed to close decompressor: %v", closeErr)
 	}
 }
 
@@ -106,8 +111,9 @@ func validateTotalSize(totalWritten int64, additionalBytes int64) error {
 	return nil
 }
 
-// processEntry handles different tar entry types
-func processEntry(header *tar.Header, target string, tr *tar.Reader, totalWritten *int64, ensuredDirs map[string]struct{}) error {
+// processEntry handles different tar entry types; zip entries are mapped
+// onto tar headers so both formats share the same checks
+func processEntry(header *tar.Header, target string, r io.Reader, totalWritten *int64, ensuredDirs map[string]struct{}) error {
 	switch header.Typeflag {
 	case tar.TypeDir:
 		if err := handleDirectory(target, header); err != nil {
@@ -117,7 +123,7 @@ func processEntry(header *tar.Header, target string, tr *tar.Reader, totalWritte
 		ensuredDirs[target] = struct{}{}
 
 	case tar.TypeReg:
-		written, err := handleRegularFile(target, header, tr, *totalWritten, ensuredDirs)
+		written, err := handleRegularFile(target, header, r, *totalWritten, ensuredDirs)
 		if err != nil {
 			return fmt.Errorf("failed to extract file %s: %w", header.Name, err)
 		}
@@ -155,7 +161,7 @@ func handleDirectory(target string, header *tar.Header) error {
 
 // handleRegularFile extracts a regular file with proper resource management
 // Returns the actual number of bytes written
-func handleRegularFile(target string, header *tar.Header, tr *tar.Reader, currentTotal int64, ensuredDirs map[string]struct{}) (int64, error) {
+func handleRegularFile(target string, header *tar.Header, r io.Reader, currentTotal int64, ensuredDirs map[string]struct{}) (int64, error) {
 	parent := filepath.Dir(target)
 	if _, ok := ensuredDirs[parent]; !ok {
 		if err := os.MkdirAll(parent, 0755); err != nil {
@@ -186,7 +192,7 @@ func handleRegularFile(target string, header *tar.Header, tr *tar.Reader, curren
 		currentTotal: currentTotal,
 	}
 
-	written, err := io.Copy(trackingWriter, tr)
+	written, err := io.Copy(trackingWriter, r)
 	if err != nil {
 		_ = os.Remove(target)
 		return 0, fmt.Errorf("failed to write file content: %w", err)
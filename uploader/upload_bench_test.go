@@ -68,7 +68,7 @@ func benchEnvStandalone(b *testing.B) *echo.Echo {
 
 	e := echo.New()
 	e.HideBanner = true
-	registerRoutes(e, http.FileServer(hideStagingFS{root: http.Dir(tempdir)}))
+	registerRoutes(e, serverConfig{}, hideStagingFS{root: http.Dir(tempdir)})
 
 	return e
 }
@@ -1,9 +1,12 @@
-// Package uploader provides HTTP upload server functionality with support for file uploads and tar.gz extraction.
+// Package uploader provides HTTP upload server functionality with support for file uploads and archive extraction.
 package uploader
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -52,9 +55,10 @@ func setUploadDirectory(dir string) error {
 // path. The trailing-separator check in isPathSafe rejects sibling-prefix
 // escapes such as "/data" vs "/data-evil". Paths that target the staging
 // directory (".tmp/...") are rejected because that dir holds in-flight
-// uploads that users must not observe or mutate.
+// uploads that users must not observe or mutate; the digest records under
+// ".meta/" are off limits for the same reason.
 func safeJoin(rel string) (string, error) {
-	if isStagingPath(rel) {
+	if isReservedPath(rel) {
 		return "", echo.NewHTTPError(http.StatusForbidden, "DENIED: path is reserved")
 	}
 
@@ -71,39 +75,46 @@ func safeJoin(rel string) (string, error) {
 // bound non-file fields here to prevent unbounded in-memory buffering.
 const maxUploadFieldSize = 1 << 20
 
-func wantTarGz(fields map[string]string) bool { return fields["targz"] == "true" }
-
 // Field order drives the early-rejection optimization: when `path` is
 // buffered before the file part, safeJoin runs before we touch the body
 // and a bad-path 403 costs zero disk I/O. curl -F preserves CLI order;
 // clients that send `path` first get the win.
+//
+// A request may carry several `file` parts. `path` and `sha256` fields bind
+// to the next file part; a file without a path lands at `prefix`/filename.
+// With a single file the fields may also follow it, as they always could.
 func upload(c echo.Context) error {
 	mr, err := c.Request().MultipartReader()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expected multipart request: %s", err))
 	}
 
+	// Malformed digest headers are rejected before the body is read.
+	if _, err := expectedSHA256(c.Request().Header, nil); err != nil {
+		return err
+	}
+
 	var (
+		ctx       = c.Request().Context()
+		cond      = writeConditionFromRequest(c.Request().Header)
 		fields    = make(map[string]string, 4)
-		haveFile  bool
-		filename  string
-		size      int64
-		stagedTmp string
-		stagedDir string
+		files     []*uploadedFile
 		committed bool
 	)
 
 	defer func() {
-		// stagedTmp must be removed unconditionally: on the regular-file path
-		// it's renamed away (Remove no-ops on ENOENT); on the late-path tar
-		// fallback extractStagedTempToDir reads it but doesn't unlink it.
-		// A `!committed` guard here would leak the temp on the late-tar path.
-		if stagedTmp != "" {
-			_ = os.Remove(stagedTmp)
-		}
+		for _, f := range files {
+			// staged.tmp must be removed unconditionally: on the regular-file
+			// path it's renamed away (Remove no-ops on ENOENT); on the late-path
+			// tar fallback extractStagedTempToDir reads it but doesn't unlink it.
+			// A `!committed` guard here would leak the temp on the late-tar path.
+			if f.staged.tmp != "" {
+				_ = os.Remove(f.staged.tmp)
+			}
 
-		if !committed && stagedDir != "" {
-			removeAllLogged(stagedDir)
+			if !committed && f.staged.dir != "" {
+				removeAllLogged(f.staged.dir)
+			}
 		}
 	}()
 
@@ -125,97 +136,320 @@ func upload(c echo.Context) error {
 			continue
 		}
 
-		if haveFile {
-			return echo.NewHTTPError(http.StatusBadRequest, "multiple file parts not supported")
+		// Extracted trees cannot be rolled back file by file.
+		if len(files) > 0 && wantsExtraction(fields) {
+			return echo.NewHTTPError(http.StatusBadRequest, "extraction supports a single file part")
 		}
 
-		haveFile = true
-		filename = part.FileName()
-
-		tmp, dir, n, err := consumeFilePart(part, fields, filename)
-		stagedTmp = tmp
-		stagedDir = dir
-		size = n
+		f := &uploadedFile{filename: part.FileName(), fields: make(map[string]string, 2)}
+		files = append(files, f)
 
-		if err != nil {
+		if f.staged, err = consumeFilePart(ctx, part, fields, f.filename, cond); err != nil {
 			return err
 		}
+
+		bindFileFields(f, fields)
 	}
 
-	if !haveFile {
+	if len(files) == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing 'file' part")
 	}
 
-	resolvedPath, abspath, err := resolveDestination(fields, filename)
+	if len(files) > 1 && wantsExtraction(fields) {
+		return echo.NewHTTPError(http.StatusBadRequest, "extraction supports a single file part")
+	}
+
+	format, err := extractFormat(fields)
 	if err != nil {
 		return err
 	}
 
-	if err := publishConsumed(c.Request().Context(), abspath, stagedTmp, stagedDir, wantTarGz(fields)); err != nil {
+	// Fields after the last file part only have an unambiguous owner when
+	// there is a single file.
+	if len(files) > 1 && (fields["path"] != "" || fields[sha256Field] != "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "'path' and 'sha256' fields must precede the file part they describe")
+	}
+
+	bindFileFields(files[0], fields)
+
+	// A digest header describes one body; per-file sha256 fields cover the rest.
+	header := c.Request().Header
+	if len(files) > 1 {
+		if want, _ := expectedSHA256(header, nil); len(want) > 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "digest headers need a single file part; use a sha256 field per file")
+		}
+	}
+
+	seen := make(map[string]bool, len(files))
+
+	for _, f := range files {
+		f.fields["prefix"] = fields["prefix"]
+
+		if f.resolvedPath, f.key, err = resolveDestination(f.fields, f.filename); err != nil {
+			return err
+		}
+
+		if seen[f.key] {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("duplicate destination %s", f.resolvedPath))
+		}
+
+		seen[f.key] = true
+
+		if err := verifySHA256(header, f.fields, f.staged.sha256); err != nil {
+			return err
+		}
+	}
+
+	if len(files) > 1 {
+		if err := publishBatch(ctx, files, cond); err != nil {
+			return err
+		}
+
+		committed = true
+
+		return c.JSON(http.StatusCreated, batchResponse(files))
+	}
+
+	f := files[0]
+
+	if err := publishConsumed(ctx, f.key, f.staged, format, cond); err != nil {
 		return err
 	}
 
 	committed = true
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"message":  fmt.Sprintf("File has been uploaded to %s", resolvedPath),
-		"filename": filename,
-		"path":     resolvedPath,
-		"size":     size,
+		"message":  fmt.Sprintf("File has been uploaded to %s", f.resolvedPath),
+		"filename": f.filename,
+		"path":     f.resolvedPath,
+		"size":     f.staged.size,
+		"sha256":   f.staged.sha256,
 	})
 }
 
-func resolveDestination(fields map[string]string, filename string) (string, string, error) {
-	resolvedPath := fields["path"]
-	if resolvedPath == "" {
-		resolvedPath = filename
+func wantsExtraction(fields map[string]string) bool {
+	return fields["extract"] != "" || fields["targz"] == "true"
+}
+
+// uploadedFile is one file part of a multipart upload together with the
+// per-file fields bound to it.
+type uploadedFile struct {
+	filename     string
+	fields       map[string]string
+	staged       stagedUpload
+	resolvedPath string
+	key          string
+}
+
+// bindFileFields moves the per-file fields read so far onto f, so the next
+// file part starts without them.
+func bindFileFields(f *uploadedFile, fields map[string]string) {
+	for _, name := range []string{"path", sha256Field} {
+		if v, ok := fields[name]; ok {
+			f.fields[name] = v
+			delete(fields, name)
+		}
+	}
+}
+
+func batchResponse(files []*uploadedFile) map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(files))
+	for _, f := range files {
+		list = append(list, map[string]interface{}{
+			"filename": f.filename,
+			"path":     f.resolvedPath,
+			"size":     f.staged.size,
+			"sha256":   f.staged.sha256,
+		})
+	}
+
+	return map[string]interface{}{
+		"message": fmt.Sprintf("%d files have been uploaded", len(files)),
+		"count":   len(files),
+		"files":   list,
+	}
+}
+
+// stagedUpload is a consumed file body: either a temp file or, when the
+// archive was extracted while streaming, a stage dir. sha256 always covers
+// the bytes as received.
+type stagedUpload struct {
+	tmp    string
+	dir    string
+	size   int64
+	sha256 string
+}
+
+// extractHeader selects archive extraction for raw PUT uploads, the
+// header counterpart of the multipart `extract` field.
+const extractHeader = "X-Extract"
+
+// uploadRaw is the multipart-free sibling of upload for clients that can
+// only send a request body (curl -T, plain HTTP PUT): the destination comes
+// from the URL and extraction from the X-Extract header. The path is
+// validated before the body is read, so a bad-path 403 costs no disk I/O.
+// A plain body with no digest header to verify is streamed straight to the
+// backend; only extraction and verification need the staged copy.
+func uploadRaw(c echo.Context) error {
+	resolvedPath, key, err := resolveDestination(map[string]string{"path": c.Param("*")}, "")
+	if err != nil {
+		return err
+	}
+
+	// "." and friends clean to the upload root; replacing that is never a
+	// valid upload.
+	if key == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing destination path")
+	}
+
+	if _, err := expectedSHA256(c.Request().Header, nil); err != nil {
+		return err
+	}
+
+	cond := writeConditionFromRequest(c.Request().Header)
+	if err := checkWrite(c.Request().Context(), key, cond); err != nil {
+		return err
+	}
+
+	var format archiveFormat
+
+	if extract := c.Request().Header.Get(extractHeader); extract != "" {
+		if format, err = parseArchiveFormat(extract); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported %s value %q", extractHeader, extract))
+		}
+	}
+
+	if want, _ := expectedSHA256(c.Request().Header, nil); format == "" && len(want) == 0 {
+		size, sum, err := putDigest(c.Request().Context(), key, c.Request().Body, cond)
+		if err != nil {
+			return publishHTTPError(err)
+		}
+
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"message": fmt.Sprintf("File has been uploaded to %s", resolvedPath),
+			"path":    resolvedPath,
+			"size":    size,
+			"sha256":  sum,
+		})
 	}
 
+	var (
+		staged    stagedUpload
+		committed bool
+	)
+
+	defer func() {
+		removeStaged(staged.tmp)
+
+		if !committed && staged.dir != "" {
+			removeAllLogged(staged.dir)
+		}
+	}()
+
+	if format != "" {
+		staged, err = streamArchiveToStage(c.Request().Body, format)
+	} else {
+		staged.tmp, staged.size, staged.sha256, err = streamPartToStagedTemp(c.Request().Body)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := verifySHA256(c.Request().Header, nil, staged.sha256); err != nil {
+		return err
+	}
+
+	if err := publishConsumed(c.Request().Context(), key, staged, format, cond); err != nil {
+		return err
+	}
+
+	committed = true
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"message": fmt.Sprintf("File has been uploaded to %s", resolvedPath),
+		"path":    resolvedPath,
+		"size":    staged.size,
+		"sha256":  staged.sha256,
+	})
+}
+
+// destinationFor picks the upload path: an explicit `path`, else the
+// filename, placed under `prefix` when one is given.
+func destinationFor(fields map[string]string, filename string) string {
+	if p := fields["path"]; p != "" {
+		return p
+	}
+
+	if prefix := fields["prefix"]; prefix != "" && filename != "" {
+		return prefix + "/" + filename
+	}
+
+	return filename
+}
+
+func resolveDestination(fields map[string]string, filename string) (string, string, error) {
+	resolvedPath := destinationFor(fields, filename)
+
 	if resolvedPath == "" {
 		return "", "", echo.NewHTTPError(http.StatusBadRequest, "missing destination path (set 'path' field or file Content-Disposition filename)")
 	}
 
-	abspath, err := safeJoin(resolvedPath)
+	key, err := safeKey(resolvedPath)
 	if err != nil {
 		return "", "", err
 	}
 
-	return resolvedPath, abspath, nil
+	return resolvedPath, key, nil
 }
 
-func publishConsumed(ctx context.Context, abspath, stagedTmp, stagedDir string, tarGz bool) error {
+// publishConsumed publishes a consumed upload at key. A non-empty format
+// means the upload is an archive: already extracted into staged.dir when
+// it could be streamed, otherwise extracted from staged.tmp now.
+func publishConsumed(ctx context.Context, key string, staged stagedUpload, format archiveFormat, cond writeCondition) error {
 	switch {
-	case stagedDir != "":
-		return publishDir(ctx, abspath, stagedDir)
-	case tarGz:
-		return extractStagedTempToDir(ctx, stagedTmp, abspath)
+	case staged.dir != "":
+		return publishDirDigests(ctx, key, staged.dir, cond)
+	case format != "":
+		return extractStagedTempToDir(ctx, staged.tmp, key, format, cond)
 	default:
-		return publishStaged(stagedTmp, abspath)
+		return publishFileDigest(ctx, key, staged.tmp, staged.sha256, cond)
 	}
 }
 
-func consumeFilePart(part *multipart.Part, fields map[string]string, filename string) (string, string, int64, error) {
-	if rawPath, ok := fields["path"]; ok {
-		candidate := rawPath
-		if candidate == "" {
-			candidate = filename
-		}
+func consumeFilePart(ctx context.Context, part *multipart.Part, fields map[string]string, filename string, cond writeCondition) (staged stagedUpload, err error) {
+	_, havePath := fields["path"]
+	_, havePrefix := fields["prefix"]
+
+	if havePath || havePrefix {
+		candidate := destinationFor(fields, filename)
 
 		// Early reject: do NOT call part.Close() on failure — Close drains
 		// the part body (io.Copy(io.Discard, p)), defeating the saved I/O.
-		if _, err := safeJoin(candidate); err != nil {
-			return "", "", 0, err
+		key, err := safeKey(candidate)
+		if err != nil {
+			return staged, err
 		}
 
-		if wantTarGz(fields) {
-			dir, n, err := streamTarToStageDir(part)
-			return "", dir, n, err
+		if key != "" {
+			if err := checkWrite(ctx, key, cond); err != nil {
+				return staged, err
+			}
+		}
+
+		format, err := extractFormat(fields)
+		if err != nil {
+			return staged, err
+		}
+
+		if format != "" {
+			return streamArchiveToStage(part, format)
 		}
 	}
 
-	tmp, n, err := streamPartToStagedTemp(part)
+	staged.tmp, staged.size, staged.sha256, err = streamPartToStagedTemp(part)
 
-	return tmp, "", n, err
+	return staged, err
 }
 
 func readField(part *multipart.Part, fields map[string]string) error {
@@ -237,12 +471,15 @@ func readField(part *multipart.Part, fields map[string]string) error {
 	return nil
 }
 
+// streamPartToStagedTemp spools r into the staging dir and returns the hex
+// SHA-256 of what was written, hashed on the way through so verifying an
+// upload never costs a second read.
 // On error returns the temp path (when create succeeded) so the caller
 // can Remove it — deviates from the usual zero-value-on-error convention.
-func streamPartToStagedTemp(r io.Reader) (string, int64, error) {
+func streamPartToStagedTemp(r io.Reader) (string, int64, string, error) {
 	f, err := os.CreateTemp(absStagePath, "up-*")
 	if err != nil {
-		return "", 0, fmt.Errorf("create temp: %w", err)
+		return "", 0, "", fmt.Errorf("create temp: %w", err)
 	}
 
 	tmpPath := f.Name()
@@ -250,21 +487,23 @@ func streamPartToStagedTemp(r io.Reader) (string, int64, error) {
 	// CreateTemp's 0600 default would break sidecars/backups running as other UIDs.
 	if err := f.Chmod(0o644); err != nil {
 		_ = f.Close()
-		return tmpPath, 0, fmt.Errorf("chmod temp: %w", err)
+		return tmpPath, 0, "", fmt.Errorf("chmod temp: %w", err)
 	}
 
-	n, copyErr := io.Copy(f, r)
+	h := sha256.New()
+	n, copyErr := io.Copy(io.MultiWriter(f, h), r)
 	closeErr := f.Close()
+	sum := hex.EncodeToString(h.Sum(nil))
 
 	if copyErr != nil {
-		return tmpPath, n, fmt.Errorf("write temp: %w", copyErr)
+		return tmpPath, n, sum, fmt.Errorf("write temp: %w", copyErr)
 	}
 
 	if closeErr != nil {
-		return tmpPath, n, fmt.Errorf("close temp: %w", closeErr)
+		return tmpPath, n, sum, fmt.Errorf("close temp: %w", closeErr)
 	}
 
-	return tmpPath, n, nil
+	return tmpPath, n, sum, nil
 }
 
 // 0755 (not MkdirTemp's 0700) keeps published artifacts readable by
@@ -283,46 +522,73 @@ func createTarStageDir() (string, error) {
 	return stage, nil
 }
 
-// On UntarGz error returns the stage dir path so the caller can clean up.
-func streamTarToStageDir(r io.Reader) (string, int64, error) {
-	stage, err := createTarStageDir()
-	if err != nil {
-		return "", 0, err
+// streamArchiveToStage consumes an archive upload. Tar formats are
+// extracted while streaming; zip needs random access, so it is spooled to
+// a temp file and extracted at publish time. On error the returned value
+// still names whatever was created, for the caller to clean up.
+func streamArchiveToStage(r io.Reader, format archiveFormat) (stagedUpload, error) {
+	var (
+		staged stagedUpload
+		err    error
+	)
+
+	br := bufio.NewReader(r)
+
+	if format == formatAuto {
+		if format, err = sniffArchiveFormat(br); err != nil {
+			return staged, err
+		}
 	}
 
-	cr := &countingReader{r: r}
-	if err := UntarGz(stage, cr); err != nil {
-		return stage, cr.n, err
+	if format == formatZip {
+		staged.tmp, staged.size, staged.sha256, err = streamPartToStagedTemp(br)
+	} else {
+		staged.dir, staged.size, staged.sha256, err = streamTarToStageDir(br, format)
 	}
 
-	return stage, cr.n, nil
+	return staged, err
 }
 
-// Late-path tar fallback: the file part arrived before targz=true was known,
-// so we already streamed it to a temp file and now have to extract it.
-func extractStagedTempToDir(ctx context.Context, stagedPath, finalPath string) error {
-	src, err := os.Open(stagedPath)
+// streamTarToStageDir extracts r into a fresh stage dir and returns the hex
+// SHA-256 of the archive bytes, like streamPartToStagedTemp. Whatever the
+// extractor leaves unread after the end-of-archive marker is drained so the
+// digest covers the whole body.
+// On extraction error returns the stage dir path so the caller can clean up.
+func streamTarToStageDir(r io.Reader, format archiveFormat) (string, int64, string, error) {
+	stage, err := createTarStageDir()
 	if err != nil {
-		return fmt.Errorf("open staged: %w", err)
+		return "", 0, "", err
 	}
 
-	defer func() {
-		if closeErr := src.Close(); closeErr != nil {
-			log.Printf("error closing staged tar source: %v", closeErr)
-		}
-	}()
+	h := sha256.New()
+	cr := &countingReader{r: io.TeeReader(r, h)}
+
+	if err := untar(stage, cr, format); err != nil {
+		return stage, cr.n, "", err
+	}
 
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return stage, cr.n, "", fmt.Errorf("read archive: %w", err)
+	}
+
+	return stage, cr.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Late-path extraction: the file part arrived before the extract field was
+// known, or it is a zip, so it was streamed to a temp file and is
+// extracted from there.
+func extractStagedTempToDir(ctx context.Context, stagedPath, key string, format archiveFormat, cond writeCondition) error {
 	stage, err := createTarStageDir()
 	if err != nil {
 		return err
 	}
 
-	if err := UntarGz(stage, src); err != nil {
+	if err := extractFile(stage, stagedPath, format); err != nil {
 		removeAllLogged(stage)
 		return err
 	}
 
-	if err := publishDir(ctx, finalPath, stage); err != nil {
+	if err := publishDirDigests(ctx, key, stage, cond); err != nil {
 		removeAllLogged(stage)
 		return err
 	}
@@ -353,12 +619,18 @@ func uploaderDelete(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "path is required")
 	}
 
-	abspath, err := safeJoin(path)
+	key, err := safeKey(path)
 	if err != nil {
 		return err
 	}
 
-	if _, err := os.Stat(abspath); err != nil {
+	ctx := c.Request().Context()
+
+	if err := authorizeTree(ctx, scopeDelete, key); err != nil {
+		return err
+	}
+
+	if _, err := store.Stat(ctx, key); err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return echo.NewHTTPError(http.StatusNotFound, "Could not find your file")
 		}
@@ -366,7 +638,7 @@ func uploaderDelete(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Could not stat your file: %s", err.Error()))
 	}
 
-	if err := os.RemoveAll(abspath); err != nil {
+	if err := deleteKey(ctx, key); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Could not delete your file: %s", err.Error()))
 	}
 
@@ -385,12 +657,16 @@ func healthCheck(c echo.Context) error {
 }
 
 func lastModified(c echo.Context) error {
-	abspath, err := safeJoin(c.Param("path"))
+	key, err := safeKey(c.Param("path"))
 	if err != nil {
 		return err
 	}
 
-	info, err := os.Stat(abspath)
+	if err := authorizeKey(c.Request().Context(), scopeRead, key); err != nil {
+		return err
+	}
+
+	info, err := store.Stat(c.Request().Context(), key)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return echo.NotFoundHandler(c)
@@ -401,21 +677,48 @@ func lastModified(c echo.Context) error {
 
 	c.Response().Header().Set(echo.HeaderLastModified, info.ModTime().UTC().Format(http.TimeFormat))
 
+	if !info.IsDir() {
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(info.Size(), 10))
+		setDigestHeaders(c.Response().Header(), lookupDigest(c.Request().Context(), key, info))
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
 func deleteOldFilesOfDir(c echo.Context) error {
 	path := c.FormValue("path")
 	days, _ := strconv.Atoi(c.FormValue("days"))
-	recursive := c.FormValue("recursive") == "true"
 
-	abspath, err := safeJoin(path)
+	key, err := safeKey(path)
 	if err != nil {
 		return err
 	}
 
-	files, err := findFilesOlderThanXDays(abspath, days, recursive)
+	if err := authorizeKey(c.Request().Context(), scopeDelete, key); err != nil {
+		return err
+	}
+
+	form, err := c.FormParams()
 	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	s := &oldFileSweep{
+		root:      key,
+		days:      days,
+		recursive: c.FormValue("recursive") == "true",
+		dryRun:    c.FormValue("dry_run") == "true",
+	}
+
+	if s.include, err = parseSweepGlobs("include", form["include"]); err != nil {
+		return err
+	}
+
+	if s.exclude, err = parseSweepGlobs("exclude", form["exclude"]); err != nil {
+		return err
+	}
+
+	if _, err := s.sweep(c.Request().Context(), key); err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return echo.NotFoundHandler(c)
 		}
@@ -423,44 +726,33 @@ func deleteOldFilesOfDir(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to find old files")
 	}
 
-	if len(files) == 0 {
-		return c.JSON(http.StatusAccepted, map[string]interface{}{
-			"message": "No old files found to delete",
-			"path":    path,
-			"days":    days,
-			"count":   0,
-		})
+	deleted := s.deleted
+	if deleted == nil {
+		deleted = []string{}
 	}
 
-	deletedCount := 0
-
-	for _, file := range files {
-		filePath := filepath.Join(abspath, file.Name())
+	message := "Old files deleted successfully"
 
-		// recursive=true allows directory entries; for those we must use
-		// RemoveAll because Remove fails on non-empty dirs. This restores
-		// the reference behavior that a prior refactor lost.
-		var rmErr error
-		if recursive && file.IsDir() {
-			rmErr = os.RemoveAll(filePath)
-		} else {
-			rmErr = os.Remove(filePath)
-		}
-
-		if rmErr != nil {
-			log.Printf("failed to delete %s: %v", file.Name(), rmErr)
-			continue
-		}
+	switch {
+	case len(deleted) == 0:
+		message = "No old files found to delete"
+	case s.dryRun:
+		message = "Old files that would be deleted"
+	}
 
-		deletedCount++
+	deletedCount := len(deleted)
+	if s.dryRun {
+		deletedCount = 0
 	}
 
 	return c.JSON(http.StatusAccepted, map[string]interface{}{
-		"message":       "Old files deleted successfully",
+		"message":       message,
 		"path":          path,
 		"days":          days,
-		"count":         deletedCount,
+		"dry_run":       s.dryRun,
+		"count":         len(deleted),
 		"deleted_count": deletedCount,
+		"deleted":       deleted,
 	})
 }
 
@@ -468,36 +760,6 @@ func isOlderThanXDays(t time.Time, days int) bool {
 	return time.Since(t) > (time.Duration(days) * 24 * time.Hour)
 }
 
-func findFilesOlderThanXDays(dir string, days int, recursive bool) (files []os.FileInfo, err error) {
-	tmpfiles, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
-	}
-
-	// Skip the staging dir when sweeping the upload root so a misconfigured
-	// cron (path="", recursive=true, days=0) can't wipe in-flight uploads.
-	skipStaging := dir == absRootDir
-
-	for _, file := range tmpfiles {
-		if skipStaging && file.Name() == stagingDir {
-			continue
-		}
-
-		info, err := file.Info()
-		if err != nil {
-			continue
-		}
-
-		if info.Mode().IsRegular() || (recursive && info.IsDir()) {
-			if isOlderThanXDays(info.ModTime(), days) {
-				files = append(files, info)
-			}
-		}
-	}
-
-	return files, nil
-}
-
 // Default server tunables. Only header- and idle-level timeouts are set; body
 // read/write timeouts are deliberately left at zero so they cannot truncate
 // legitimate multi-GB cache transfers under slow clients or slow disks.
@@ -510,9 +772,23 @@ const (
 )
 
 type serverConfig struct {
-	maxUploadSize   string
-	shutdownTimeout time.Duration
-	credentials     string
+	maxUploadSize     string
+	shutdownTimeout   time.Duration
+	credentials       string
+	credentialFile    *credentialFile
+	serviceAccounts   *serviceAccountAuth
+	immutablePrefixes []string
+	acls              []aclRule
+	readAuth          readAuthConfig
+	presign           presignConfig
+	storage           storageConfig
+	gradle            gradleConfig
+	actions           actionsConfig
+	turbo             turboConfig
+	tus               tusConfig
+	list              listConfig
+	eviction          evictionConfig
+	retention         retentionConfig
 }
 
 func loadConfig() (serverConfig, error) {
@@ -542,6 +818,22 @@ func loadConfig() (serverConfig, error) {
 		cfg.credentials = v
 	}
 
+	if v := os.Getenv("UPLOADER_AUTH_FILE"); v != "" {
+		f, err := loadCredentialFile(v, credentialReloadInterval)
+		if err != nil {
+			return cfg, fmt.Errorf("UPLOADER_AUTH_FILE: %w", err)
+		}
+
+		cfg.credentialFile = f
+	}
+
+	serviceAccounts, err := loadServiceAccountAuth()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.serviceAccounts = serviceAccounts
+
 	if v := os.Getenv("UPLOADER_MAX_UPLOAD_SIZE"); v != "" {
 		cfg.maxUploadSize = v
 	}
@@ -555,6 +847,90 @@ func loadConfig() (serverConfig, error) {
 		cfg.shutdownTimeout = d
 	}
 
+	immutable, err := loadImmutablePrefixes()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.immutablePrefixes = immutable
+
+	rules, err := loadACLs()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.acls = rules
+
+	storageCfg, err := loadStorageConfig()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.storage = storageCfg
+
+	gradleCfg, err := loadGradleConfig()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.gradle = gradleCfg
+
+	actionsCfg, err := loadActionsConfig(cfg.maxUploadSize)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.actions = actionsCfg
+
+	turboCfg, err := loadTurboConfig()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.turbo = turboCfg
+
+	tusCfg, err := loadTusConfig(cfg.maxUploadSize)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.tus = tusCfg
+
+	readAuthCfg, err := loadReadAuthConfig(cfg.authEnabled())
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.readAuth = readAuthCfg
+
+	presignCfg, err := loadPresignConfig(cfg.authEnabled())
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.presign = presignCfg
+
+	listCfg, err := loadListConfig(cfg.authEnabled())
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.list = listCfg
+
+	evictionCfg, err := loadEvictionConfig()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.eviction = evictionCfg
+
+	retentionCfg, err := loadRetentionConfig()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.retention = retentionCfg
+
 	if err := setUploadDirectory(dir); err != nil {
 		return cfg, err
 	}
@@ -563,39 +939,110 @@ func loadConfig() (serverConfig, error) {
 }
 
 // Shared between Uploader() and the test server so route registration cannot drift.
-func registerRoutes(e *echo.Echo, fileServer http.Handler) {
+// The write policy is installed here too, since every publish path is behind
+// one of these routes.
+func registerRoutes(e *echo.Echo, cfg serverConfig, files http.FileSystem) {
+	setImmutablePrefixes(cfg.immutablePrefixes)
+	setACLs(cfg.acls)
+
 	e.GET(healthPath, healthCheck)
+
+	// Retention runs are the only series.
+	if len(cfg.retention.Rules) > 0 {
+		e.GET(metricsPath, serveMetrics)
+	}
+
 	e.HEAD("/:path", lastModified)
 	e.POST("/upload", upload)
 	e.DELETE("/upload", uploaderDelete)
 	e.DELETE("/delete", deleteOldFilesOfDir)
-	e.GET("/*", echo.WrapHandler(fileServer))
+	registerBazelRoutes(e)
+	registerGradleRoutes(e, cfg.gradle, files)
+	registerGoproxyRoutes(e)
+	registerActionsCacheRoutes(e, cfg.actions)
+	registerTurboRoutes(e, cfg.turbo)
+	registerOCIRoutes(e)
+	registerTusRoutes(e, cfg.tus)
+	registerArchiveRoutes(e)
+	registerListRoutes(e, cfg.list)
+	registerPresignRoutes(e, cfg.presign)
+	e.PUT("/*", uploadRaw)
+	e.GET("/*", serveFiles(files))
 }
 
-// registerAuth mirrors go-simple-uploader: only mutating endpoints require creds.
-// rawCreds is assumed validated by loadConfig (contains ":"). The expected
-// username/password are converted to bytes once so the per-request validator is
-// allocation-free.
-func registerAuth(e *echo.Echo, rawCreds string) {
-	if rawCreds == "" {
+// registerAuth mirrors go-simple-uploader: only mutating endpoints require creds,
+// unless UPLOADER_AUTH_READS extends that to downloads.
+// Route groups that bring their own credentials (Gradle, Turborepo, and the
+// Actions cache when it has a token) are skipped here. Scopes are checked per route; the prefixes
+// a principal is limited to and the ACLs are checked where the handlers
+// resolve keys.
+func registerAuth(e *echo.Echo, cfg serverConfig) {
+	if !cfg.authEnabled() {
 		return
 	}
 
-	user, pass, _ := strings.Cut(rawCreds, ":")
-	expectedUser := []byte(user)
-	expectedPass := []byte(pass)
-
-	c := middleware.DefaultBasicAuthConfig
-	c.Skipper = func(ctx echo.Context) bool {
+	e.Use(newAuthenticator(cfg).middleware(func(ctx echo.Context) authMode {
 		if ctx.Path() == healthPath {
-			return true
+			return authExempt
+		}
+
+		if cfg.gradle.credentials != "" && isGradleRoute(ctx) {
+			return authExempt
+		}
+
+		if isTurboRoute(ctx.Path()) {
+			return authExempt
+		}
+
+		// Without its own token the Actions cache takes the server's
+		// credentials like any other route.
+		if cfg.actions.token != "" && isActionsRoute(ctx.Path()) {
+			return authExempt
 		}
 
 		method := ctx.Request().Method
 
-		return method == http.MethodHead || method == http.MethodGet
-	}
-	c.Validator = func(username, password string, _ echo.Context) (bool, error) {
+		// A tus HEAD reveals the destination path in Upload-Metadata, so
+		// only capability discovery is open there.
+		if isTusRoute(ctx.Path()) {
+			if method == http.MethodOptions {
+				return authExempt
+			}
+
+			return authRequired
+		}
+
+		// Listings reveal the whole tree, unlike a download by name.
+		if ctx.Path() == listRoute {
+			return authRequired
+		}
+
+		if method == http.MethodHead || method == http.MethodGet {
+			if cfg.readAuth.required && !cfg.readAuth.isPublic(ctx.Request().URL.Path) {
+				return authRequired
+			}
+
+			return authOptional
+		}
+
+		return authRequired
+	}))
+}
+
+func (cfg serverConfig) authEnabled() bool {
+	return cfg.credentials != "" || cfg.credentialFile != nil || cfg.serviceAccounts != nil
+}
+
+// basicAuthValidator checks against a single "username:password" pair.
+// rawCreds is assumed validated by loadConfig (contains ":"). The expected
+// username/password are converted to bytes once so the per-request validator is
+// allocation-free.
+func basicAuthValidator(rawCreds string) middleware.BasicAuthValidator {
+	user, pass, _ := strings.Cut(rawCreds, ":")
+	expectedUser := []byte(user)
+	expectedPass := []byte(pass)
+
+	return func(username, password string, _ echo.Context) (bool, error) {
 		if subtle.ConstantTimeCompare([]byte(username), expectedUser) == 1 &&
 			subtle.ConstantTimeCompare([]byte(password), expectedPass) == 1 {
 			return true, nil
@@ -603,7 +1050,6 @@ func registerAuth(e *echo.Echo, rawCreds string) {
 
 		return false, nil
 	}
-	e.Use(middleware.BasicAuthWithConfig(c))
 }
 
 func runWithGracefulShutdown(e *echo.Echo, addr string, shutdownTimeout time.Duration) error {
@@ -643,10 +1089,19 @@ func Uploader() error {
 		return err
 	}
 
+	// Even remote backends spool uploads and extract archives locally, so
+	// the staging dir is required regardless of UPLOADER_STORAGE.
 	if err := setupStagingDir(); err != nil {
 		return err
 	}
 
+	backend, err := newStorage(cfg.storage)
+	if err != nil {
+		return err
+	}
+
+	setStorage(backend)
+
 	// The multipart parser spools parts >32MB into os.TempDir(); on
 	// readOnlyRootFilesystem pods the default /tmp is unwritable so every
 	// large upload would fail with EROFS. Point TMPDIR at our writable PVC.
@@ -664,13 +1119,24 @@ func Uploader() error {
 	e.Use(middleware.Recover())
 	e.Use(middleware.Logger())
 	e.Use(middleware.BodyLimit(cfg.maxUploadSize))
-	registerAuth(e, cfg.credentials)
+	registerAuth(e, cfg)
+
+	registerRoutes(e, cfg, hideStagingFS{root: storageFS{store}})
 
-	registerRoutes(e, http.FileServer(hideStagingFS{root: http.Dir(absRootDir)}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cfg.eviction.quota > 0 {
+		go runEvictor(ctx, cfg.eviction)
+	}
+
+	if len(cfg.retention.Rules) > 0 {
+		go runRetention(ctx, cfg.retention)
+	}
 
 	addr := fmt.Sprintf("%s:%s", host, port)
-	log.Printf("krci-cache listening on %s (directory=%s, max_upload=%s, shutdown_timeout=%s)",
-		addr, directory, cfg.maxUploadSize, cfg.shutdownTimeout)
+	log.Printf("krci-cache listening on %s (directory=%s, storage=%s, max_upload=%s, shutdown_timeout=%s)",
+		addr, directory, cfg.storage.kind, cfg.maxUploadSize, cfg.shutdownTimeout)
 
 	return runWithGracefulShutdown(e, addr, cfg.shutdownTimeout)
 }